@@ -0,0 +1,386 @@
+// Package admin serves the local admin API of httpctl. Every endpoint but
+// the web UI and /flows/{id}/export answers in JSON:
+//
+//	GET    /health                     liveness
+//	GET    /ready                      readiness, 503 until the proxy listens
+//	GET    /logging/{logger}           log level of a logger, see zap.AtomicLevel
+//	PUT    /logging/{logger}           set the log level of a logger
+//	GET    /                           redirect to the web UI at /ui/
+//	GET    /flows                      recent flows, oldest first
+//	GET    /flows/{id}                 a recent or stored flow
+//	POST   /flows/{id}/replay          send the request of a flow again
+//	GET    /flows/{id}/export          the request of a flow as a snippet, see core.ExportRequest
+//	GET    /stream                     live flows, as Server-Sent Events or WebSocket
+//	GET    /executors                  configured executors
+//	POST   /executors/{name}/enable    enable an executor
+//	POST   /executors/{name}/disable   disable an executor
+//	GET    /resolver/cache             cached DNS lookups
+//	DELETE /resolver/cache             flush the DNS cache
+//	GET    /certs                      certificates signed so far
+//	GET    /rules                      rules applied
+//	POST   /rules/reload               reload the rules file
+//	       /breakpoints/...            see core.Breakpoints.Handler
+//
+// /flows and /stream accept the host, method, url, minStatus, maxStatus and
+// limit query parameters of executor.FlowFilter, and status for an exact
+// status such as 404 or a class such as 4xx. /flows lists the flow store
+// instead of the recent flows with source=store. /flows/{id} decodes the
+// bodies with decode=true. /flows/{id}/export takes the format parameter,
+// one of core.ExportFormats, and renders a curl command by default.
+//
+// When a token is configured, every endpoint but /health, /ready and the
+// web UI requires it, as a bearer token or, for browsers opening streams,
+// as the access_token query parameter. Without a token, these endpoints
+// require a loopback Host, so that pages cannot reach them by rebinding
+// their own name to 127.0.0.1. Requests changing state are refused when
+// sent from another origin or with a body other than JSON.
+package admin
+
+import (
+	"crypto/subtle"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"github.com/millken/httpctl/certer"
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/core"
+	"github.com/millken/httpctl/executor"
+	"github.com/millken/httpctl/internal/httpjson"
+	"github.com/millken/httpctl/log"
+	"github.com/millken/httpctl/resolver"
+	"github.com/millken/httpctl/rules"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// DefaultMaxFlows is the number of recent flows kept when the config does
+// not say.
+const DefaultMaxFlows = 1000
+
+// RecentBodyLimit is the number of body bytes kept in the recent flows,
+// which are held in memory.
+var RecentBodyLimit = 64 << 10
+
+var errNotFound = errors.New("not found")
+
+// Server is the admin API. The components it controls are set before
+// Handler is called; the endpoints of those left unset answer 404.
+type Server struct {
+	addr  string
+	token string
+	log   *zap.Logger
+	ready int32
+
+	execute     *executor.Execute
+	resolver    *resolver.Resolver
+	certs       *certer.CertCA
+	rules       *rules.Engine
+	breakpoints *core.Breakpoints
+	transport   http.RoundTripper
+	hub         *Hub
+
+	flowsMu  sync.Mutex
+	flows    []*core.Flow
+	maxFlows int
+}
+
+// New returns the admin API configured by cfg. It fails if cfg listens
+// beyond loopback without a token.
+func New(cfg config.Admin) (*Server, error) {
+	addr, err := listenAddr(cfg.Listen)
+	if err != nil {
+		return nil, err
+	}
+	host, _, _ := net.SplitHostPort(addr)
+	if cfg.Token == "" && !isLoopback(host) {
+		return nil, errors.Errorf("admin listens on '%s' beyond loopback without a token", addr)
+	}
+	s := &Server{
+		addr:     addr,
+		token:    cfg.Token,
+		log:      log.Logger("admin"),
+		hub:      NewHub(),
+		maxFlows: cfg.MaxFlows,
+	}
+	if s.maxFlows <= 0 {
+		s.maxFlows = DefaultMaxFlows
+	}
+	return s, nil
+}
+
+// listenAddr returns listen with the loopback address as default host.
+func listenAddr(listen string) (string, error) {
+	host, port, err := net.SplitHostPort(listen)
+	if err != nil {
+		return "", errors.Wrapf(err, "invalid admin listen address '%s'", listen)
+	}
+	if host == "" {
+		host = "127.0.0.1"
+	}
+	return net.JoinHostPort(host, port), nil
+}
+
+func isLoopback(host string) bool {
+	if strings.EqualFold(host, "localhost") {
+		return true
+	}
+	ip := net.ParseIP(host)
+	return ip != nil && ip.IsLoopback()
+}
+
+// Addr returns the address the admin API listens on.
+func (s *Server) Addr() string {
+	return s.addr
+}
+
+// SetExecutor makes the executors of e controllable.
+func (s *Server) SetExecutor(e *executor.Execute) { s.execute = e }
+
+// SetResolver exposes the cache of r.
+func (s *Server) SetResolver(r *resolver.Resolver) { s.resolver = r }
+
+// SetCertCA lists the certificates signed by ca.
+func (s *Server) SetCertCA(ca *certer.CertCA) { s.certs = ca }
+
+// SetRules makes the rules of e reloadable.
+func (s *Server) SetRules(e *rules.Engine) { s.rules = e }
+
+// SetBreakpoints serves the control API of b below /breakpoints/.
+func (s *Server) SetBreakpoints(b *core.Breakpoints) { s.breakpoints = b }
+
+// SetTransport replays the requests of flows through rt.
+func (s *Server) SetTransport(rt http.RoundTripper) { s.transport = rt }
+
+// SetReady sets whether /ready reports the proxy as ready.
+func (s *Server) SetReady(ready bool) {
+	var v int32
+	if ready {
+		v = 1
+	}
+	atomic.StoreInt32(&s.ready, v)
+}
+
+// RecordFlow publishes f on the live stream and keeps it among the recent
+// flows, with its bodies truncated to RecentBodyLimit. It is a
+// core.FlowHandler.
+func (s *Server) RecordFlow(f *core.Flow) {
+	s.hub.Publish(f)
+	if len(f.Request.Body) > RecentBodyLimit || (f.Response != nil && len(f.Response.Body) > RecentBodyLimit) {
+		copied := *f
+		if len(f.Request.Body) > RecentBodyLimit {
+			copied.Request.Body = append([]byte(nil), f.Request.Body[:RecentBodyLimit]...)
+			copied.Request.BodyTruncated = true
+		}
+		if f.Response != nil && len(f.Response.Body) > RecentBodyLimit {
+			response := *f.Response
+			response.Body = append([]byte(nil), f.Response.Body[:RecentBodyLimit]...)
+			response.BodyTruncated = true
+			copied.Response = &response
+		}
+		f = &copied
+	}
+	s.flowsMu.Lock()
+	defer s.flowsMu.Unlock()
+	if len(s.flows) >= s.maxFlows {
+		n := copy(s.flows, s.flows[len(s.flows)-s.maxFlows+1:])
+		s.flows = s.flows[:n]
+	}
+	s.flows = append(s.flows, f)
+}
+
+// ListenAndServe serves the admin API until it fails.
+func (s *Server) ListenAndServe() error {
+	s.log.Info("admin API listening", zap.String("addr", s.addr))
+	return http.ListenAndServe(s.addr, s.Handler())
+}
+
+// Handler returns the admin API.
+func (s *Server) Handler() http.Handler {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		httpjson.Write(w, http.StatusOK, map[string]string{"status": "ok"})
+	})
+	mux.HandleFunc("/ready", func(w http.ResponseWriter, r *http.Request) {
+		if atomic.LoadInt32(&s.ready) == 0 {
+			httpjson.Write(w, http.StatusServiceUnavailable, map[string]string{"status": "starting"})
+			return
+		}
+		httpjson.Write(w, http.StatusOK, map[string]string{"status": "ready"})
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/" {
+			httpjson.Error(w, http.StatusNotFound, errNotFound)
+			return
+		}
+		http.Redirect(w, r, "/ui/", http.StatusFound)
+	})
+	mux.Handle("/ui/", http.StripPrefix("/ui", uiHandler()))
+	logging := http.NewServeMux()
+	log.RegisterLevelConfigMux(logging)
+	mux.Handle("/logging/", s.authorize(logging))
+	mux.Handle("/flows", s.authorize(http.HandlerFunc(s.serveFlows)))
+	mux.Handle("/flows/", s.authorize(http.HandlerFunc(s.serveFlow)))
+	mux.Handle("/stream", s.authorize(http.HandlerFunc(s.serveStream)))
+	mux.Handle("/executors", s.authorize(http.HandlerFunc(s.serveExecutors)))
+	mux.Handle("/executors/", s.authorize(http.HandlerFunc(s.serveExecutor)))
+	mux.Handle("/resolver/cache", s.authorize(http.HandlerFunc(s.serveResolverCache)))
+	mux.Handle("/certs", s.authorize(http.HandlerFunc(s.serveCerts)))
+	mux.Handle("/rules", s.authorize(http.HandlerFunc(s.serveRules)))
+	mux.Handle("/rules/reload", s.authorize(http.HandlerFunc(s.serveRulesReload)))
+	if s.breakpoints != nil {
+		mux.Handle("/breakpoints/", s.authorize(http.StripPrefix("/breakpoints", s.breakpoints.Handler())))
+	}
+	return mux
+}
+
+func (s *Server) authorize(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if !s.authorized(r) {
+			httpjson.Error(w, http.StatusUnauthorized, errors.New("unauthorized"))
+			return
+		}
+		if status, err := s.checkBrowser(r); err != nil {
+			httpjson.Error(w, status, err)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if s.token == "" {
+		return true
+	}
+	token := r.URL.Query().Get("access_token")
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		token = auth[len("Bearer "):]
+	}
+	return subtle.ConstantTimeCompare([]byte(token), []byte(s.token)) == 1
+}
+
+// checkBrowser refuses the requests a hostile page could make through the
+// browser of the user, returning the status to answer with.
+func (s *Server) checkBrowser(r *http.Request) (int, error) {
+	if s.token == "" && !isLoopback(hostname(r.Host)) {
+		return http.StatusForbidden, errors.Errorf("host '%s' not allowed", r.Host)
+	}
+	switch r.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions:
+		return 0, nil
+	}
+	if origin := r.Header.Get("Origin"); origin != "" && !sameOrigin(origin, r.Host) {
+		return http.StatusForbidden, errors.Errorf("origin '%s' not allowed", origin)
+	}
+	if ct := r.Header.Get("Content-Type"); ct != "" {
+		if mediaType, _, _ := mime.ParseMediaType(ct); mediaType != "application/json" {
+			return http.StatusUnsupportedMediaType, errors.Errorf("content type '%s' not allowed", ct)
+		}
+	}
+	return 0, nil
+}
+
+// hostname returns host without its port and brackets.
+func hostname(host string) string {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		return h
+	}
+	return strings.TrimSuffix(strings.TrimPrefix(host, "["), "]")
+}
+
+// sameOrigin returns true if origin, the value of an Origin header, names
+// host.
+func sameOrigin(origin, host string) bool {
+	u, err := url.Parse(origin)
+	return err == nil && strings.EqualFold(u.Host, host)
+}
+
+func (s *Server) serveExecutors(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpjson.MethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	if s.execute == nil {
+		httpjson.Write(w, http.StatusOK, []executor.ExecutorState{})
+		return
+	}
+	httpjson.Write(w, http.StatusOK, s.execute.Executors())
+}
+
+func (s *Server) serveExecutor(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/executors/"), "/")
+	if len(parts) != 2 || (parts[1] != "enable" && parts[1] != "disable") || s.execute == nil {
+		httpjson.Error(w, http.StatusNotFound, errNotFound)
+		return
+	}
+	if r.Method != http.MethodPost {
+		httpjson.MethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	if err := s.execute.SetEnabled(parts[0], parts[1] == "enable"); err != nil {
+		httpjson.Error(w, http.StatusNotFound, err)
+		return
+	}
+	httpjson.Write(w, http.StatusOK, s.execute.Executors())
+}
+
+func (s *Server) serveResolverCache(w http.ResponseWriter, r *http.Request) {
+	if s.resolver == nil {
+		httpjson.Error(w, http.StatusNotFound, errors.New("resolver is not enabled"))
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		httpjson.Write(w, http.StatusOK, s.resolver.Cache())
+	case http.MethodDelete:
+		n := s.resolver.Flush()
+		s.log.Info("resolver cache flushed", zap.Int("entries", n))
+		httpjson.Write(w, http.StatusOK, map[string]int{"flushed": n})
+	default:
+		httpjson.MethodNotAllowed(w, http.MethodGet, http.MethodDelete)
+	}
+}
+
+func (s *Server) serveCerts(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpjson.MethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	certs := []certer.CachedCert{}
+	if s.certs != nil {
+		certs = append(certs, s.certs.Certificates()...)
+	}
+	httpjson.Write(w, http.StatusOK, certs)
+}
+
+func (s *Server) serveRules(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpjson.MethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	if s.rules == nil {
+		httpjson.Write(w, http.StatusOK, []rules.Rule{})
+		return
+	}
+	httpjson.Write(w, http.StatusOK, s.rules.Rules())
+}
+
+func (s *Server) serveRulesReload(w http.ResponseWriter, r *http.Request) {
+	if s.rules == nil {
+		httpjson.Error(w, http.StatusNotFound, errors.New("rules are not enabled"))
+		return
+	}
+	if r.Method != http.MethodPost {
+		httpjson.MethodNotAllowed(w, http.MethodPost)
+		return
+	}
+	if err := s.rules.Reload(); err != nil {
+		httpjson.Error(w, http.StatusUnprocessableEntity, err)
+		return
+	}
+	httpjson.Write(w, http.StatusOK, s.rules.Rules())
+}
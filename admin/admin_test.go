@@ -0,0 +1,330 @@
+package admin
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/millken/httpctl/certer"
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/core"
+	"github.com/millken/httpctl/executor"
+	"github.com/millken/httpctl/log"
+	"github.com/millken/httpctl/resolver"
+	"github.com/millken/httpctl/rules"
+	"github.com/stretchr/testify/require"
+)
+
+type client struct {
+	t     *testing.T
+	url   string
+	token string
+}
+
+func newTestServer(t *testing.T, cfg config.Admin) (*Server, *client) {
+	if cfg.Listen == "" {
+		cfg.Listen = ":0"
+	}
+	s, err := New(cfg)
+	require.NoError(t, err)
+	return s, &client{t: t, token: cfg.Token}
+}
+
+func (c *client) start(s *Server) {
+	srv := httptest.NewServer(s.Handler())
+	c.t.Cleanup(srv.Close)
+	c.url = srv.URL
+}
+
+func (c *client) do(method, path, body string) (int, string) {
+	req, err := http.NewRequest(method, c.url+path, strings.NewReader(body))
+	require.NoError(c.t, err)
+	return c.send(req)
+}
+
+func (c *client) send(req *http.Request) (int, string) {
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(c.t, err)
+	defer res.Body.Close()
+	b, err := io.ReadAll(res.Body)
+	require.NoError(c.t, err)
+	return res.StatusCode, string(b)
+}
+
+func TestNew(t *testing.T) {
+	require := require.New(t)
+	s, err := New(config.Admin{Listen: ":9090"})
+	require.NoError(err)
+	require.Equal("127.0.0.1:9090", s.Addr())
+	_, err = New(config.Admin{Listen: "[::1]:9090"})
+	require.NoError(err)
+	_, err = New(config.Admin{Listen: "localhost:9090"})
+	require.NoError(err)
+
+	_, err = New(config.Admin{Listen: "0.0.0.0:9090"})
+	require.EqualError(err, "admin listens on '0.0.0.0:9090' beyond loopback without a token")
+	_, err = New(config.Admin{Listen: "0.0.0.0:9090", Token: "secret"})
+	require.NoError(err)
+	_, err = New(config.Admin{Listen: "9090"})
+	require.Error(err)
+}
+
+func TestToken(t *testing.T) {
+	require := require.New(t)
+	s, c := newTestServer(t, config.Admin{Token: "secret"})
+	c.start(s)
+
+	code, _ := c.do("GET", "/flows", "")
+	require.Equal(http.StatusOK, code)
+
+	c.token = "wrong"
+	code, body := c.do("GET", "/flows", "")
+	require.Equal(http.StatusUnauthorized, code)
+	require.JSONEq(`{"error":"unauthorized"}`, body)
+	code, _ = c.do("GET", "/logging/global", "")
+	require.Equal(http.StatusUnauthorized, code)
+
+	// Probes don't need the token.
+	c.token = ""
+	code, _ = c.do("GET", "/health", "")
+	require.Equal(http.StatusOK, code)
+	code, _ = c.do("GET", "/ready", "")
+	require.Equal(http.StatusServiceUnavailable, code)
+}
+
+func TestBrowserChecks(t *testing.T) {
+	require := require.New(t)
+	s, c := newTestServer(t, config.Admin{})
+	s.SetExecutor(executor.NewExecutor(context.Background(), config.Executor{Example: config.ExampleExecutor{Enable: true}}))
+	c.start(s)
+	send := func(method, host string, header http.Header) (int, string) {
+		req, err := http.NewRequest(method, c.url+"/executors/example/enable", nil)
+		require.NoError(err)
+		if host != "" {
+			req.Host = host
+		}
+		for name, values := range header {
+			req.Header[name] = values
+		}
+		return c.send(req)
+	}
+
+	// Names other than loopback may be rebound by a hostile page.
+	code, body := send("GET", "evil.example:9090", nil)
+	require.Equal(http.StatusForbidden, code)
+	require.JSONEq(`{"error":"host 'evil.example:9090' not allowed"}`, body)
+	code, _ = send("POST", "localhost:9090", nil)
+	require.Equal(http.StatusOK, code)
+	code, _ = send("POST", "[::1]", nil)
+	require.Equal(http.StatusOK, code)
+	code, _ = send("GET", "", http.Header{"Origin": {"http://evil.example"}})
+	require.Equal(http.StatusMethodNotAllowed, code)
+
+	// Pages may send simple requests to any origin.
+	code, body = send("POST", "", http.Header{"Origin": {"http://evil.example"}})
+	require.Equal(http.StatusForbidden, code)
+	require.JSONEq(`{"error":"origin 'http://evil.example' not allowed"}`, body)
+	code, _ = send("POST", "", http.Header{"Origin": {"null"}})
+	require.Equal(http.StatusForbidden, code)
+	code, _ = send("POST", "", http.Header{"Content-Type": {"text/plain"}})
+	require.Equal(http.StatusUnsupportedMediaType, code)
+	code, _ = send("POST", "", http.Header{"Origin": {c.url}, "Content-Type": {"application/json"}})
+	require.Equal(http.StatusOK, code)
+
+	// A token is required instead when there is one.
+	s, c = newTestServer(t, config.Admin{Token: "secret"})
+	c.start(s)
+	code, body = send("POST", "proxy.example:9090", nil)
+	require.Equal(http.StatusNotFound, code)
+	require.JSONEq(`{"error":"not found"}`, body)
+}
+
+func TestHealth(t *testing.T) {
+	require := require.New(t)
+	s, c := newTestServer(t, config.Admin{})
+	c.start(s)
+
+	code, body := c.do("GET", "/health", "")
+	require.Equal(http.StatusOK, code)
+	require.JSONEq(`{"status":"ok"}`, body)
+	code, body = c.do("GET", "/ready", "")
+	require.Equal(http.StatusServiceUnavailable, code)
+	require.JSONEq(`{"status":"starting"}`, body)
+	s.SetReady(true)
+	code, body = c.do("GET", "/ready", "")
+	require.Equal(http.StatusOK, code)
+	require.JSONEq(`{"status":"ready"}`, body)
+
+	code, body = c.do("GET", "/unknown", "")
+	require.Equal(http.StatusNotFound, code)
+	require.JSONEq(`{"error":"not found"}`, body)
+}
+
+// initLoggers registers the loggers, which can only be done once.
+var initLoggers sync.Once
+
+func TestLogging(t *testing.T) {
+	require := require.New(t)
+	initLoggers.Do(func() {
+		require.NoError(log.InitLoggers(log.GlobalConfig{}, map[string]log.GlobalConfig{}))
+	})
+	s, c := newTestServer(t, config.Admin{})
+	c.start(s)
+
+	code, body := c.do("PUT", "/logging/global", `{"level":"warn"}`)
+	require.Equal(http.StatusOK, code)
+	require.JSONEq(`{"level":"warn"}`, body)
+	code, body = c.do("GET", "/logging/global", "")
+	require.Equal(http.StatusOK, code)
+	require.JSONEq(`{"level":"warn"}`, body)
+	code, _ = c.do("PUT", "/logging/global", `{"level":"info"}`)
+	require.Equal(http.StatusOK, code)
+}
+
+func TestExecutors(t *testing.T) {
+	require := require.New(t)
+	s, c := newTestServer(t, config.Admin{})
+	s.SetExecutor(executor.NewExecutor(context.Background(), config.Executor{Example: config.ExampleExecutor{Enable: true}}))
+	c.start(s)
+
+	code, body := c.do("GET", "/executors", "")
+	require.Equal(http.StatusOK, code)
+	require.JSONEq(`[{"name":"example","enabled":true}]`, body)
+	code, body = c.do("POST", "/executors/example/disable", "")
+	require.Equal(http.StatusOK, code)
+	require.JSONEq(`[{"name":"example","enabled":false}]`, body)
+	code, _ = c.do("GET", "/executors/example/enable", "")
+	require.Equal(http.StatusMethodNotAllowed, code)
+	code, body = c.do("POST", "/executors/example/enable", "")
+	require.Equal(http.StatusOK, code)
+	require.JSONEq(`[{"name":"example","enabled":true}]`, body)
+
+	code, body = c.do("POST", "/executors/har/enable", "")
+	require.Equal(http.StatusNotFound, code)
+	require.JSONEq(`{"error":"executor 'har': executor not configured"}`, body)
+	code, _ = c.do("POST", "/executors/example/restart", "")
+	require.Equal(http.StatusNotFound, code)
+}
+
+func TestResolverCache(t *testing.T) {
+	require := require.New(t)
+	s, c := newTestServer(t, config.Admin{})
+	c.start(s)
+	code, _ := c.do("GET", "/resolver/cache", "")
+	require.Equal(http.StatusNotFound, code)
+
+	s, c = newTestServer(t, config.Admin{})
+	s.SetResolver(resolver.NewResolver())
+	c.start(s)
+	code, body := c.do("GET", "/resolver/cache", "")
+	require.Equal(http.StatusOK, code)
+	require.JSONEq(`[]`, body)
+	code, body = c.do("DELETE", "/resolver/cache", "")
+	require.Equal(http.StatusOK, code)
+	require.JSONEq(`{"flushed":0}`, body)
+	code, _ = c.do("POST", "/resolver/cache", "")
+	require.Equal(http.StatusMethodNotAllowed, code)
+}
+
+func TestCerts(t *testing.T) {
+	require := require.New(t)
+	s, c := newTestServer(t, config.Admin{})
+	s.SetCertCA(certer.NewCertCA())
+	c.start(s)
+	code, body := c.do("GET", "/certs", "")
+	require.Equal(http.StatusOK, code)
+	require.JSONEq(`[]`, body)
+}
+
+func TestRules(t *testing.T) {
+	require := require.New(t)
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	require.NoError(os.WriteFile(path, []byte("rules: [{name: one, response: {status: 503}}]"), 0600))
+	engine, err := rules.NewEngine(path)
+	require.NoError(err)
+	s, c := newTestServer(t, config.Admin{})
+	s.SetRules(engine)
+	c.start(s)
+
+	names := func(body string) []string {
+		var list []rules.Rule
+		require.NoError(json.Unmarshal([]byte(body), &list))
+		var names []string
+		for _, rule := range list {
+			names = append(names, rule.Name)
+		}
+		return names
+	}
+	code, body := c.do("GET", "/rules", "")
+	require.Equal(http.StatusOK, code)
+	require.Equal([]string{"one"}, names(body))
+
+	require.NoError(os.WriteFile(path, []byte("rules: [{name: two, response: {status: 503}}]"), 0600))
+	code, body = c.do("POST", "/rules/reload", "")
+	require.Equal(http.StatusOK, code)
+	require.Equal([]string{"two"}, names(body))
+
+	require.NoError(os.WriteFile(path, []byte("rules: [{name: bad}]"), 0600))
+	code, body = c.do("POST", "/rules/reload", "")
+	require.Equal(http.StatusUnprocessableEntity, code)
+	require.Contains(body, "no actions")
+	require.Equal([]string{"two"}, names(func() string { _, body := c.do("GET", "/rules", ""); return body }()))
+}
+
+func TestBreakpoints(t *testing.T) {
+	require := require.New(t)
+	b, err := core.NewBreakpoints(config.Breakpoints{})
+	require.NoError(err)
+	s, c := newTestServer(t, config.Admin{Token: "secret"})
+	s.SetBreakpoints(b)
+	c.start(s)
+
+	code, body := c.do("GET", "/breakpoints/flows", "")
+	require.Equal(http.StatusOK, code)
+	require.JSONEq(`[]`, body)
+	code, _ = c.do("POST", "/breakpoints/flows/missing/resume", "")
+	require.Equal(http.StatusNotFound, code)
+	c.token = ""
+	code, _ = c.do("GET", "/breakpoints/flows", "")
+	require.Equal(http.StatusUnauthorized, code)
+}
+
+func TestUI(t *testing.T) {
+	require := require.New(t)
+	s, c := newTestServer(t, config.Admin{Token: "secret"})
+	c.start(s)
+	c.token = ""
+
+	code, body := c.do("GET", "/ui/", "")
+	require.Equal(http.StatusOK, code)
+	require.Contains(body, `<script src="app.js"></script>`)
+	res, err := http.Get(c.url + "/ui/app.js")
+	require.NoError(err)
+	res.Body.Close()
+	require.Equal(http.StatusOK, res.StatusCode)
+	require.Contains(res.Header.Get("Content-Type"), "javascript")
+	require.Contains(res.Header.Get("Content-Security-Policy"), "default-src 'self'")
+
+	client := &http.Client{CheckRedirect: func(*http.Request, []*http.Request) error { return http.ErrUseLastResponse }}
+	res, err = client.Get(c.url + "/")
+	require.NoError(err)
+	res.Body.Close()
+	require.Equal(http.StatusFound, res.StatusCode)
+	require.Equal("/ui/", res.Header.Get("Location"))
+
+	// Browsers pass the token of streams in the query.
+	code, _ = c.do("GET", "/flows?access_token=secret", "")
+	require.Equal(http.StatusOK, code)
+	code, _ = c.do("GET", "/flows?access_token=wrong", "")
+	require.Equal(http.StatusUnauthorized, code)
+}
@@ -0,0 +1,298 @@
+package admin
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/millken/httpctl/core"
+	"github.com/millken/httpctl/executor"
+	"github.com/millken/httpctl/internal/httpjson"
+	"github.com/pkg/errors"
+)
+
+// ReplayTimeout bounds the exchanges replayed through the admin API.
+var ReplayTimeout = time.Minute
+
+// ReplayResult is the outcome of replaying the request of a flow.
+type ReplayResult struct {
+	Response *core.FlowResponse `json:"response,omitempty"`
+	Duration time.Duration      `json:"duration"`
+	Error    string             `json:"error,omitempty"`
+}
+
+// serveFlows lists the recent flows, or the stored ones with source=store.
+func (s *Server) serveFlows(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpjson.MethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	filter, err := flowFilter(r)
+	if err != nil {
+		httpjson.Error(w, http.StatusBadRequest, err)
+		return
+	}
+	switch r.URL.Query().Get("source") {
+	case "", "recent":
+	case "store":
+		store := s.flowStore()
+		if store == nil {
+			httpjson.Error(w, http.StatusNotFound, errors.New("flows are not stored"))
+			return
+		}
+		flows, err := store.List(filter)
+		if err != nil {
+			httpjson.Error(w, http.StatusInternalServerError, err)
+			return
+		}
+		if flows == nil {
+			flows = []*core.Flow{}
+		}
+		httpjson.Write(w, http.StatusOK, flows)
+		return
+	default:
+		httpjson.Error(w, http.StatusBadRequest, errors.Errorf("invalid source '%s'", r.URL.Query().Get("source")))
+		return
+	}
+	s.flowsMu.Lock()
+	flows := make([]*core.Flow, 0, len(s.flows))
+	for _, f := range s.flows {
+		if filter.Match(f) {
+			flows = append(flows, f)
+		}
+	}
+	s.flowsMu.Unlock()
+	if filter.Limit > 0 && len(flows) > filter.Limit {
+		flows = flows[len(flows)-filter.Limit:]
+	}
+	httpjson.Write(w, http.StatusOK, flows)
+}
+
+// flowFilter reads the filter of /flows from the query of r.
+func flowFilter(r *http.Request) (executor.FlowFilter, error) {
+	q := r.URL.Query()
+	filter := executor.FlowFilter{
+		Host:   q.Get("host"),
+		Method: q.Get("method"),
+		URL:    q.Get("url"),
+	}
+	if status := q.Get("status"); status != "" {
+		var err error
+		if filter.MinStatus, filter.MaxStatus, err = statusRange(status); err != nil {
+			return filter, err
+		}
+	}
+	for name, v := range map[string]*int{
+		"minStatus": &filter.MinStatus,
+		"maxStatus": &filter.MaxStatus,
+		"limit":     &filter.Limit,
+	} {
+		if q.Get(name) == "" {
+			continue
+		}
+		n, err := strconv.Atoi(q.Get(name))
+		if err != nil {
+			return filter, errors.Errorf("invalid %s '%s'", name, q.Get(name))
+		}
+		*v = n
+	}
+	return filter, nil
+}
+
+// statusRange returns the statuses matching status, which is a status
+// such as 404 or a class such as 4xx.
+func statusRange(status string) (int, int, error) {
+	if len(status) == 3 && strings.HasSuffix(strings.ToLower(status), "xx") && status[0] >= '1' && status[0] <= '9' {
+		class := int(status[0]-'0') * 100
+		return class, class + 99, nil
+	}
+	n, err := strconv.Atoi(status)
+	if err != nil || n < 100 || n > 999 {
+		return 0, 0, errors.Errorf("invalid status '%s'", status)
+	}
+	return n, n, nil
+}
+
+// serveFlow serves GET /flows/{id}, with the bodies decoded when
+// decode=true, POST /flows/{id}/replay and GET /flows/{id}/export.
+func (s *Server) serveFlow(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/flows/"), "/")
+	switch {
+	case len(parts) == 1:
+		if r.Method != http.MethodGet {
+			httpjson.MethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		f, ok := s.findFlow(w, parts[0], false)
+		if !ok {
+			return
+		}
+		if r.URL.Query().Get("decode") == "true" {
+			f = decodedFlow(f)
+		}
+		httpjson.Write(w, http.StatusOK, f)
+	case len(parts) == 2 && parts[1] == "replay":
+		if r.Method != http.MethodPost {
+			httpjson.MethodNotAllowed(w, http.MethodPost)
+			return
+		}
+		if s.transport == nil {
+			httpjson.Error(w, http.StatusNotFound, errors.New("replay is not enabled"))
+			return
+		}
+		f, ok := s.findFlow(w, parts[0], true)
+		if !ok {
+			return
+		}
+		httpjson.Write(w, http.StatusOK, s.replay(r.Context(), f))
+	case len(parts) == 2 && parts[1] == "export":
+		if r.Method != http.MethodGet {
+			httpjson.MethodNotAllowed(w, http.MethodGet)
+			return
+		}
+		s.serveExport(w, r, parts[0])
+	default:
+		httpjson.Error(w, http.StatusNotFound, errNotFound)
+	}
+}
+
+// serveExport writes the request of the flow id as a snippet in the format
+// parameter, curl by default.
+func (s *Server) serveExport(w http.ResponseWriter, r *http.Request, id string) {
+	format := r.URL.Query().Get("format")
+	if format == "" {
+		format = core.ExportCurl
+	}
+	if !exportFormat(format) {
+		httpjson.Error(w, http.StatusBadRequest, errors.Errorf("invalid format '%s', want one of %s",
+			format, strings.Join(core.ExportFormats, ", ")))
+		return
+	}
+	f, ok := s.findFlow(w, id, true)
+	if !ok {
+		return
+	}
+	snippet, err := core.ExportRequest(format, &f.Request)
+	if err != nil {
+		httpjson.Error(w, http.StatusConflict, err)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	io.WriteString(w, snippet)
+}
+
+func exportFormat(format string) bool {
+	for _, f := range core.ExportFormats {
+		if f == format {
+			return true
+		}
+	}
+	return false
+}
+
+// findFlow returns the flow id, looking in the recent flows and then in
+// the flow store, or writes an error. With whole, recent flows whose
+// request body was truncated are looked up in the store.
+func (s *Server) findFlow(w http.ResponseWriter, id string, whole bool) (*core.Flow, bool) {
+	if f := s.recentFlow(id); f != nil && (!whole || !f.Request.BodyTruncated) {
+		return f, true
+	}
+	store := s.flowStore()
+	if store == nil {
+		httpjson.Error(w, http.StatusNotFound, errors.Wrapf(executor.ErrFlowNotFound, "flow '%s'", id))
+		return nil, false
+	}
+	f, err := store.Get(id)
+	switch {
+	case errors.Cause(err) == executor.ErrFlowNotFound:
+		httpjson.Error(w, http.StatusNotFound, err)
+	case err != nil:
+		httpjson.Error(w, http.StatusInternalServerError, err)
+	default:
+		return f, true
+	}
+	return nil, false
+}
+
+func (s *Server) recentFlow(id string) *core.Flow {
+	s.flowsMu.Lock()
+	defer s.flowsMu.Unlock()
+	for _, f := range s.flows {
+		if f.ID == id {
+			return f
+		}
+	}
+	return nil
+}
+
+func (s *Server) flowStore() *executor.FlowStore {
+	if s.execute == nil {
+		return nil
+	}
+	return s.execute.FlowStore()
+}
+
+// decodedFlow returns a copy of f with its bodies decoded. Bodies that
+// cannot be decoded are kept as they are.
+func decodedFlow(f *core.Flow) *core.Flow {
+	copied := *f
+	copied.Request.Body = decodeBody(f.Request.Header, f.Request.Body)
+	if f.Response != nil {
+		response := *f.Response
+		response.Body = decodeBody(f.Response.Header, f.Response.Body)
+		copied.Response = &response
+	}
+	return &copied
+}
+
+func decodeBody(h http.Header, body []byte) []byte {
+	codings := core.ContentEncoding(h)
+	if len(codings) == 0 || len(body) == 0 || !core.CanDecode(codings...) {
+		return body
+	}
+	decoded, _, err := core.DecodeBody(body, core.FlowBodyLimit, codings...)
+	if err != nil {
+		return body
+	}
+	return decoded
+}
+
+// replay sends the request of f again and returns the response, with its
+// body decoded and kept up to RecentBodyLimit bytes.
+func (s *Server) replay(ctx context.Context, f *core.Flow) *ReplayResult {
+	ctx, cancel := context.WithTimeout(ctx, ReplayTimeout)
+	defer cancel()
+	result := &ReplayResult{}
+	start := time.Now()
+	r, err := f.NewRequest(ctx)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	response, err := s.transport.RoundTrip(r)
+	if err != nil {
+		result.Error = err.Error()
+		return result
+	}
+	defer response.Body.Close()
+	body := core.NewLimitedBuffer(RecentBodyLimit)
+	size, err := io.Copy(body, response.Body)
+	result.Duration = time.Since(start)
+	if err != nil {
+		result.Error = err.Error()
+	}
+	result.Response = &core.FlowResponse{
+		StatusCode:    response.StatusCode,
+		Proto:         response.Proto,
+		Header:        response.Header,
+		Trailer:       response.Trailer,
+		Body:          decodeBody(response.Header, body.Bytes()),
+		BodySize:      size,
+		BodyTruncated: body.Truncated(),
+	}
+	return result
+}
@@ -0,0 +1,229 @@
+package admin
+
+import (
+	"bytes"
+	"compress/gzip"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/core"
+	"github.com/millken/httpctl/executor"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlows(t *testing.T) {
+	require := require.New(t)
+	defer func(n int) { RecentBodyLimit = n }(RecentBodyLimit)
+	RecentBodyLimit = 4
+	dir := t.TempDir()
+	execute := executor.NewExecutor(context.Background(), config.Executor{Flow: config.FlowExecutor{Enable: true, OutputPath: dir}})
+	s, c := newTestServer(t, config.Admin{MaxFlows: 2})
+	s.SetExecutor(execute)
+	c.start(s)
+
+	flow := func(id, url string, status int) *core.Flow {
+		return &core.Flow{
+			ID:        id,
+			StartedAt: time.Now(),
+			Request:   core.FlowRequest{Method: "GET", URL: url, Body: []byte("request")},
+			Response:  &core.FlowResponse{StatusCode: status, Body: []byte("ok")},
+		}
+	}
+	stored := flow("stored", "https://example.com/stored", 200)
+	execute.RecordFlow(stored)
+	s.RecordFlow(stored)
+	s.RecordFlow(flow("1", "https://example.com/1", 200))
+	s.RecordFlow(flow("2", "https://api.example.com/2", 404))
+	// The request body is still whole for the other flow handlers.
+	require.Equal("request", string(stored.Request.Body))
+
+	list := func(query string) []string {
+		code, body := c.do("GET", "/flows"+query, "")
+		require.Equal(http.StatusOK, code, body)
+		var flows []*core.Flow
+		require.NoError(json.Unmarshal([]byte(body), &flows))
+		ids := []string{}
+		for _, f := range flows {
+			ids = append(ids, f.ID)
+		}
+		return ids
+	}
+	require.Equal([]string{"1", "2"}, list(""))
+	require.Equal([]string{"2"}, list("?host=api.example.com"))
+	require.Equal([]string{"2"}, list("?minStatus=400"))
+	require.Equal([]string{"2"}, list("?limit=1"))
+	code, body := c.do("GET", "/flows?limit=x", "")
+	require.Equal(http.StatusBadRequest, code)
+	require.JSONEq(`{"error":"invalid limit 'x'"}`, body)
+
+	code, body = c.do("GET", "/flows/1", "")
+	require.Equal(http.StatusOK, code)
+	f := &core.Flow{}
+	require.NoError(json.Unmarshal([]byte(body), f))
+	require.Equal("requ", string(f.Request.Body))
+	require.True(f.Request.BodyTruncated)
+	require.Equal("ok", string(f.Response.Body))
+	require.False(f.Response.BodyTruncated)
+
+	// Flows no longer recent are read from the flow store.
+	code, body = c.do("GET", "/flows/stored", "")
+	require.Equal(http.StatusOK, code)
+	require.NoError(json.Unmarshal([]byte(body), f))
+	require.Equal("request", string(f.Request.Body))
+	code, _ = c.do("GET", "/flows/missing", "")
+	require.Equal(http.StatusNotFound, code)
+}
+
+func TestFlows_Store(t *testing.T) {
+	require := require.New(t)
+	s, c := newTestServer(t, config.Admin{})
+	c.start(s)
+	code, body := c.do("GET", "/flows?source=store", "")
+	require.Equal(http.StatusNotFound, code)
+	require.JSONEq(`{"error":"flows are not stored"}`, body)
+
+	execute := executor.NewExecutor(context.Background(), config.Executor{Flow: config.FlowExecutor{Enable: true, OutputPath: t.TempDir()}})
+	s, c = newTestServer(t, config.Admin{})
+	s.SetExecutor(execute)
+	c.start(s)
+	code, body = c.do("GET", "/flows?source=store", "")
+	require.Equal(http.StatusOK, code)
+	require.JSONEq(`[]`, body)
+
+	execute.RecordFlow(streamFlow("a", "https://a.example.com/", 200))
+	execute.RecordFlow(streamFlow("b", "https://b.example.com/", 500))
+	code, body = c.do("GET", "/flows?source=store&status=5xx", "")
+	require.Equal(http.StatusOK, code)
+	var flows []*core.Flow
+	require.NoError(json.Unmarshal([]byte(body), &flows))
+	require.Len(flows, 1)
+	require.Equal("b", flows[0].ID)
+
+	code, _ = c.do("GET", "/flows?source=disk", "")
+	require.Equal(http.StatusBadRequest, code)
+}
+
+func TestFlows_Decode(t *testing.T) {
+	require := require.New(t)
+	s, c := newTestServer(t, config.Admin{})
+	c.start(s)
+
+	var gzipped bytes.Buffer
+	zw := gzip.NewWriter(&gzipped)
+	io.WriteString(zw, "hello, decoded")
+	zw.Close()
+	f := streamFlow("gz", "https://example.com/", 200)
+	f.Response.Header.Set("Content-Encoding", "gzip")
+	f.Response.Body = gzipped.Bytes()
+	s.RecordFlow(f)
+
+	decoded := &core.Flow{}
+	code, body := c.do("GET", "/flows/gz?decode=true", "")
+	require.Equal(http.StatusOK, code)
+	require.NoError(json.Unmarshal([]byte(body), decoded))
+	require.Equal("hello, decoded", string(decoded.Response.Body))
+	require.Equal("gzip", decoded.Response.Header.Get("Content-Encoding"))
+
+	code, body = c.do("GET", "/flows/gz", "")
+	require.Equal(http.StatusOK, code)
+	require.NoError(json.Unmarshal([]byte(body), decoded))
+	require.Equal(gzipped.Bytes(), decoded.Response.Body)
+	// The recorded flow is left as it was.
+	require.Equal(gzipped.Bytes(), f.Response.Body)
+}
+
+func TestFlows_Replay(t *testing.T) {
+	require := require.New(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("X-Method", r.Method)
+		w.WriteHeader(http.StatusCreated)
+		w.Write(body)
+	}))
+	defer origin.Close()
+
+	s, c := newTestServer(t, config.Admin{})
+	c.start(s)
+	f := streamFlow("post", origin.URL+"/orders", 201)
+	f.Request.Method = "POST"
+	f.Request.Body = []byte(`{"qty":1}`)
+	s.RecordFlow(f)
+	code, body := c.do("POST", "/flows/post/replay", "")
+	require.Equal(http.StatusNotFound, code)
+	require.JSONEq(`{"error":"replay is not enabled"}`, body)
+
+	s, c = newTestServer(t, config.Admin{})
+	s.SetTransport(http.DefaultTransport)
+	c.start(s)
+	s.RecordFlow(f)
+	code, body = c.do("POST", "/flows/post/replay", "")
+	require.Equal(http.StatusOK, code)
+	result := &ReplayResult{}
+	require.NoError(json.Unmarshal([]byte(body), result))
+	require.Empty(result.Error)
+	require.Equal(http.StatusCreated, result.Response.StatusCode)
+	require.Equal("POST", result.Response.Header.Get("X-Method"))
+	require.Equal(`{"qty":1}`, string(result.Response.Body))
+	require.Equal(int64(9), result.Response.BodySize)
+	require.True(result.Duration > 0)
+
+	code, _ = c.do("GET", "/flows/post/replay", "")
+	require.Equal(http.StatusMethodNotAllowed, code)
+	code, _ = c.do("POST", "/flows/missing/replay", "")
+	require.Equal(http.StatusNotFound, code)
+
+	// Recent flows with a truncated request body can't be replayed.
+	defer func(n int) { RecentBodyLimit = n }(RecentBodyLimit)
+	RecentBodyLimit = 4
+	truncated := streamFlow("truncated", origin.URL+"/orders", 201)
+	truncated.Request.Body = []byte(`{"qty":1}`)
+	s.RecordFlow(truncated)
+	code, _ = c.do("POST", "/flows/truncated/replay", "")
+	require.Equal(http.StatusNotFound, code)
+}
+
+func TestFlows_Export(t *testing.T) {
+	require := require.New(t)
+	s, c := newTestServer(t, config.Admin{})
+	c.start(s)
+	f := streamFlow("post", "https://example.com/orders", 201)
+	f.Request.Method = "POST"
+	f.Request.Body = []byte(`{"qty":1}`)
+	s.RecordFlow(f)
+
+	req, err := http.NewRequest("GET", c.url+"/flows/post/export", nil)
+	require.NoError(err)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(err)
+	b, err := io.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(err)
+	require.Equal(http.StatusOK, res.StatusCode)
+	require.Equal("text/plain; charset=utf-8", res.Header.Get("Content-Type"))
+	require.Equal(`curl \
+  -X 'POST' \
+  'https://example.com/orders' \
+  -H 'Accept: */*' \
+  --data-raw '{"qty":1}'
+`, string(b))
+
+	for _, format := range core.ExportFormats {
+		code, body := c.do("GET", "/flows/post/export?format="+format, "")
+		require.Equal(http.StatusOK, code, format)
+		require.Contains(body, "https://example.com/orders", format)
+	}
+
+	code, body := c.do("GET", "/flows/post/export?format=wget", "")
+	require.Equal(http.StatusBadRequest, code)
+	require.JSONEq(`{"error":"invalid format 'wget', want one of curl, httpie, go, python"}`, body)
+	code, _ = c.do("POST", "/flows/post/export", "")
+	require.Equal(http.StatusMethodNotAllowed, code)
+	code, _ = c.do("GET", "/flows/missing/export", "")
+	require.Equal(http.StatusNotFound, code)
+}
@@ -0,0 +1,250 @@
+package admin
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/millken/httpctl/core"
+	"github.com/millken/httpctl/executor"
+	"github.com/millken/httpctl/internal/httpjson"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/net/websocket"
+)
+
+var (
+	// StreamBuffer is the number of flows queued for a stream subscriber.
+	// Flows published while its queue is full are dropped for it.
+	StreamBuffer = 256
+	// StreamHeartbeat is the interval of the keep-alive comments sent on
+	// idle Server-Sent Events streams.
+	StreamHeartbeat = 15 * time.Second
+)
+
+// Hub broadcasts the completed flows to the stream subscribers. Publish
+// never blocks: a subscriber that doesn't keep up misses flows instead of
+// holding up the proxy.
+type Hub struct {
+	mu   sync.Mutex
+	subs map[*Subscription]struct{}
+}
+
+// Subscription receives the flows passing its filter on C.
+type Subscription struct {
+	C       <-chan *core.Flow
+	c       chan *core.Flow
+	filter  executor.FlowFilter
+	dropped uint64
+}
+
+// NewHub returns a Hub without subscribers.
+func NewHub() *Hub {
+	return &Hub{subs: make(map[*Subscription]struct{})}
+}
+
+// Subscribe returns a subscription to the flows passing filter. The Limit
+// of filter is ignored.
+func (h *Hub) Subscribe(filter executor.FlowFilter) *Subscription {
+	c := make(chan *core.Flow, StreamBuffer)
+	s := &Subscription{C: c, c: c, filter: filter}
+	h.mu.Lock()
+	h.subs[s] = struct{}{}
+	h.mu.Unlock()
+	return s
+}
+
+// Unsubscribe stops delivering flows to s.
+func (h *Hub) Unsubscribe(s *Subscription) {
+	h.mu.Lock()
+	delete(h.subs, s)
+	h.mu.Unlock()
+}
+
+// Subscribers returns the number of subscriptions.
+func (h *Hub) Subscribers() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return len(h.subs)
+}
+
+// Publish hands f to the subscriptions whose filter it passes.
+func (h *Hub) Publish(f *core.Flow) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for s := range h.subs {
+		if !s.filter.Match(f) {
+			continue
+		}
+		select {
+		case s.c <- f:
+		default:
+			atomic.AddUint64(&s.dropped, 1)
+		}
+	}
+}
+
+// Dropped returns the number of flows dropped since the last call.
+func (s *Subscription) Dropped() uint64 {
+	return atomic.SwapUint64(&s.dropped, 0)
+}
+
+// StreamEvent summarizes a flow on the live stream.
+type StreamEvent struct {
+	ID         string        `json:"id"`
+	StartedAt  time.Time     `json:"startedAt"`
+	ClientAddr string        `json:"clientAddr"`
+	Method     string        `json:"method"`
+	URL        string        `json:"url"`
+	Host       string        `json:"host"`
+	Status     int           `json:"status,omitempty"`
+	Duration   time.Duration `json:"duration"`
+	// RequestSize and ResponseSize are body sizes.
+	RequestSize    int64       `json:"requestSize"`
+	ResponseSize   int64       `json:"responseSize"`
+	Error          string      `json:"error,omitempty"`
+	RequestHeader  http.Header `json:"requestHeader,omitempty"`
+	ResponseHeader http.Header `json:"responseHeader,omitempty"`
+	// Dropped is the number of flows dropped since the previous message
+	// because the subscriber was too slow. They may have started before
+	// or after this one.
+	Dropped uint64 `json:"dropped,omitempty"`
+}
+
+func newStreamEvent(f *core.Flow, headers bool) *StreamEvent {
+	e := &StreamEvent{
+		ID:          f.ID,
+		StartedAt:   f.StartedAt,
+		ClientAddr:  f.ClientAddr,
+		Method:      f.Request.Method,
+		URL:         f.Request.URL,
+		Duration:    f.Timings.Total,
+		RequestSize: f.Request.BodySize,
+		Error:       f.Error,
+	}
+	if u, err := url.Parse(f.Request.URL); err == nil {
+		e.Host = u.Host
+	}
+	if headers {
+		e.RequestHeader = f.Request.Header
+	}
+	if f.Response != nil {
+		e.Status = f.Response.StatusCode
+		e.ResponseSize = f.Response.BodySize
+		if headers {
+			e.ResponseHeader = f.Response.Header
+		}
+	}
+	return e
+}
+
+// serveStream streams the flows passing the filter of the query as
+// Server-Sent Events, or as WebSocket text messages when r is a WebSocket
+// handshake. Each message is a StreamEvent in JSON; headers=true adds the
+// headers.
+func (s *Server) serveStream(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		httpjson.MethodNotAllowed(w, http.MethodGet)
+		return
+	}
+	filter, err := flowFilter(r)
+	if err != nil {
+		httpjson.Error(w, http.StatusBadRequest, err)
+		return
+	}
+	headers := r.URL.Query().Get("headers") == "true"
+	if strings.EqualFold(r.Header.Get("Upgrade"), "websocket") {
+		websocket.Server{
+			Handshake: checkOrigin,
+			Handler: func(ws *websocket.Conn) {
+				s.streamWebSocket(ws, filter, headers)
+			},
+		}.ServeHTTP(w, r)
+		return
+	}
+	s.streamEvents(w, r, filter, headers)
+}
+
+func (s *Server) streamEvents(w http.ResponseWriter, r *http.Request, filter executor.FlowFilter, headers bool) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		httpjson.Error(w, http.StatusInternalServerError, errors.New("streaming is not supported"))
+		return
+	}
+	sub := s.hub.Subscribe(filter)
+	defer s.hub.Unsubscribe(sub)
+	s.log.Debug("stream subscriber joined", zap.String("client", r.RemoteAddr))
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	heartbeat := time.NewTicker(StreamHeartbeat)
+	defer heartbeat.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-heartbeat.C:
+			if _, err := io.WriteString(w, ": ping\n\n"); err != nil {
+				return
+			}
+		case f := <-sub.C:
+			e := newStreamEvent(f, headers)
+			e.Dropped = sub.Dropped()
+			b, err := json.Marshal(e)
+			if err != nil {
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "id: %s\nevent: flow\ndata: %s\n\n", e.ID, b); err != nil {
+				return
+			}
+		}
+		flusher.Flush()
+	}
+}
+
+func (s *Server) streamWebSocket(ws *websocket.Conn, filter executor.FlowFilter, headers bool) {
+	sub := s.hub.Subscribe(filter)
+	defer s.hub.Unsubscribe(sub)
+	s.log.Debug("stream subscriber joined", zap.String("client", ws.Request().RemoteAddr))
+
+	// Messages from the client are ignored; reading notices when it leaves.
+	closed := make(chan struct{})
+	go func() {
+		io.Copy(io.Discard, ws)
+		close(closed)
+	}()
+	for {
+		select {
+		case <-closed:
+			return
+		case f := <-sub.C:
+			e := newStreamEvent(f, headers)
+			e.Dropped = sub.Dropped()
+			if err := websocket.JSON.Send(ws, e); err != nil {
+				return
+			}
+		}
+	}
+}
+
+// checkOrigin accepts the WebSocket handshakes of clients without Origin,
+// such as scripts, and of pages served by the admin API itself, so that
+// other sites opened in a browser cannot read the stream.
+func checkOrigin(config *websocket.Config, r *http.Request) error {
+	origin := r.Header.Get("Origin")
+	if origin == "" {
+		return nil
+	}
+	if !sameOrigin(origin, r.Host) {
+		return errors.Errorf("origin '%s' not allowed", origin)
+	}
+	return nil
+}
@@ -0,0 +1,132 @@
+package admin
+
+import (
+	"bufio"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/core"
+	"github.com/millken/httpctl/executor"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/net/websocket"
+)
+
+func streamFlow(id, url string, status int) *core.Flow {
+	return &core.Flow{
+		ID:        id,
+		StartedAt: time.Now(),
+		Request: core.FlowRequest{
+			Method:   "GET",
+			URL:      url,
+			Header:   http.Header{"Accept": {"*/*"}},
+			BodySize: 3,
+		},
+		Response: &core.FlowResponse{
+			StatusCode: status,
+			Header:     http.Header{"Content-Type": {"text/plain"}},
+			BodySize:   5,
+		},
+		Timings: core.FlowTimings{Total: time.Second},
+	}
+}
+
+func TestHub(t *testing.T) {
+	require := require.New(t)
+	defer func(n int) { StreamBuffer = n }(StreamBuffer)
+	StreamBuffer = 2
+	h := NewHub()
+	all := h.Subscribe(executor.FlowFilter{})
+	errors := h.Subscribe(executor.FlowFilter{MinStatus: 500})
+	require.Equal(2, h.Subscribers())
+
+	for i := 0; i < 3; i++ {
+		h.Publish(streamFlow("ok", "https://example.com/", 200))
+	}
+	h.Publish(streamFlow("failed", "https://example.com/", 502))
+	require.Equal(uint64(2), all.Dropped())
+	require.Equal(uint64(0), all.Dropped())
+	require.Len(all.C, 2)
+	require.Equal(uint64(0), errors.Dropped())
+	require.Equal("failed", (<-errors.C).ID)
+
+	h.Unsubscribe(all)
+	h.Unsubscribe(errors)
+	require.Equal(0, h.Subscribers())
+	h.Publish(streamFlow("ok", "https://example.com/", 200))
+}
+
+func TestStream_Events(t *testing.T) {
+	require := require.New(t)
+	s, c := newTestServer(t, config.Admin{Token: "secret"})
+	c.start(s)
+
+	req, err := http.NewRequest("GET", c.url+"/stream?status=4xx&headers=true", nil)
+	require.NoError(err)
+	req.Header.Set("Authorization", "Bearer secret")
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(err)
+	defer res.Body.Close()
+	require.Equal(http.StatusOK, res.StatusCode)
+	require.Equal("text/event-stream", res.Header.Get("Content-Type"))
+	require.Equal(1, s.hub.Subscribers())
+
+	s.RecordFlow(streamFlow("1", "https://example.com/ok", 200))
+	s.RecordFlow(streamFlow("2", "https://example.com:8443/missing", 404))
+	r := bufio.NewReader(res.Body)
+	var lines []string
+	for len(lines) < 3 {
+		line, err := r.ReadString('\n')
+		require.NoError(err)
+		lines = append(lines, strings.TrimSuffix(line, "\n"))
+	}
+	require.Equal("id: 2", lines[0])
+	require.Equal("event: flow", lines[1])
+	require.True(strings.HasPrefix(lines[2], "data: "))
+	e := &StreamEvent{}
+	require.NoError(json.Unmarshal([]byte(strings.TrimPrefix(lines[2], "data: ")), e))
+	require.Equal("example.com:8443", e.Host)
+	require.Equal(404, e.Status)
+	require.Equal(time.Second, e.Duration)
+	require.Equal(int64(3), e.RequestSize)
+	require.Equal(int64(5), e.ResponseSize)
+	require.Equal("*/*", e.RequestHeader.Get("Accept"))
+	require.Equal("text/plain", e.ResponseHeader.Get("Content-Type"))
+
+	res.Body.Close()
+	require.Eventually(func() bool { return s.hub.Subscribers() == 0 }, time.Second, 10*time.Millisecond)
+
+	code, body := c.do("GET", "/stream?status=abc", "")
+	require.Equal(http.StatusBadRequest, code)
+	require.JSONEq(`{"error":"invalid status 'abc'"}`, body)
+}
+
+func TestStream_WebSocket(t *testing.T) {
+	require := require.New(t)
+	s, c := newTestServer(t, config.Admin{})
+	c.start(s)
+	wsURL := "ws" + strings.TrimPrefix(c.url, "http") + "/stream?method=post"
+
+	_, err := websocket.Dial(wsURL, "", "http://evil.example.com")
+	require.Error(err)
+
+	ws, err := websocket.Dial(wsURL, "", c.url)
+	require.NoError(err)
+	require.Eventually(func() bool { return s.hub.Subscribers() == 1 }, time.Second, 10*time.Millisecond)
+
+	s.RecordFlow(streamFlow("get", "https://example.com/", 200))
+	post := streamFlow("post", "https://example.com/", 201)
+	post.Request.Method = "POST"
+	s.RecordFlow(post)
+	e := &StreamEvent{}
+	require.NoError(websocket.JSON.Receive(ws, e))
+	require.Equal("post", e.ID)
+	require.Equal("POST", e.Method)
+	require.Nil(e.RequestHeader)
+
+	ws.Close()
+	require.Eventually(func() bool { return s.hub.Subscribers() == 0 }, time.Second, 10*time.Millisecond)
+}
@@ -0,0 +1,300 @@
+// httpctl web UI: lists the recent or stored flows, follows the live
+// stream and shows the selected flow. Everything goes through the JSON
+// endpoints of the admin API.
+(function () {
+  "use strict";
+
+  var maxRows = 500;
+  var tokenKey = "httpctl.token";
+  var stream = null;
+  var selected = null;
+
+  var $ = function (id) { return document.getElementById(id); };
+  var form = $("filter");
+
+  function token() {
+    return localStorage.getItem(tokenKey) || "";
+  }
+
+  // api fetches path, asking for the admin token once if it is needed.
+  function api(path, options, retried) {
+    options = options || {};
+    options.headers = options.headers || {};
+    if (token()) {
+      options.headers.Authorization = "Bearer " + token();
+    }
+    return fetch(path, options).then(function (res) {
+      if (res.status === 401 && !retried) {
+        var t = prompt("Admin token");
+        if (t !== null) {
+          localStorage.setItem(tokenKey, t);
+          return api(path, options, true);
+        }
+      }
+      return res.json().then(function (body) {
+        if (!res.ok) {
+          throw new Error(body.error || res.statusText);
+        }
+        return body;
+      });
+    });
+  }
+
+  function query(extra) {
+    var params = new URLSearchParams();
+    ["host", "method", "status", "url"].forEach(function (name) {
+      var v = form.elements[name].value.trim();
+      if (v) {
+        params.set(name, v);
+      }
+    });
+    Object.keys(extra || {}).forEach(function (name) {
+      params.set(name, extra[name]);
+    });
+    return params.toString();
+  }
+
+  function setState(text) {
+    $("state").textContent = text;
+  }
+
+  // summary returns the row of a Flow or of a StreamEvent.
+  function summary(f) {
+    if (f.request) {
+      return {
+        id: f.id,
+        startedAt: f.startedAt,
+        method: f.request.method,
+        url: f.request.url,
+        status: f.response ? f.response.statusCode : 0,
+        size: f.response ? f.response.bodySize : 0,
+        duration: f.timings.total,
+        error: f.error
+      };
+    }
+    return {
+      id: f.id,
+      startedAt: f.startedAt,
+      method: f.method,
+      url: f.url,
+      status: f.status || 0,
+      size: f.responseSize,
+      duration: f.duration,
+      error: f.error
+    };
+  }
+
+  function formatSize(n) {
+    if (n >= 1 << 20) {
+      return (n / (1 << 20)).toFixed(1) + " MB";
+    }
+    if (n >= 1 << 10) {
+      return (n / (1 << 10)).toFixed(1) + " KB";
+    }
+    return n + " B";
+  }
+
+  function row(f) {
+    var s = summary(f);
+    var u;
+    try {
+      u = new URL(s.url);
+    } catch (e) {
+      u = { host: "", pathname: s.url, search: "" };
+    }
+    var tr = document.createElement("tr");
+    tr.dataset.id = s.id;
+    if (s.error || s.status >= 400) {
+      tr.className = "error";
+    }
+    [
+      new Date(s.startedAt).toLocaleTimeString(),
+      s.method,
+      s.error ? "failed" : String(s.status),
+      u.host,
+      u.pathname + u.search,
+      formatSize(s.size || 0),
+      Math.round(s.duration / 1e6) + " ms"
+    ].forEach(function (text, i) {
+      var td = document.createElement("td");
+      td.textContent = text;
+      if (i === 4) {
+        td.className = "path";
+        td.title = s.url;
+      }
+      tr.appendChild(td);
+    });
+    tr.addEventListener("click", function () { select(s.id, tr); });
+    return tr;
+  }
+
+  function prepend(f) {
+    var tbody = $("flows");
+    tbody.insertBefore(row(f), tbody.firstChild);
+    while (tbody.children.length > maxRows) {
+      tbody.removeChild(tbody.lastChild);
+    }
+  }
+
+  function load() {
+    if (stream) {
+      stream.close();
+      stream = null;
+    }
+    var source = form.elements.source.value;
+    setState("loading…");
+    api("../flows?" + query({ source: source, limit: maxRows })).then(function (flows) {
+      var tbody = $("flows");
+      tbody.textContent = "";
+      flows.forEach(prepend);
+      setState(flows.length + " flows");
+      if (source === "recent") {
+        follow();
+      }
+    }).catch(function (err) {
+      setState(err.message);
+    });
+  }
+
+  // follow adds the flows of the live stream as they complete.
+  function follow() {
+    var extra = {};
+    if (token()) {
+      extra.access_token = token();
+    }
+    stream = new EventSource("../stream?" + query(extra));
+    stream.addEventListener("open", function () { setState("live"); });
+    stream.addEventListener("error", function () { setState("stream disconnected, retrying…"); });
+    stream.addEventListener("flow", function (msg) {
+      var e = JSON.parse(msg.data);
+      prepend(e);
+      if (e.dropped) {
+        setState("live, " + e.dropped + " flows dropped");
+      }
+    });
+  }
+
+  // text returns a base64 body as text, or a placeholder if it is binary.
+  function text(body, header) {
+    if (!body) {
+      return "";
+    }
+    var raw = atob(body);
+    var bytes = new Uint8Array(raw.length);
+    for (var i = 0; i < raw.length; i++) {
+      bytes[i] = raw.charCodeAt(i);
+    }
+    var s;
+    try {
+      s = new TextDecoder("utf-8", { fatal: true }).decode(bytes);
+    } catch (e) {
+      return "(binary, " + formatSize(bytes.length) + ")";
+    }
+    var type = header && header["Content-Type"] ? header["Content-Type"][0] : "";
+    if (type.indexOf("json") >= 0) {
+      try {
+        return JSON.stringify(JSON.parse(s), null, 2);
+      } catch (e) {
+        // Truncated or invalid, shown as it is.
+      }
+    }
+    return s;
+  }
+
+  function headers(first, header) {
+    var lines = [first];
+    Object.keys(header || {}).sort().forEach(function (name) {
+      header[name].forEach(function (v) { lines.push(name + ": " + v); });
+    });
+    return lines.join("\n");
+  }
+
+  function truncated(flag, size) {
+    return flag ? "\n… truncated, " + formatSize(size) + " in total" : "";
+  }
+
+  function select(id, tr) {
+    Array.prototype.forEach.call(document.querySelectorAll("tr.selected"), function (el) {
+      el.classList.remove("selected");
+    });
+    tr.classList.add("selected");
+    $("detail").hidden = false;
+    $("replay-result").hidden = true;
+    $("detail-state").textContent = "loading…";
+    api("../flows/" + encodeURIComponent(id) + "?decode=true").then(function (f) {
+      selected = f;
+      $("detail-title").textContent = f.request.method + " " + f.request.url;
+      $("detail-state").textContent = f.error || "";
+      $("request-head").textContent = headers(f.request.method + " " + f.request.url + " " + f.request.proto, f.request.header);
+      $("request-body").textContent = text(f.request.body, f.request.header) + truncated(f.request.bodyTruncated, f.request.bodySize);
+      if (f.response) {
+        $("response-head").textContent = headers(f.response.proto + " " + f.response.statusCode, f.response.header);
+        $("response-body").textContent = text(f.response.body, f.response.header) + truncated(f.response.bodyTruncated, f.response.bodySize);
+      } else {
+        $("response-head").textContent = "(no response)";
+        $("response-body").textContent = "";
+      }
+    }).catch(function (err) {
+      $("detail-state").textContent = err.message;
+    });
+  }
+
+  // exported fetches the request of the selected flow rendered by the
+  // export endpoint.
+  function exported(format) {
+    var path = "../flows/" + encodeURIComponent(selected.id) + "/export?format=" + encodeURIComponent(format);
+    var options = { headers: {} };
+    if (token()) {
+      options.headers.Authorization = "Bearer " + token();
+    }
+    return fetch(path, options).then(function (res) {
+      if (!res.ok) {
+        return res.json().then(function (body) {
+          throw new Error(body.error || res.statusText);
+        });
+      }
+      return res.text();
+    });
+  }
+
+  $("copy").addEventListener("click", function () {
+    var format = $("export-format").value;
+    exported(format).then(function (snippet) {
+      return navigator.clipboard.writeText(snippet).then(function () {
+        $("detail-state").textContent = "copied";
+      }, function () {
+        prompt(format, snippet);
+      });
+    }).catch(function (err) {
+      $("detail-state").textContent = err.message;
+    });
+  });
+
+  $("replay").addEventListener("click", function () {
+    $("detail-state").textContent = "replaying…";
+    api("../flows/" + encodeURIComponent(selected.id) + "/replay", { method: "POST" }).then(function (res) {
+      $("replay-result").hidden = false;
+      if (res.error && !res.response) {
+        $("replay-head").textContent = res.error;
+        $("replay-body").textContent = "";
+      } else {
+        $("replay-head").textContent = headers(res.response.proto + " " + res.response.statusCode + "  (" + Math.round(res.duration / 1e6) + " ms)", res.response.header);
+        $("replay-body").textContent = text(res.response.body, res.response.header) + truncated(res.response.bodyTruncated, res.response.bodySize);
+      }
+      $("detail-state").textContent = res.error || "";
+    }).catch(function (err) {
+      $("detail-state").textContent = err.message;
+    });
+  });
+
+  form.addEventListener("submit", function (e) {
+    e.preventDefault();
+    load();
+  });
+  form.elements.source.addEventListener("change", load);
+  $("clear").addEventListener("click", function () {
+    form.reset();
+    load();
+  });
+  load();
+})();
@@ -0,0 +1,141 @@
+// Package capture defines the JSONL capture format written by
+// middleware.HttpLogCaptureHandler and replays capture files against the live
+// origins.
+//
+// A capture file holds one exchange per line, as a JSON object:
+//
+//	{"v":1,"time":"2022-06-01T12:00:00.123Z","durationMs":48.2,
+//	 "request":{"method":"POST","url":"https://example.com/api?x=1","proto":"HTTP/2.0",
+//	            "header":{"Content-Type":["application/json"]},
+//	            "body":"eyJhIjoxfQ==","bodySize":7},
+//	 "response":{"status":200,"proto":"HTTP/2.0",
+//	             "header":{"Content-Type":["application/json"]},
+//	             "body":"eyJvayI6dHJ1ZX0=","bodySize":11,
+//	             "bodySha256":"3f1c..."}}
+//
+// Fields:
+//
+//   - v is the schema version, currently 1.
+//   - time is when the request arrived, durationMs how long the exchange took.
+//   - url is absolute; header maps canonical names to their values as seen
+//     by the proxy, without Host which is part of url.
+//   - body holds at most the dump limit of the body, base64 encoded;
+//     bodySize is the full size and bodyTruncated is set when body was cut.
+//   - response.header is what the client received; bodySha256 is the hex
+//     SHA-256 of the whole response body.
+//
+// Lines that are empty are ignored.
+package capture
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// SchemaVersion is the version written in the "v" field.
+const SchemaVersion = 1
+
+// Record is one captured exchange.
+type Record struct {
+	Version    int       `json:"v"`
+	Time       time.Time `json:"time"`
+	DurationMs float64   `json:"durationMs"`
+	Request    Request   `json:"request"`
+	Response   Response  `json:"response"`
+}
+
+// Request is the captured request.
+type Request struct {
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	Proto         string      `json:"proto"`
+	Header        http.Header `json:"header"`
+	Body          []byte      `json:"body,omitempty"`
+	BodySize      int64       `json:"bodySize"`
+	BodyTruncated bool        `json:"bodyTruncated,omitempty"`
+}
+
+// Response is the captured response.
+type Response struct {
+	Status        int         `json:"status"`
+	Proto         string      `json:"proto"`
+	Header        http.Header `json:"header"`
+	Body          []byte      `json:"body,omitempty"`
+	BodySize      int64       `json:"bodySize"`
+	BodyTruncated bool        `json:"bodyTruncated,omitempty"`
+	BodySHA256    string      `json:"bodySha256,omitempty"`
+}
+
+// Writer appends records to a capture file. It is safe for concurrent use.
+type Writer struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+// NewWriter returns a Writer writing to w.
+func NewWriter(w io.Writer) *Writer {
+	return &Writer{w: w}
+}
+
+// Write appends rec as one line.
+func (w *Writer) Write(rec *Record) error {
+	if rec.Version == 0 {
+		rec.Version = SchemaVersion
+	}
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode capture record")
+	}
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	_, err = w.w.Write(append(b, '\n'))
+	return err
+}
+
+// Reader reads records from a capture file.
+type Reader struct {
+	r    *bufio.Reader
+	line int
+}
+
+// NewReader returns a Reader reading from r.
+func NewReader(r io.Reader) *Reader {
+	return &Reader{r: bufio.NewReader(r)}
+}
+
+// Line returns the line number of the last record read.
+func (r *Reader) Line() int {
+	return r.line
+}
+
+// Next returns the next record, or io.EOF at the end of the file.
+func (r *Reader) Next() (*Record, error) {
+	for {
+		line, err := r.r.ReadBytes('\n')
+		if err != nil && err != io.EOF {
+			return nil, errors.Wrap(err, "failed to read capture")
+		}
+		if len(line) == 0 && err == io.EOF {
+			return nil, io.EOF
+		}
+		r.line++
+		if line = bytes.TrimSpace(line); len(line) == 0 {
+			continue
+		}
+		rec := &Record{}
+		if err := json.Unmarshal(line, rec); err != nil {
+			return nil, errors.Wrapf(err, "invalid capture record on line %d", r.line)
+		}
+		if rec.Version > SchemaVersion {
+			return nil, errors.Errorf("unsupported capture version %d on line %d", rec.Version, r.line)
+		}
+		return rec, nil
+	}
+}
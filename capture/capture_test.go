@@ -0,0 +1,61 @@
+package capture
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestWriterReader(t *testing.T) {
+	require := require.New(t)
+	var buf bytes.Buffer
+	w := NewWriter(&buf)
+	rec := &Record{
+		Time:       time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+		DurationMs: 48.2,
+		Request: Request{
+			Method:   "POST",
+			URL:      "https://example.com/api?x=1",
+			Proto:    "HTTP/1.1",
+			Header:   http.Header{"Content-Type": {"application/json"}},
+			Body:     []byte(`{"a":1}`),
+			BodySize: 7,
+		},
+		Response: Response{Status: 200, Proto: "HTTP/1.1", BodySHA256: "abc"},
+	}
+	require.NoError(w.Write(rec))
+	require.NoError(w.Write(rec))
+	require.Equal(SchemaVersion, rec.Version)
+
+	r := NewReader(strings.NewReader("\n" + buf.String() + "\n"))
+	got, err := r.Next()
+	require.NoError(err)
+	require.Equal(2, r.Line())
+	require.Equal(rec.Request, got.Request)
+	require.Equal(rec.Response, got.Response)
+	require.True(rec.Time.Equal(got.Time))
+
+	_, err = r.Next()
+	require.NoError(err)
+	require.Equal(3, r.Line())
+	_, err = r.Next()
+	require.Equal(io.EOF, err)
+}
+
+func TestReaderErrors(t *testing.T) {
+	require := require.New(t)
+	_, err := NewReader(strings.NewReader(`{"v":2}`)).Next()
+	require.EqualError(err, "unsupported capture version 2 on line 1")
+
+	r := NewReader(strings.NewReader("{}\nnot json\n"))
+	_, err = r.Next()
+	require.NoError(err)
+	_, err = r.Next()
+	require.Error(err)
+	require.Contains(err.Error(), "line 2")
+}
@@ -0,0 +1,141 @@
+package capture
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strings"
+
+	"github.com/millken/httpctl/core"
+	"github.com/pkg/errors"
+)
+
+// DefaultIgnoreHeaders are response headers that change between identical
+// responses and are not compared by Replay.
+var DefaultIgnoreHeaders = []string{
+	"Age",
+	"Alt-Svc",
+	"Cf-Ray",
+	"Date",
+	"Expires",
+	"Nel",
+	"Report-To",
+	"Server-Timing",
+	"Set-Cookie",
+	"Via",
+	"X-Request-Id",
+}
+
+// Diff is a difference between the recorded and the replayed response.
+type Diff struct {
+	// Field is "status", "body" or "header <Name>".
+	Field    string
+	Recorded string
+	Replayed string
+}
+
+func (d Diff) String() string {
+	return fmt.Sprintf("%s: %q -> %q", d.Field, d.Recorded, d.Replayed)
+}
+
+// Result is the outcome of replaying one record.
+type Result struct {
+	Record *Record
+	Diffs  []Diff
+	// Err is set when the request could not be replayed.
+	Err error
+}
+
+// Replayer re-issues captured requests and compares the responses.
+type Replayer struct {
+	Transport http.RoundTripper
+	// IgnoreHeaders are not compared, see DefaultIgnoreHeaders.
+	IgnoreHeaders []string
+}
+
+// NewReplayer returns a Replayer sending through rt and ignoring
+// DefaultIgnoreHeaders.
+func NewReplayer(rt http.RoundTripper) *Replayer {
+	return &Replayer{Transport: rt, IgnoreHeaders: DefaultIgnoreHeaders}
+}
+
+// Replay sends the request of rec again and reports how the response
+// differs in status, headers and body hash.
+func (p *Replayer) Replay(ctx context.Context, rec *Record) *Result {
+	result := &Result{Record: rec}
+	if rec.Request.BodyTruncated {
+		result.Err = errors.New("request body was truncated when captured")
+		return result
+	}
+	r, err := http.NewRequestWithContext(ctx, rec.Request.Method, rec.Request.URL, bytes.NewReader(rec.Request.Body))
+	if err != nil {
+		result.Err = errors.Wrap(err, "invalid captured request")
+		return result
+	}
+	for name, values := range rec.Request.Header {
+		r.Header[name] = append([]string(nil), values...)
+	}
+	core.RemoveHopHeaders(r.Header)
+
+	response, err := p.Transport.RoundTrip(r)
+	if err != nil {
+		result.Err = err
+		return result
+	}
+	defer response.Body.Close()
+	digest := sha256.New()
+	if _, err := io.Copy(digest, response.Body); err != nil {
+		result.Err = errors.Wrap(err, "failed to read replayed body")
+		return result
+	}
+	core.RemoveHopHeaders(response.Header)
+
+	if rec.Response.Status != response.StatusCode {
+		result.Diffs = append(result.Diffs, Diff{
+			Field:    "status",
+			Recorded: fmt.Sprint(rec.Response.Status),
+			Replayed: fmt.Sprint(response.StatusCode),
+		})
+	}
+	result.Diffs = append(result.Diffs, p.diffHeaders(rec.Response.Header, response.Header)...)
+	if sum := hex.EncodeToString(digest.Sum(nil)); rec.Response.BodySHA256 != "" && sum != rec.Response.BodySHA256 {
+		result.Diffs = append(result.Diffs, Diff{Field: "body", Recorded: rec.Response.BodySHA256, Replayed: sum})
+	}
+	return result
+}
+
+func (p *Replayer) diffHeaders(recorded, replayed http.Header) []Diff {
+	ignored := make(map[string]bool, len(p.IgnoreHeaders))
+	for _, name := range p.IgnoreHeaders {
+		ignored[http.CanonicalHeaderKey(name)] = true
+	}
+	names := make(map[string]bool)
+	for name := range recorded {
+		names[http.CanonicalHeaderKey(name)] = true
+	}
+	for name := range replayed {
+		names[http.CanonicalHeaderKey(name)] = true
+	}
+	sorted := make([]string, 0, len(names))
+	for name := range names {
+		if !ignored[name] {
+			sorted = append(sorted, name)
+		}
+	}
+	sort.Strings(sorted)
+
+	var diffs []Diff
+	for _, name := range sorted {
+		a := strings.Join(recorded.Values(name), ", ")
+		b := strings.Join(replayed.Values(name), ", ")
+		if a != b {
+			diffs = append(diffs, Diff{Field: "header " + name, Recorded: a, Replayed: b})
+		}
+	}
+	return diffs
+}
@@ -0,0 +1,74 @@
+package capture
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func bodySum(s string) string {
+	sum := sha256.Sum256([]byte(s))
+	return hex.EncodeToString(sum[:])
+}
+
+func TestReplay(t *testing.T) {
+	require := require.New(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("X-Method", r.Method)
+		w.Header().Set("X-Request-Id", "random")
+		w.Write(body)
+	}))
+	defer origin.Close()
+
+	rec := &Record{
+		Request: Request{
+			Method: "POST",
+			URL:    origin.URL + "/echo",
+			Header: http.Header{"Connection": {"close"}},
+			Body:   []byte("hello"),
+		},
+		Response: Response{
+			Status: 200,
+			Header: http.Header{
+				"Content-Type":   {"text/plain"},
+				"Content-Length": {"5"},
+				"X-Method":       {"POST"},
+			},
+			BodySHA256: bodySum("hello"),
+		},
+	}
+	p := NewReplayer(http.DefaultTransport)
+	result := p.Replay(context.Background(), rec)
+	require.NoError(result.Err)
+	require.Empty(result.Diffs)
+
+	rec.Response.Status = 201
+	rec.Response.Header.Set("X-Method", "GET")
+	rec.Response.BodySHA256 = bodySum("other")
+	result = p.Replay(context.Background(), rec)
+	require.NoError(result.Err)
+	require.Equal([]Diff{
+		{Field: "status", Recorded: "201", Replayed: "200"},
+		{Field: "header X-Method", Recorded: "GET", Replayed: "POST"},
+		{Field: "body", Recorded: bodySum("other"), Replayed: bodySum("hello")},
+	}, result.Diffs)
+
+	p.IgnoreHeaders = nil
+	result = p.Replay(context.Background(), rec)
+	require.Contains(result.Diffs, Diff{Field: "header X-Request-Id", Recorded: "", Replayed: "random"})
+}
+
+func TestReplayTruncated(t *testing.T) {
+	require := require.New(t)
+	rec := &Record{Request: Request{Method: "POST", URL: "http://example.com", BodyTruncated: true}}
+	result := NewReplayer(http.DefaultTransport).Replay(context.Background(), rec)
+	require.Error(result.Err)
+}
@@ -106,6 +106,11 @@ func (m *CertCA) HostTLSConfig(host string) (*tls.Config, error) {
 	return config, nil
 }
 
+// Certificates returns the certificates signed for hosts so far.
+func (m *CertCA) Certificates() []CachedCert {
+	return m.storage.List()
+}
+
 // LoadCA will load or create the CA at CAROOT.
 func (m *CertCA) LoadCA() error {
 
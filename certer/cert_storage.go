@@ -2,13 +2,25 @@ package certer
 
 import (
 	"crypto/tls"
+	"crypto/x509"
+	"sort"
 	"sync"
+	"time"
 )
 
 type CertStorage struct {
 	certs sync.Map
 }
 
+// CachedCert describes a certificate signed for a host.
+type CachedCert struct {
+	Host      string    `json:"host"`
+	Serial    string    `json:"serial"`
+	DNSNames  []string  `json:"dnsNames,omitempty"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+}
+
 func (tcs *CertStorage) Fetch(hostname string, gen func() (*tls.Certificate, error)) (*tls.Certificate, error) {
 	var cert tls.Certificate
 	icert, ok := tcs.certs.Load(hostname)
@@ -26,6 +38,25 @@ func (tcs *CertStorage) Fetch(hostname string, gen func() (*tls.Certificate, err
 	return &cert, nil
 }
 
+// List returns the stored certificates, sorted by host.
+func (tcs *CertStorage) List() []CachedCert {
+	var certs []CachedCert
+	tcs.certs.Range(func(key, value interface{}) bool {
+		c := CachedCert{Host: key.(string)}
+		if cert := value.(tls.Certificate); len(cert.Certificate) > 0 {
+			if x509Cert, err := x509.ParseCertificate(cert.Certificate[0]); err == nil {
+				c.Serial = x509Cert.SerialNumber.String()
+				c.DNSNames = x509Cert.DNSNames
+				c.NotBefore, c.NotAfter = x509Cert.NotBefore, x509Cert.NotAfter
+			}
+		}
+		certs = append(certs, c)
+		return true
+	})
+	sort.Slice(certs, func(i, j int) bool { return certs[i].Host < certs[j].Host })
+	return certs
+}
+
 func NewCertStorage() *CertStorage {
 	tcs := &CertStorage{}
 	tcs.certs = sync.Map{}
@@ -4,6 +4,7 @@ import (
 	"io/ioutil"
 	"path/filepath"
 	"strings"
+	"time"
 
 	"github.com/millken/httpctl/log"
 	"github.com/pkg/errors"
@@ -23,10 +24,102 @@ type (
 	Https struct {
 		Listen string `yaml:"listen" json:"listen"`
 	}
+	// Http3 configures the optional QUIC listener. When Listen is empty,
+	// StripAltSvc removes Alt-Svc from responses so clients don't switch to
+	// HTTP/3 and bypass interception.
+	Http3 struct {
+		Listen      string `yaml:"listen" json:"listen"`
+		StripAltSvc bool   `yaml:"stripAltSvc" json:"stripAltSvc"`
+	}
+	// ProxyRule routes the matching hosts through Proxy instead of the
+	// default upstream proxy. Hosts are glob patterns such as "*.google.com".
+	ProxyRule struct {
+		Hosts []string `yaml:"hosts" json:"hosts"`
+		Proxy string   `yaml:"proxy" json:"proxy"`
+	}
+	// Transport tunes the pooled upstream connections. Zero values use the
+	// defaults of core.CreateHTTPTransport.
+	Transport struct {
+		MaxIdleConns        int           `yaml:"maxIdleConns" json:"maxIdleConns"`
+		MaxIdleConnsPerHost int           `yaml:"maxIdleConnsPerHost" json:"maxIdleConnsPerHost"`
+		MaxConnsPerHost     int           `yaml:"maxConnsPerHost" json:"maxConnsPerHost"`
+		IdleConnTimeout     time.Duration `yaml:"idleConnTimeout" json:"idleConnTimeout"`
+		InsecureSkipVerify  bool          `yaml:"insecureSkipVerify" json:"insecureSkipVerify"`
+	}
+	// ProtocolRule forces the upstream protocol, one of "h1", "h2", "h3" or
+	// "auto", for the matching hosts.
+	ProtocolRule struct {
+		Hosts    []string `yaml:"hosts" json:"hosts"`
+		Protocol string   `yaml:"protocol" json:"protocol"`
+	}
+	// WebSocket controls decoding of proxied WebSocket frames into the
+	// "websocket" logger. Messages larger than MaxPayload bytes are logged
+	// without their payload.
+	WebSocket struct {
+		Inspect    bool `yaml:"inspect" json:"inspect"`
+		MaxPayload int  `yaml:"maxPayload" json:"maxPayload"`
+	}
+	// Forward controls the headers added to proxied requests. Via is also
+	// added to responses. They are off by default so interception stays
+	// invisible to both sides.
+	Forward struct {
+		Via             bool `yaml:"via" json:"via"`
+		XForwardedFor   bool `yaml:"xForwardedFor" json:"xForwardedFor"`
+		XForwardedHost  bool `yaml:"xForwardedHost" json:"xForwardedHost"`
+		XForwardedProto bool `yaml:"xForwardedProto" json:"xForwardedProto"`
+	}
+	// Capture appends every exchange logged by the HTTP log middleware to
+	// the JSONL file at Path, see package capture.
+	Capture struct {
+		Path string `yaml:"path" json:"path"`
+	}
+	// Rules applies the rules file at Path to the proxied traffic, see
+	// package rules. The file is reloaded when it changes, checking every
+	// ReloadInterval; zero disables reloading.
+	Rules struct {
+		Path           string        `yaml:"path" json:"path"`
+		ReloadInterval time.Duration `yaml:"reloadInterval" json:"reloadInterval"`
+	}
+	// Breakpoint holds the requests, the responses or both of the matching
+	// exchanges. Hosts are glob patterns and Path is a regular expression on
+	// the request path; empty conditions match everything.
+	Breakpoint struct {
+		Hosts    []string `yaml:"hosts" json:"hosts"`
+		Path     string   `yaml:"path" json:"path"`
+		Method   []string `yaml:"method" json:"method"`
+		Request  bool     `yaml:"request" json:"request"`
+		Response bool     `yaml:"response" json:"response"`
+	}
+	// Breakpoints holds matching exchanges until they are resumed through
+	// the admin API, or until Timeout has passed.
+	Breakpoints struct {
+		Timeout time.Duration `yaml:"timeout" json:"timeout"`
+		Rules   []Breakpoint  `yaml:"rules" json:"rules"`
+	}
+	// Admin serves the JSON admin API on Listen, see package admin. A
+	// listen address without host binds to loopback; Token must be set to
+	// bind elsewhere and is then required as a bearer token. The MaxFlows
+	// most recent flows are kept for listing.
+	Admin struct {
+		Listen   string `yaml:"listen" json:"listen"`
+		Token    string `yaml:"token" json:"token"`
+		MaxFlows int    `yaml:"maxFlows" json:"maxFlows"`
+	}
 	Server struct {
-		Http     Http   `yaml:"http" json:"http"`
-		Https    Https  `yaml:"https" json:"https"`
-		Resolver string `yaml:"resolver" json:"resolver"`
+		Http        Http           `yaml:"http" json:"http"`
+		Https       Https          `yaml:"https" json:"https"`
+		Http3       Http3          `yaml:"http3" json:"http3"`
+		Resolver    string         `yaml:"resolver" json:"resolver"`
+		Proxy       string         `yaml:"proxy" json:"proxy"`
+		ProxyRules  []ProxyRule    `yaml:"proxyRules" json:"proxyRules"`
+		Transport   Transport      `yaml:"transport" json:"transport"`
+		Protocols   []ProtocolRule `yaml:"protocols" json:"protocols"`
+		WebSocket   WebSocket      `yaml:"websocket" json:"websocket"`
+		Forward     Forward        `yaml:"forward" json:"forward"`
+		Capture     Capture        `yaml:"capture" json:"capture"`
+		Rules       Rules          `yaml:"rules" json:"rules"`
+		Breakpoints Breakpoints    `yaml:"breakpoints" json:"breakpoints"`
+		Admin       Admin          `yaml:"admin" json:"admin"`
 	}
 	ExampleExecutor struct {
 		Enable bool `yaml:"enable" json:"enable"`
@@ -41,14 +134,34 @@ type (
 		Hosts      []string `yaml:"hosts" json:"hosts"`
 		OutputPath string   `yaml:"outputPath" json:"outputPath"`
 	}
+	// FlowExecutor records the proxied exchanges and WebSocket messages of
+	// the matching hosts, or of all hosts if none is given, into OutputPath.
+	// Bodies are kept up to MaxBodySize bytes, and the records of the
+	// MaxDays most recent days.
 	FlowExecutor struct {
-		Enable bool `yaml:"enable" json:"enable"`
+		Enable      bool     `yaml:"enable" json:"enable"`
+		Hosts       []string `yaml:"hosts" json:"hosts"`
+		OutputPath  string   `yaml:"outputPath" json:"outputPath"`
+		MaxBodySize int      `yaml:"maxBodySize" json:"maxBodySize"`
+		MaxDays     int      `yaml:"maxDays" json:"maxDays"`
+	}
+	// HarExecutor writes the recorded flows of the matching hosts, or of
+	// all hosts if none is given, as HAR files in OutputPath. Split is
+	// "session" for one file per run or "host" for one file per host and
+	// run. A file is rolled over once it holds MaxEntries entries.
+	HarExecutor struct {
+		Enable     bool     `yaml:"enable" json:"enable"`
+		Hosts      []string `yaml:"hosts" json:"hosts"`
+		OutputPath string   `yaml:"outputPath" json:"outputPath"`
+		Split      string   `yaml:"split" json:"split"`
+		MaxEntries int      `yaml:"maxEntries" json:"maxEntries"`
 	}
 	Executor struct {
 		Example   ExampleExecutor   `yaml:"example" json:"example"`
 		SiteCopy  SiteCopyExecutor  `yaml:"sitecopy" json:"sitecopy"`
 		SourceMap SourceMapExecutor `yaml:"sourcemap" json:"sourcemap"`
 		Flow      FlowExecutor      `yaml:"flow" json:"flow"`
+		Har       HarExecutor       `yaml:"har" json:"har"`
 	}
 	Config struct {
 		Server   Server                      `yaml:"server" json:"server"`
@@ -0,0 +1,87 @@
+package core
+
+import (
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// altSvcMaxAge is the freshness lifetime of an Alt-Svc entry without "ma",
+// see RFC 7838 section 3.1.
+const altSvcMaxAge = 24 * time.Hour
+
+type altSvcEntry struct {
+	port    string
+	expires time.Time
+}
+
+// altSvcCache remembers which origins advertised HTTP/3 with an Alt-Svc
+// response header, keyed by origin host:port.
+type altSvcCache struct {
+	mu      sync.RWMutex
+	entries map[string]altSvcEntry
+}
+
+func newAltSvcCache() *altSvcCache {
+	return &altSvcCache{
+		entries: make(map[string]altSvcEntry),
+	}
+}
+
+// Lookup returns the UDP port to use for HTTP/3 on origin, or false if the
+// origin has not advertised HTTP/3 or the advertisement expired.
+func (c *altSvcCache) Lookup(origin string) (string, bool) {
+	c.mu.RLock()
+	entry, ok := c.entries[origin]
+	c.mu.RUnlock()
+	if !ok || time.Now().After(entry.expires) {
+		return "", false
+	}
+	return entry.port, true
+}
+
+// Update records the Alt-Svc header value received from origin.
+func (c *altSvcCache) Update(origin, value string) {
+	if value == "" {
+		return
+	}
+	if strings.TrimSpace(value) == "clear" {
+		c.Delete(origin)
+		return
+	}
+	for _, alt := range strings.Split(value, ",") {
+		params := strings.Split(alt, ";")
+		proto := strings.SplitN(strings.TrimSpace(params[0]), "=", 2)
+		if len(proto) != 2 || proto[0] != "h3" {
+			continue
+		}
+		// Only alternatives on the same host are followed, so the
+		// certificate presented over QUIC matches the original one.
+		host, port, err := net.SplitHostPort(strings.Trim(proto[1], `"`))
+		if err != nil || host != "" || port == "" {
+			continue
+		}
+		maxAge := altSvcMaxAge
+		for _, param := range params[1:] {
+			kv := strings.SplitN(strings.TrimSpace(param), "=", 2)
+			if len(kv) == 2 && kv[0] == "ma" {
+				if secs, err := strconv.Atoi(strings.Trim(kv[1], `"`)); err == nil {
+					maxAge = time.Duration(secs) * time.Second
+				}
+			}
+		}
+		c.mu.Lock()
+		c.entries[origin] = altSvcEntry{port: port, expires: time.Now().Add(maxAge)}
+		c.mu.Unlock()
+		return
+	}
+}
+
+// Delete forgets origin, e.g. after HTTP/3 failed for it.
+func (c *altSvcCache) Delete(origin string) {
+	c.mu.Lock()
+	delete(c.entries, origin)
+	c.mu.Unlock()
+}
@@ -0,0 +1,416 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/log"
+	"github.com/millken/httpctl/upstream"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	PhaseRequest  = "request"
+	PhaseResponse = "response"
+
+	defaultBreakpointTimeout = time.Minute
+)
+
+// BreakpointBodyLimit is the largest body that can be edited at a
+// breakpoint. Larger bodies are held and passed on unchanged.
+var BreakpointBodyLimit = 4 << 20
+
+var (
+	// ErrFlowNotHeld is returned for a flow that is not, or no longer, held.
+	ErrFlowNotHeld = errors.New("flow is not held")
+	// ErrBreakpointAbort is the error of the exchanges aborted at a
+	// breakpoint.
+	ErrBreakpointAbort = errors.New("aborted at breakpoint")
+)
+
+// HeldFlow is a request or response held at a breakpoint.
+type HeldFlow struct {
+	ID       string      `json:"id"`
+	Phase    string      `json:"phase"`
+	HeldAt   time.Time   `json:"heldAt"`
+	Deadline time.Time   `json:"deadline"`
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Status   int         `json:"status,omitempty"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body,omitempty"`
+	// BodyTooLarge is set when the body is larger than BreakpointBodyLimit;
+	// Body is then empty and cannot be edited.
+	BodyTooLarge bool `json:"bodyTooLarge,omitempty"`
+}
+
+// FlowEdit modifies a held flow. Header replaces all headers and Body the
+// body when they are set; Status only applies to responses.
+type FlowEdit struct {
+	Header http.Header `json:"header,omitempty"`
+	Body   *[]byte     `json:"body,omitempty"`
+	Status int         `json:"status,omitempty"`
+}
+
+// Breakpoints is the registry of the flows held at breakpoints. It is safe
+// for concurrent use.
+type Breakpoints struct {
+	timeout time.Duration
+	log     *zap.Logger
+
+	mu      sync.Mutex
+	rules   []config.Breakpoint
+	filters []breakpointFilter
+	pending map[string]*heldFlow
+}
+
+type breakpointFilter struct {
+	hosts    []string
+	path     *regexp.Regexp
+	methods  []string
+	request  bool
+	response bool
+}
+
+type heldFlow struct {
+	flow HeldFlow
+	// resume receives true to continue and false to abort.
+	resume chan bool
+}
+
+// NewBreakpoints returns a registry holding the exchanges matching the
+// rules of cfg.
+func NewBreakpoints(cfg config.Breakpoints) (*Breakpoints, error) {
+	b := &Breakpoints{
+		timeout: cfg.Timeout,
+		log:     log.Logger("breakpoint"),
+		pending: make(map[string]*heldFlow),
+	}
+	if b.timeout <= 0 {
+		b.timeout = defaultBreakpointTimeout
+	}
+	if err := b.SetRules(cfg.Rules); err != nil {
+		return nil, err
+	}
+	return b, nil
+}
+
+// SetBreakpoints makes the Mux hold the exchanges matching b.
+func (mx *Mux) SetBreakpoints(b *Breakpoints) {
+	mx.breakpoints = b
+}
+
+// Rules returns the breakpoint rules.
+func (b *Breakpoints) Rules() []config.Breakpoint {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.rules
+}
+
+// SetRules replaces the breakpoint rules. Flows already held stay held.
+func (b *Breakpoints) SetRules(rules []config.Breakpoint) error {
+	filters := make([]breakpointFilter, 0, len(rules))
+	for i, rule := range rules {
+		f := breakpointFilter{hosts: rule.Hosts, request: rule.Request, response: rule.Response}
+		if rule.Path != "" {
+			re, err := regexp.Compile(rule.Path)
+			if err != nil {
+				return errors.Wrapf(err, "invalid path of breakpoint %d", i+1)
+			}
+			f.path = re
+		}
+		for _, method := range rule.Method {
+			f.methods = append(f.methods, strings.ToUpper(method))
+		}
+		if !f.request && !f.response {
+			return errors.Errorf("breakpoint %d holds neither requests nor responses", i+1)
+		}
+		filters = append(filters, f)
+	}
+	b.mu.Lock()
+	b.rules, b.filters = rules, filters
+	b.mu.Unlock()
+	return nil
+}
+
+// List returns the held flows, oldest first.
+func (b *Breakpoints) List() []HeldFlow {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	flows := make([]HeldFlow, 0, len(b.pending))
+	for _, h := range b.pending {
+		flows = append(flows, h.flow)
+	}
+	sort.Slice(flows, func(i, j int) bool { return flows[i].HeldAt.Before(flows[j].HeldAt) })
+	return flows
+}
+
+// Get returns the held flow id.
+func (b *Breakpoints) Get(id string) (HeldFlow, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h, ok := b.pending[id]
+	if !ok {
+		return HeldFlow{}, ErrFlowNotHeld
+	}
+	return h.flow, nil
+}
+
+// Modify applies edit to the held flow id, which stays held.
+func (b *Breakpoints) Modify(id string, edit FlowEdit) (HeldFlow, error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h, ok := b.pending[id]
+	if !ok {
+		return HeldFlow{}, ErrFlowNotHeld
+	}
+	f := &h.flow
+	if edit.Status != 0 {
+		if f.Phase != PhaseResponse {
+			return HeldFlow{}, errors.New("the status of a request cannot be set")
+		}
+		if edit.Status < 100 || edit.Status > 999 {
+			return HeldFlow{}, errors.Errorf("invalid status %d", edit.Status)
+		}
+		f.Status = edit.Status
+	}
+	if edit.Body != nil {
+		if f.BodyTooLarge {
+			return HeldFlow{}, errors.New("the body is too large to be edited")
+		}
+		f.Body = *edit.Body
+	}
+	if edit.Header != nil {
+		f.Header = edit.Header.Clone()
+	}
+	return *f, nil
+}
+
+// Resume lets the held flow id continue.
+func (b *Breakpoints) Resume(id string) error {
+	return b.release(id, true)
+}
+
+// Abort fails the held flow id: the client gets a 502 response.
+func (b *Breakpoints) Abort(id string) error {
+	return b.release(id, false)
+}
+
+func (b *Breakpoints) release(id string, resume bool) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	h, ok := b.pending[id]
+	if !ok {
+		return ErrFlowNotHeld
+	}
+	delete(b.pending, id)
+	h.resume <- resume
+	return nil
+}
+
+// match returns true if a breakpoint of phase holds r.
+func (b *Breakpoints) match(r *http.Request, phase string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	for _, f := range b.filters {
+		if (phase == PhaseRequest && !f.request) || (phase == PhaseResponse && !f.response) {
+			continue
+		}
+		if f.match(r) {
+			return true
+		}
+	}
+	return false
+}
+
+func (f *breakpointFilter) match(r *http.Request) bool {
+	if len(f.hosts) > 0 {
+		host := r.Host
+		if h, _, err := net.SplitHostPort(host); err == nil {
+			host = h
+		}
+		matched := false
+		for _, pattern := range f.hosts {
+			if upstream.MatchHost(pattern, host) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	if f.path != nil && !f.path.MatchString(r.URL.Path) {
+		return false
+	}
+	if len(f.methods) > 0 {
+		for _, method := range f.methods {
+			if method == r.Method {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// hold registers f and waits until it is resumed or aborted, the timeout
+// has passed or ctx is done. It returns the flow as edited and whether it
+// may continue.
+func (b *Breakpoints) hold(ctx context.Context, f HeldFlow) (HeldFlow, bool) {
+	f.ID = newFlowID()
+	f.HeldAt = time.Now()
+	f.Deadline = f.HeldAt.Add(b.timeout)
+	h := &heldFlow{flow: f, resume: make(chan bool, 1)}
+	b.mu.Lock()
+	b.pending[f.ID] = h
+	b.mu.Unlock()
+	logger := b.log.With(zap.String("id", f.ID), zap.String("phase", f.Phase), zap.String("url", f.URL))
+	logger.Info("flow held")
+
+	timer := time.NewTimer(b.timeout)
+	defer timer.Stop()
+	resume := true
+	select {
+	case resume = <-h.resume:
+	case <-timer.C:
+		logger.Info("breakpoint timed out, continuing")
+	case <-ctx.Done():
+		logger.Info("client went away while held")
+		resume = false
+	}
+	b.mu.Lock()
+	delete(b.pending, f.ID)
+	f = h.flow
+	b.mu.Unlock()
+	return f, resume
+}
+
+// holdRequest holds r if a request breakpoint matches it, returning r as
+// edited. ErrBreakpointAbort is returned if it was aborted.
+func (b *Breakpoints) holdRequest(r *http.Request) (*http.Request, error) {
+	if !b.match(r, PhaseRequest) {
+		return r, nil
+	}
+	f := HeldFlow{
+		Phase:  PhaseRequest,
+		Method: r.Method,
+		URL:    requestURL(r),
+		Header: r.Header.Clone(),
+	}
+	var rest io.Reader
+	f.Body, rest = readHeldBody(r.Body)
+	f.BodyTooLarge = rest != nil
+	f, ok := b.hold(r.Context(), f)
+	if !ok {
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		return r, ErrBreakpointAbort
+	}
+	r.Header = f.Header
+	switch {
+	case rest != nil:
+		r.Body = struct {
+			io.Reader
+			io.Closer
+		}{rest, r.Body}
+	case len(f.Body) > 0 || (r.Body != nil && r.Body != http.NoBody):
+		if r.Body != nil {
+			r.Body.Close()
+		}
+		r.Body = io.NopCloser(bytes.NewReader(f.Body))
+		r.ContentLength = int64(len(f.Body))
+	}
+	return r, nil
+}
+
+// holdResponse holds response if a response breakpoint matches r,
+// editing it in place. ErrBreakpointAbort is returned if it was aborted.
+func (b *Breakpoints) holdResponse(r *http.Request, response *http.Response) error {
+	if !b.match(r, PhaseResponse) {
+		return nil
+	}
+	f := HeldFlow{
+		Phase:  PhaseResponse,
+		Method: r.Method,
+		URL:    requestURL(r),
+		Status: response.StatusCode,
+		Header: response.Header.Clone(),
+	}
+	var rest io.Reader
+	f.Body, rest = readHeldBody(response.Body)
+	f.BodyTooLarge = rest != nil
+	held := f.Body
+	f, ok := b.hold(r.Context(), f)
+	if !ok {
+		return ErrBreakpointAbort
+	}
+	if f.Status != response.StatusCode {
+		response.StatusCode = f.Status
+		response.Status = strconv.Itoa(f.Status) + " " + http.StatusText(f.Status)
+	}
+	response.Header = f.Header
+	if rest != nil {
+		response.Body = struct {
+			io.Reader
+			io.Closer
+		}{rest, response.Body}
+		return nil
+	}
+	response.Body.Close()
+	response.Body = io.NopCloser(bytes.NewReader(f.Body))
+	// HEAD responses and statuses without a body keep the length of the
+	// representation they describe.
+	if bytes.Equal(f.Body, held) || r.Method == http.MethodHead || !bodyAllowedForStatus(f.Status) {
+		return nil
+	}
+	response.ContentLength = int64(len(f.Body))
+	response.Header.Del("Transfer-Encoding")
+	response.Header.Set("Content-Length", strconv.Itoa(len(f.Body)))
+	return nil
+}
+
+// bodyAllowedForStatus returns true if a response with status may have a
+// body.
+func bodyAllowedForStatus(status int) bool {
+	switch {
+	case status >= 100 && status <= 199:
+		return false
+	case status == http.StatusNoContent, status == http.StatusNotModified:
+		return false
+	}
+	return true
+}
+
+// readHeldBody reads body up to BreakpointBodyLimit. If it is larger, what
+// was read is returned as rest, followed by the remaining body.
+func readHeldBody(body io.ReadCloser) ([]byte, io.Reader) {
+	if body == nil || body == http.NoBody {
+		return nil, nil
+	}
+	b, err := io.ReadAll(io.LimitReader(body, int64(BreakpointBodyLimit)+1))
+	if len(b) > BreakpointBodyLimit || err != nil {
+		return nil, io.MultiReader(bytes.NewReader(b), body)
+	}
+	return b, nil
+}
+
+func requestURL(r *http.Request) string {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	return scheme + "://" + r.Host + r.URL.RequestURI()
+}
@@ -0,0 +1,105 @@
+package core
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/internal/httpjson"
+	"github.com/pkg/errors"
+)
+
+// Handler returns the control API of the breakpoints, answering in JSON:
+//
+//	GET   /flows              held flows, oldest first
+//	GET   /flows/{id}         a held flow
+//	PATCH /flows/{id}         edit a held flow with a FlowEdit
+//	POST  /flows/{id}/resume  let a held flow continue
+//	POST  /flows/{id}/abort   fail a held flow
+//	GET   /rules              breakpoint rules
+//	PUT   /rules              replace the breakpoint rules
+//
+// Mount it with http.StripPrefix when serving it below a path.
+func (b *Breakpoints) Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(r.URL.Path, "/"), "/")
+		switch {
+		case len(parts) == 1 && parts[0] == "flows":
+			if r.Method != http.MethodGet {
+				httpjson.MethodNotAllowed(w, http.MethodGet)
+				return
+			}
+			httpjson.Write(w, http.StatusOK, b.List())
+		case len(parts) == 2 && parts[0] == "flows":
+			b.serveFlow(w, r, parts[1])
+		case len(parts) == 3 && parts[0] == "flows" && (parts[2] == "resume" || parts[2] == "abort"):
+			if r.Method != http.MethodPost {
+				httpjson.MethodNotAllowed(w, http.MethodPost)
+				return
+			}
+			release := b.Resume
+			if parts[2] == "abort" {
+				release = b.Abort
+			}
+			if err := release(parts[1]); err != nil {
+				httpjson.Error(w, http.StatusNotFound, err)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		case len(parts) == 1 && parts[0] == "rules":
+			b.serveRules(w, r)
+		default:
+			httpjson.Error(w, http.StatusNotFound, errors.New("not found"))
+		}
+	})
+}
+
+func (b *Breakpoints) serveFlow(w http.ResponseWriter, r *http.Request, id string) {
+	switch r.Method {
+	case http.MethodGet:
+		f, err := b.Get(id)
+		if err != nil {
+			httpjson.Error(w, http.StatusNotFound, err)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, f)
+	case http.MethodPatch:
+		var edit FlowEdit
+		if err := json.NewDecoder(r.Body).Decode(&edit); err != nil {
+			httpjson.Error(w, http.StatusBadRequest, errors.Wrap(err, "invalid edit"))
+			return
+		}
+		f, err := b.Modify(id, edit)
+		switch {
+		case err == ErrFlowNotHeld:
+			httpjson.Error(w, http.StatusNotFound, err)
+		case err != nil:
+			httpjson.Error(w, http.StatusBadRequest, err)
+		default:
+			httpjson.Write(w, http.StatusOK, f)
+		}
+	default:
+		httpjson.MethodNotAllowed(w, http.MethodGet, http.MethodPatch)
+	}
+}
+
+func (b *Breakpoints) serveRules(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		httpjson.Write(w, http.StatusOK, b.Rules())
+	case http.MethodPut:
+		var rules []config.Breakpoint
+		if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+			httpjson.Error(w, http.StatusBadRequest, errors.Wrap(err, "invalid rules"))
+			return
+		}
+		if err := b.SetRules(rules); err != nil {
+			httpjson.Error(w, http.StatusBadRequest, err)
+			return
+		}
+		httpjson.Write(w, http.StatusOK, b.Rules())
+	default:
+		httpjson.MethodNotAllowed(w, http.MethodGet, http.MethodPut)
+	}
+}
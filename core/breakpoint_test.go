@@ -0,0 +1,269 @@
+package core
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/millken/httpctl/config"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestBreakpoints(t *testing.T, timeout time.Duration, rules ...config.Breakpoint) *Breakpoints {
+	b, err := NewBreakpoints(config.Breakpoints{Timeout: timeout, Rules: rules})
+	require.NoError(t, err)
+	return b
+}
+
+// serveHeld serves r in the background and waits until it is held.
+func serveHeld(t *testing.T, mx *Mux, b *Breakpoints, r *http.Request) (HeldFlow, <-chan *httptest.ResponseRecorder) {
+	done := make(chan *httptest.ResponseRecorder, 1)
+	go func() {
+		rec := httptest.NewRecorder()
+		mx.ServeHTTP(rec, r)
+		done <- rec
+	}()
+	require.Eventually(t, func() bool { return len(b.List()) == 1 }, time.Second, time.Millisecond)
+	return b.List()[0], done
+}
+
+func TestBreakpoints_Request(t *testing.T) {
+	require := require.New(t)
+	received := make(chan *http.Request, 1)
+	origin := newTestOrigin(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		received <- r
+		w.Write(body)
+	})
+	defer origin.Close()
+
+	b := newTestBreakpoints(t, time.Minute, config.Breakpoint{Path: "^/orders", Method: []string{"post"}, Request: true})
+	mx := newTestMux(t, config.Server{})
+	defer mx.Close()
+	mx.SetBreakpoints(b)
+
+	// Requests that don't match are not held.
+	rec := serveMux(mx, http.MethodGet, origin.URL+"/orders", nil)
+	require.Equal(http.StatusOK, rec.Code)
+	<-received
+
+	r := httptest.NewRequest(http.MethodPost, origin.URL+"/orders", strings.NewReader(`{"qty":1}`))
+	r.Header.Set("X-Test", "original")
+	f, done := serveHeld(t, mx, b, r)
+	require.Equal(PhaseRequest, f.Phase)
+	require.Equal(http.MethodPost, f.Method)
+	require.Equal(origin.URL+"/orders", f.URL)
+	require.Equal("original", f.Header.Get("X-Test"))
+	require.Equal(`{"qty":1}`, string(f.Body))
+
+	body := []byte(`{"qty":100}`)
+	f, err := b.Modify(f.ID, FlowEdit{Header: http.Header{"X-Test": {"edited"}}, Body: &body})
+	require.NoError(err)
+	require.Equal("edited", f.Header.Get("X-Test"))
+	_, err = b.Modify(f.ID, FlowEdit{Status: 500})
+	require.Error(err)
+	require.NoError(b.Resume(f.ID))
+	require.Equal(ErrFlowNotHeld, b.Resume(f.ID))
+
+	rec = <-done
+	require.Equal(`{"qty":100}`, rec.Body.String())
+	got := <-received
+	require.Equal("edited", got.Header.Get("X-Test"))
+	require.Equal(int64(len(body)), got.ContentLength)
+	require.Empty(b.List())
+}
+
+func TestBreakpoints_Response(t *testing.T) {
+	require := require.New(t)
+	origin := newTestOrigin(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain")
+		io.WriteString(w, "original")
+	})
+	defer origin.Close()
+
+	b := newTestBreakpoints(t, time.Minute, config.Breakpoint{Response: true})
+	mx := newTestMux(t, config.Server{})
+	defer mx.Close()
+	mx.SetBreakpoints(b)
+
+	f, done := serveHeld(t, mx, b, httptest.NewRequest(http.MethodGet, origin.URL+"/", nil))
+	require.Equal(PhaseResponse, f.Phase)
+	require.Equal(http.StatusOK, f.Status)
+	require.Equal("original", string(f.Body))
+
+	body := []byte("edited response")
+	_, err := b.Modify(f.ID, FlowEdit{Status: http.StatusTeapot, Body: &body})
+	require.NoError(err)
+	require.NoError(b.Resume(f.ID))
+
+	rec := <-done
+	require.Equal(http.StatusTeapot, rec.Code)
+	require.Equal("edited response", rec.Body.String())
+	require.Equal("15", rec.Header().Get("Content-Length"))
+	require.Equal("text/plain", rec.Header().Get("Content-Type"))
+}
+
+func TestBreakpoints_ResponseLength(t *testing.T) {
+	require := require.New(t)
+	origin := newTestOrigin(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path == "/cached" {
+			w.Header().Set("Content-Length", "42")
+			w.WriteHeader(http.StatusNotModified)
+			return
+		}
+		io.WriteString(w, "original")
+	})
+	defer origin.Close()
+
+	b := newTestBreakpoints(t, time.Minute, config.Breakpoint{Response: true})
+	mx := newTestMux(t, config.Server{})
+	defer mx.Close()
+	mx.SetBreakpoints(b)
+	body := []byte("edited response")
+
+	// HEAD keeps the length of the body it describes, edited or not.
+	for _, edit := range []FlowEdit{{}, {Body: &body}} {
+		f, done := serveHeld(t, mx, b, httptest.NewRequest(http.MethodHead, origin.URL+"/", nil))
+		_, err := b.Modify(f.ID, edit)
+		require.NoError(err)
+		require.NoError(b.Resume(f.ID))
+		require.Equal("8", (<-done).Header().Get("Content-Length"))
+	}
+
+	f, done := serveHeld(t, mx, b, httptest.NewRequest(http.MethodGet, origin.URL+"/cached", nil))
+	require.Equal(http.StatusNotModified, f.Status)
+	_, err := b.Modify(f.ID, FlowEdit{Header: http.Header{"Content-Length": {"42"}, "X-Test": {"edited"}}})
+	require.NoError(err)
+	require.NoError(b.Resume(f.ID))
+	rec := <-done
+	require.Equal(http.StatusNotModified, rec.Code)
+	require.Equal("42", rec.Header().Get("Content-Length"))
+	require.Equal("edited", rec.Header().Get("X-Test"))
+}
+
+func TestBreakpoints_Abort(t *testing.T) {
+	require := require.New(t)
+	called := false
+	origin := newTestOrigin(func(w http.ResponseWriter, r *http.Request) { called = true })
+	defer origin.Close()
+
+	b := newTestBreakpoints(t, time.Minute, config.Breakpoint{Request: true})
+	mx := newTestMux(t, config.Server{})
+	defer mx.Close()
+	mx.SetBreakpoints(b)
+	var flows []*Flow
+	mx.HandleFlow(func(f *Flow) { flows = append(flows, f) })
+
+	f, done := serveHeld(t, mx, b, httptest.NewRequest(http.MethodGet, origin.URL+"/", nil))
+	require.NoError(b.Abort(f.ID))
+	rec := <-done
+	require.Equal(http.StatusBadGateway, rec.Code)
+	require.False(called)
+	require.Len(flows, 1)
+	require.Equal(ErrBreakpointAbort.Error(), flows[0].Error)
+}
+
+func TestBreakpoints_Timeout(t *testing.T) {
+	require := require.New(t)
+	origin := newTestOrigin(nil)
+	defer origin.Close()
+
+	b := newTestBreakpoints(t, 20*time.Millisecond, config.Breakpoint{Hosts: []string{"127.0.0.1"}, Request: true, Response: true})
+	mx := newTestMux(t, config.Server{})
+	defer mx.Close()
+	mx.SetBreakpoints(b)
+
+	start := time.Now()
+	rec := serveMux(mx, http.MethodGet, origin.URL+"/", nil)
+	require.Equal(http.StatusOK, rec.Code)
+	require.Equal("hello", rec.Body.String())
+	require.True(time.Since(start) >= 40*time.Millisecond)
+}
+
+func TestBreakpoints_ClientGone(t *testing.T) {
+	require := require.New(t)
+	origin := newTestOrigin(nil)
+	defer origin.Close()
+
+	b := newTestBreakpoints(t, time.Minute, config.Breakpoint{Request: true})
+	mx := newTestMux(t, config.Server{})
+	defer mx.Close()
+	mx.SetBreakpoints(b)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	_, done := serveHeld(t, mx, b, httptest.NewRequest(http.MethodGet, origin.URL+"/", nil).WithContext(ctx))
+	cancel()
+	rec := <-done
+	require.Equal(http.StatusBadGateway, rec.Code)
+	require.Empty(b.List())
+}
+
+func TestBreakpoints_Handler(t *testing.T) {
+	require := require.New(t)
+	origin := newTestOrigin(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Header.Get("X-Test"))
+	})
+	defer origin.Close()
+
+	b := newTestBreakpoints(t, time.Minute)
+	mx := newTestMux(t, config.Server{})
+	defer mx.Close()
+	mx.SetBreakpoints(b)
+	api := httptest.NewServer(http.StripPrefix("/breakpoints", b.Handler()))
+	defer api.Close()
+
+	do := func(method, path, body string) (*http.Response, []byte) {
+		req, err := http.NewRequest(method, api.URL+"/breakpoints"+path, strings.NewReader(body))
+		require.NoError(err)
+		res, err := http.DefaultClient.Do(req)
+		require.NoError(err)
+		defer res.Body.Close()
+		b, err := io.ReadAll(res.Body)
+		require.NoError(err)
+		return res, b
+	}
+
+	res, body := do("PUT", "/rules", `[{"hosts":["127.0.0.1"],"request":true}]`)
+	require.Equal(http.StatusOK, res.StatusCode)
+	require.JSONEq(`[{"hosts":["127.0.0.1"],"path":"","method":null,"request":true,"response":false}]`, string(body))
+	res, _ = do("PUT", "/rules", `[{"path":"("}]`)
+	require.Equal(http.StatusBadRequest, res.StatusCode)
+
+	f, done := serveHeld(t, mx, b, httptest.NewRequest(http.MethodGet, origin.URL+"/", nil))
+	res, body = do("GET", "/flows", "")
+	require.Equal(http.StatusOK, res.StatusCode)
+	require.Equal("application/json", res.Header.Get("Content-Type"))
+	var flows []HeldFlow
+	require.NoError(json.Unmarshal(body, &flows))
+	require.Len(flows, 1)
+	require.Equal(f.ID, flows[0].ID)
+
+	res, body = do("PATCH", "/flows/"+f.ID, `{"header":{"X-Test":["from api"]}}`)
+	require.Equal(http.StatusOK, res.StatusCode, string(body))
+	res, _ = do("PATCH", "/flows/"+f.ID, `{"status":200}`)
+	require.Equal(http.StatusBadRequest, res.StatusCode)
+	res, _ = do("GET", "/flows/"+f.ID, "")
+	require.Equal(http.StatusOK, res.StatusCode)
+	res, _ = do("GET", "/flows/"+f.ID+"/resume", "")
+	require.Equal(http.StatusMethodNotAllowed, res.StatusCode)
+	res, _ = do("POST", "/flows/"+f.ID+"/resume", "")
+	require.Equal(http.StatusNoContent, res.StatusCode)
+	require.Equal("from api", (<-done).Body.String())
+
+	res, body = do("POST", "/flows/"+f.ID+"/abort", "")
+	require.Equal(http.StatusNotFound, res.StatusCode)
+	require.JSONEq(`{"error":"flow is not held"}`, string(body))
+	res, _ = do("GET", "/unknown", "")
+	require.Equal(http.StatusNotFound, res.StatusCode)
+}
+
+func TestNewBreakpoints_Invalid(t *testing.T) {
+	require := require.New(t)
+	_, err := NewBreakpoints(config.Breakpoints{Rules: []config.Breakpoint{{Path: "/"}}})
+	require.EqualError(err, "breakpoint 1 holds neither requests nor responses")
+}
@@ -0,0 +1,147 @@
+package core
+
+import (
+	"bufio"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"github.com/millken/httpctl/log"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+// recordTypeHandshake is the first byte of a TLS ClientHello record.
+const recordTypeHandshake = 0x16
+
+var connectEstablished = []byte("HTTP/1.1 200 Connection Established\r\n\r\n")
+
+// handleConnect answers a CONNECT request from a client that uses httpctl as
+// an explicit proxy. The client connection is hijacked, TLS is terminated with
+// a certificate signed for the requested host, and the decrypted requests are
+// fed back into the Mux so they pass through the middleware chain.
+func (mx *Mux) handleConnect(w http.ResponseWriter, r *http.Request) {
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+	conn, brw, err := hj.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	logger := log.Logger("mux").With(zap.String("host", r.Host))
+	if _, err := conn.Write(connectEstablished); err != nil {
+		logger.Warn("failed to establish tunnel", zap.Error(err))
+		conn.Close()
+		return
+	}
+	bconn := &bufferedConn{Conn: conn, r: brw.Reader}
+
+	// Clients may tunnel plain HTTP (e.g. ws:// through a proxy), so only
+	// terminate TLS when the first byte looks like a handshake.
+	var tunnelConn net.Conn = bconn
+	first, err := bconn.r.Peek(1)
+	if err != nil {
+		if err != io.EOF {
+			logger.Warn("failed to read from tunnel", zap.Error(err))
+		}
+		conn.Close()
+		return
+	}
+	if first[0] == recordTypeHandshake {
+		if mx.certCA == nil {
+			logger.Warn("no certificate authority to intercept tunnel")
+			conn.Close()
+			return
+		}
+		tlsConfig, err := mx.certCA.HostTLSConfig(r.Host)
+		if err != nil {
+			logger.Error("failed to sign tunnel certificate", zap.Error(err))
+			conn.Close()
+			return
+		}
+		tlsConfig.NextProtos = []string{http2.NextProtoTLS, "http/1.1"}
+		tunnelConn = tls.Server(bconn, tlsConfig)
+	}
+
+	ln := newConnListener(tunnelConn)
+	srv := &http.Server{
+		Handler:   mx.tunnelHandler(r.Host),
+		ConnState: ln.connState,
+	}
+	if err := http2.ConfigureServer(srv, nil); err != nil {
+		logger.Error("failed to configure HTTP/2 for tunnel", zap.Error(err))
+	}
+	// Serve returns once the only connection is closed or hijacked.
+	srv.Serve(ln)
+}
+
+// tunnelHandler dispatches requests read from a CONNECT tunnel to the Mux,
+// using the tunnel target when the inner request carries no Host.
+func (mx *Mux) tunnelHandler(target string) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Host == "" {
+			r.Host = target
+		}
+		mx.ServeHTTP(w, r)
+	})
+}
+
+// bufferedConn is a net.Conn whose reads are served from a bufio.Reader, so
+// bytes buffered by the HTTP server before hijacking are not lost.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// connListener is a net.Listener that yields a single connection and then
+// blocks until the server reports that connection as closed.
+type connListener struct {
+	conn     net.Conn
+	once     sync.Once
+	doneOnce sync.Once
+	done     chan struct{}
+}
+
+func newConnListener(conn net.Conn) *connListener {
+	return &connListener{
+		conn: conn,
+		done: make(chan struct{}),
+	}
+}
+
+func (l *connListener) Accept() (net.Conn, error) {
+	var conn net.Conn
+	l.once.Do(func() {
+		conn = l.conn
+	})
+	if conn != nil {
+		return conn, nil
+	}
+	<-l.done
+	return nil, io.EOF
+}
+
+func (l *connListener) Close() error {
+	return nil
+}
+
+func (l *connListener) Addr() net.Addr {
+	return l.conn.LocalAddr()
+}
+
+// connState is used as http.Server.ConnState to unblock Accept once the
+// connection is finished with.
+func (l *connListener) connState(conn net.Conn, state http.ConnState) {
+	if state == http.StateClosed || state == http.StateHijacked {
+		l.doneOnce.Do(func() { close(l.done) })
+	}
+}
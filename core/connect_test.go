@@ -0,0 +1,124 @@
+package core
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/millken/httpctl/certer"
+	"github.com/millken/httpctl/config"
+	"github.com/stretchr/testify/require"
+)
+
+// newTestCA returns a CertCA loaded from a throwaway root, and a pool
+// trusting that root.
+func newTestCA(t *testing.T) (*certer.CertCA, *x509.CertPool) {
+	require := require.New(t)
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	require.NoError(err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "httpctl test CA"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, key.Public(), key)
+	require.NoError(err)
+	keyDER, err := x509.MarshalPKCS8PrivateKey(key)
+	require.NoError(err)
+
+	dir := t.TempDir()
+	require.NoError(os.WriteFile(filepath.Join(dir, certer.RootName),
+		pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	require.NoError(os.WriteFile(filepath.Join(dir, certer.RootKeyName),
+		pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: keyDER}), 0600))
+	defer func(root string) { certer.CaRoot = root }(certer.CaRoot)
+	certer.CaRoot = dir
+	ca := certer.NewCertCA()
+	require.NoError(ca.LoadCA())
+
+	pool := x509.NewCertPool()
+	pool.AddCert(ca.CaCert)
+	return ca, pool
+}
+
+// newTestProxy serves a Mux intercepting CONNECT tunnels and returns a
+// client using it as its proxy. h2 lets the client negotiate HTTP/2 in the
+// tunnel.
+func newTestProxy(t *testing.T, h2 bool) *http.Client {
+	ca, pool := newTestCA(t)
+	mx, err := NewMux(config.Server{Transport: config.Transport{InsecureSkipVerify: true}}, nil, ca)
+	require.NoError(t, err)
+	t.Cleanup(mx.Close)
+	proxy := httptest.NewServer(mx)
+	t.Cleanup(proxy.Close)
+	proxyURL, err := url.Parse(proxy.URL)
+	require.NoError(t, err)
+	tr := &http.Transport{
+		Proxy:             http.ProxyURL(proxyURL),
+		TLSClientConfig:   &tls.Config{RootCAs: pool},
+		ForceAttemptHTTP2: h2,
+	}
+	t.Cleanup(tr.CloseIdleConnections)
+	return &http.Client{Transport: tr}
+}
+
+func TestConnect(t *testing.T) {
+	require := require.New(t)
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Path", r.URL.Path)
+		io.WriteString(w, "secure hello")
+	}))
+	defer origin.Close()
+	client := newTestProxy(t, false)
+
+	res, err := client.Get(origin.URL + "/tunneled")
+	require.NoError(err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(err)
+	require.Equal(http.StatusOK, res.StatusCode)
+	require.Equal("HTTP/1.1", res.Proto)
+	require.Equal("/tunneled", res.Header.Get("X-Path"))
+	require.Equal("secure hello", string(body))
+	// The client trusted the certificate signed by httpctl, not the
+	// origin's.
+	require.Equal("127.0.0.1", res.TLS.PeerCertificates[0].IPAddresses[0].String())
+	require.Equal("httpctl test CA", res.TLS.PeerCertificates[0].Issuer.CommonName)
+}
+
+func TestConnect_HTTP2(t *testing.T) {
+	require := require.New(t)
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello over "+r.Proto)
+	}))
+	defer origin.Close()
+	client := newTestProxy(t, true)
+
+	res, err := client.Get(origin.URL + "/")
+	require.NoError(err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(err)
+	require.Equal(http.StatusOK, res.StatusCode)
+	require.Equal("h2", res.TLS.NegotiatedProtocol)
+	require.Equal("HTTP/2.0", res.Proto)
+	// The origin still speaks HTTP/1.1 to httpctl.
+	require.Equal("hello over HTTP/1.1", string(body))
+}
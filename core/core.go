@@ -5,3 +5,6 @@ import "net/http"
 // Middlewares type is a slice of standard middleware handlers with methods
 // to compose middleware chains and http.Handler's.
 type Middlewares []func(http.Handler) http.Handler
+
+// Version is the httpctl version, reported in exports such as HAR files.
+const Version = "2.0.0"
@@ -0,0 +1,156 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+)
+
+// ErrUnsupportedEncoding is returned for a Content-Encoding that cannot be
+// decoded.
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// ContentEncoding returns the Content-Encoding of h as a list of codings in
+// the order they were applied, without identity.
+func ContentEncoding(h http.Header) []string {
+	var codings []string
+	for _, v := range h.Values("Content-Encoding") {
+		for _, coding := range strings.Split(v, ",") {
+			coding = strings.ToLower(strings.TrimSpace(coding))
+			if coding != "" && coding != "identity" {
+				codings = append(codings, coding)
+			}
+		}
+	}
+	return codings
+}
+
+// CanDecode returns true if all codings are supported by NewDecoder.
+func CanDecode(codings ...string) bool {
+	for _, coding := range codings {
+		switch coding {
+		case "gzip", "x-gzip", "deflate", "br", "zstd":
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// NewDecoder returns a reader decoding r, which was encoded with codings
+// in the given order. The codings are undone in reverse order.
+func NewDecoder(r io.Reader, codings ...string) (io.ReadCloser, error) {
+	rc := io.NopCloser(r)
+	for i := len(codings) - 1; i >= 0; i-- {
+		dec, err := newDecoder(rc, codings[i])
+		if err != nil {
+			return nil, err
+		}
+		rc = dec
+	}
+	return rc, nil
+}
+
+func newDecoder(r io.Reader, coding string) (io.ReadCloser, error) {
+	switch coding {
+	case "gzip", "x-gzip":
+		return gzip.NewReader(r)
+	case "deflate":
+		// Some servers send raw deflate instead of the zlib format.
+		br := bufio.NewReader(r)
+		header, err := br.Peek(2)
+		if err != nil {
+			return nil, err
+		}
+		if header[0]&0x0f == 8 && (uint16(header[0])<<8|uint16(header[1]))%31 == 0 {
+			return zlib.NewReader(br)
+		}
+		return flate.NewReader(br), nil
+	case "br":
+		return io.NopCloser(brotli.NewReader(r)), nil
+	case "zstd":
+		dec, err := zstd.NewReader(r)
+		if err != nil {
+			return nil, err
+		}
+		return zstdReadCloser{dec}, nil
+	}
+	return nil, errors.Wrapf(ErrUnsupportedEncoding, "'%s'", coding)
+}
+
+type zstdReadCloser struct {
+	*zstd.Decoder
+}
+
+func (z zstdReadCloser) Close() error {
+	z.Decoder.Close()
+	return nil
+}
+
+// DecodeBody decodes body, which was encoded with codings, keeping at most
+// limit bytes; truncated is true if there were more. The body may be a
+// truncated prefix, in which case what could be decoded is returned along
+// with the error.
+func DecodeBody(body []byte, limit int, codings ...string) (decoded []byte, truncated bool, err error) {
+	dec, err := NewDecoder(bytes.NewReader(body), codings...)
+	if err != nil {
+		return nil, false, err
+	}
+	defer dec.Close()
+	buf := NewLimitedBuffer(limit)
+	_, err = io.Copy(buf, io.LimitReader(dec, int64(limit)+1))
+	return buf.Bytes(), buf.Truncated(), err
+}
+
+// decodeWriter decodes what is written to it into w. Decoding runs on its
+// own goroutine, fed through a pipe, since the decoders pull their input.
+type decodeWriter struct {
+	pw   *io.PipeWriter
+	done chan error
+}
+
+func newDecodeWriter(w io.Writer, codings ...string) *decodeWriter {
+	pr, pw := io.Pipe()
+	dw := &decodeWriter{pw: pw, done: make(chan error, 1)}
+	go func() {
+		err := decodeTo(w, pr, codings)
+		// Fail further writes instead of blocking them.
+		pr.CloseWithError(err)
+		dw.done <- err
+	}()
+	return dw
+}
+
+func decodeTo(w io.Writer, r io.Reader, codings []string) error {
+	dec, err := NewDecoder(r, codings...)
+	if err == io.EOF {
+		// An empty body, as in replies to HEAD.
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	defer dec.Close()
+	_, err = io.Copy(w, dec)
+	return err
+}
+
+func (dw *decodeWriter) Write(p []byte) (int, error) {
+	return dw.pw.Write(p)
+}
+
+// Close signals the end of the encoded stream and waits for the decoding
+// to finish, returning its error.
+func (dw *decodeWriter) Close() error {
+	dw.pw.Close()
+	return <-dw.done
+}
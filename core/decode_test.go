@@ -0,0 +1,123 @@
+package core
+
+import (
+	"bytes"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/andybalholm/brotli"
+	"github.com/klauspost/compress/zstd"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func encodeBody(t *testing.T, body []byte, coding string) []byte {
+	var buf bytes.Buffer
+	var w io.WriteCloser
+	switch coding {
+	case "gzip":
+		w = gzip.NewWriter(&buf)
+	case "deflate":
+		w = zlib.NewWriter(&buf)
+	case "raw-deflate":
+		w, _ = flate.NewWriter(&buf, flate.DefaultCompression)
+	case "br":
+		w = brotli.NewWriter(&buf)
+	case "zstd":
+		var err error
+		w, err = zstd.NewWriter(&buf)
+		require.NoError(t, err)
+	}
+	_, err := w.Write(body)
+	require.NoError(t, err)
+	require.NoError(t, w.Close())
+	return buf.Bytes()
+}
+
+func TestContentEncoding(t *testing.T) {
+	require := require.New(t)
+	h := http.Header{"Content-Encoding": {"gzip, Identity", "BR"}}
+	require.Equal([]string{"gzip", "br"}, ContentEncoding(h))
+	require.Empty(ContentEncoding(http.Header{}))
+	require.True(CanDecode("gzip", "br"))
+	require.False(CanDecode("gzip", "compress"))
+}
+
+func TestNewDecoder(t *testing.T) {
+	require := require.New(t)
+	body := []byte(strings.Repeat("<html>hello</html>", 100))
+	for _, coding := range []string{"gzip", "deflate", "raw-deflate", "br", "zstd"} {
+		encoded := encodeBody(t, body, coding)
+		if coding == "raw-deflate" {
+			coding = "deflate"
+		}
+		dec, err := NewDecoder(bytes.NewReader(encoded), coding)
+		require.NoError(err, coding)
+		decoded, err := io.ReadAll(dec)
+		require.NoError(err, coding)
+		require.NoError(dec.Close())
+		require.Equal(body, decoded, coding)
+	}
+
+	// Codings are undone in reverse order.
+	encoded := encodeBody(t, encodeBody(t, body, "gzip"), "br")
+	dec, err := NewDecoder(bytes.NewReader(encoded), "gzip", "br")
+	require.NoError(err)
+	decoded, err := io.ReadAll(dec)
+	require.NoError(err)
+	require.Equal(body, decoded)
+
+	_, err = NewDecoder(bytes.NewReader(encoded), "compress")
+	require.Equal(ErrUnsupportedEncoding, errors.Cause(err))
+}
+
+func TestDecodeBody(t *testing.T) {
+	require := require.New(t)
+	body := []byte(strings.Repeat("0123456789", 1000))
+	encoded := encodeBody(t, body, "gzip")
+
+	decoded, truncated, err := DecodeBody(encoded, len(body), "gzip")
+	require.NoError(err)
+	require.False(truncated)
+	require.Equal(body, decoded)
+
+	decoded, truncated, err = DecodeBody(encoded, 10, "gzip")
+	require.NoError(err)
+	require.True(truncated)
+	require.Equal(body[:10], decoded)
+
+	// A truncated prefix decodes as far as it goes.
+	decoded, _, err = DecodeBody(encoded[:len(encoded)/2], len(body), "gzip")
+	require.Error(err)
+	require.True(bytes.HasPrefix(body, decoded))
+}
+
+func TestDecodeWriter(t *testing.T) {
+	require := require.New(t)
+	body := []byte(strings.Repeat("streamed ", 1000))
+	encoded := encodeBody(t, body, "zstd")
+
+	var out bytes.Buffer
+	dw := newDecodeWriter(&out, "zstd")
+	for p := encoded; len(p) > 0; p = p[1:] {
+		_, err := dw.Write(p[:1])
+		require.NoError(err)
+	}
+	require.NoError(dw.Close())
+	require.Equal(body, out.Bytes())
+
+	// An empty body is not an error.
+	require.NoError(newDecodeWriter(&out, "gzip").Close())
+
+	dw = newDecodeWriter(io.Discard, "gzip")
+	_, err := dw.Write([]byte("not gzip at all"))
+	if err == nil {
+		err = dw.Close()
+	}
+	require.Error(err)
+}
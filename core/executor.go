@@ -0,0 +1,121 @@
+package core
+
+import (
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/millken/httpctl/log"
+	"go.uber.org/zap"
+)
+
+// Executor hands out the writers that receive a copy of each proxied
+// response body. It is implemented by executor.Execute; the interface lives
+// here because the executor package depends on core.
+type Executor interface {
+	Writer(*RequestHeader, *ResponseHeader) []io.Writer
+}
+
+// SetExecutor makes the Mux copy every proxied response body to the writers
+// returned by e.
+func (mx *Mux) SetExecutor(e Executor) {
+	mx.executor = e
+}
+
+// executorBody tees the response body into the executor writers while it is
+// streamed to the client. Closing it closes the writers that are io.Closers,
+// such as the files written by the sitecopy executor.
+type executorBody struct {
+	io.ReadCloser
+	w io.Writer
+	// decoder undoes the Content-Encoding before the executor writers, if
+	// the body is encoded.
+	decoder *executorWriter
+	writers []*executorWriter
+}
+
+// executeBody wraps response.Body so the executor writers get a copy of it
+// as it is read. Encoded bodies are decoded for the executors, which see
+// the response header without Content-Encoding and Content-Length; the
+// client still gets the original bytes.
+func (mx *Mux) executeBody(r *http.Request, response *http.Response) {
+	if mx.executor == nil {
+		return
+	}
+	logger := log.Logger("executor").With(zap.String("host", r.Host), zap.String("uri", r.URL.RequestURI()))
+	resHeader := NewResponseHeader(response)
+	codings := ContentEncoding(response.Header)
+	if !CanDecode(codings...) {
+		logger.Debug("body not decoded for executors", zap.Strings("encoding", codings))
+		codings = nil
+	}
+	if len(codings) > 0 {
+		resHeader.Del("Content-Encoding")
+		resHeader.Del("Content-Length")
+	}
+	writers := mx.executor.Writer(NewRequestHeader(r), resHeader)
+	if len(writers) == 0 {
+		return
+	}
+	body := &executorBody{ReadCloser: response.Body}
+	ws := make([]io.Writer, 0, len(writers))
+	for _, w := range writers {
+		ew := &executorWriter{w: w, log: logger}
+		body.writers = append(body.writers, ew)
+		ws = append(ws, ew)
+	}
+	body.w = io.MultiWriter(ws...)
+	if len(codings) > 0 {
+		body.decoder = &executorWriter{w: newDecodeWriter(body.w, codings...), log: logger}
+		body.w = body.decoder
+	}
+	response.Body = body
+}
+
+func (b *executorBody) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	if n > 0 {
+		b.w.Write(p[:n])
+	}
+	return n, err
+}
+
+func (b *executorBody) Close() error {
+	err := b.ReadCloser.Close()
+	if b.decoder != nil {
+		b.decoder.close()
+	}
+	for _, w := range b.writers {
+		w.close()
+	}
+	return err
+}
+
+// executorWriter isolates one executor writer: its first error is logged and
+// later writes are dropped, without failing the other writers or the client.
+type executorWriter struct {
+	w   io.Writer
+	log *zap.Logger
+	err error
+}
+
+func (w *executorWriter) Write(p []byte) (int, error) {
+	if w.err == nil {
+		if _, w.err = w.w.Write(p); w.err != nil {
+			w.log.Warn("executor writer failed", zap.Error(w.err))
+		}
+	}
+	return len(p), nil
+}
+
+func (w *executorWriter) close() {
+	// The example executor writes to the process' standard streams.
+	if w.w == os.Stdout || w.w == os.Stderr {
+		return
+	}
+	if c, ok := w.w.(io.Closer); ok {
+		if err := c.Close(); err != nil {
+			w.log.Warn("failed to close executor writer", zap.Error(err))
+		}
+	}
+}
@@ -0,0 +1,112 @@
+package core
+
+import (
+	"bytes"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/millken/httpctl/config"
+	"github.com/stretchr/testify/require"
+)
+
+type testExecutor struct {
+	req     *RequestHeader
+	res     *ResponseHeader
+	writers []io.Writer
+}
+
+func (e *testExecutor) Writer(req *RequestHeader, res *ResponseHeader) []io.Writer {
+	e.req, e.res = req, res
+	return e.writers
+}
+
+type failingWriter struct{}
+
+func (failingWriter) Write(p []byte) (int, error) {
+	return 0, errors.New("disk full")
+}
+
+type closingBuffer struct {
+	bytes.Buffer
+	closed bool
+}
+
+func (b *closingBuffer) Close() error {
+	b.closed = true
+	return nil
+}
+
+func TestMux_Executor(t *testing.T) {
+	require := require.New(t)
+	origin := newTestOrigin(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Server", "origin")
+		io.WriteString(w, "<html></html>")
+	})
+	defer origin.Close()
+
+	good := &closingBuffer{}
+	exec := &testExecutor{writers: []io.Writer{failingWriter{}, good}}
+	mx := newTestMux(t, config.Server{})
+	defer mx.Close()
+	mx.SetExecutor(exec)
+
+	rec := serveMux(mx, http.MethodGet, origin.URL+"/index.html?a=1", nil)
+	require.Equal(http.StatusOK, rec.Code)
+	require.Equal("<html></html>", rec.Body.String())
+	require.Equal("<html></html>", good.String())
+	require.True(good.closed)
+
+	require.True(exec.req.IsGet())
+	require.Equal("/index.html?a=1", string(exec.req.RequestURI()))
+	require.Equal(origin.Listener.Addr().String(), string(exec.req.Host()))
+	require.False(exec.req.GetHTTPS())
+	require.Equal(http.StatusOK, exec.res.StatusCode())
+	require.Equal("text/html", string(exec.res.ContentType()))
+	require.Equal("origin", string(exec.res.Server()))
+}
+
+func TestMux_ExecutorDecodesBody(t *testing.T) {
+	require := require.New(t)
+	body := []byte("<html>compressed</html>")
+	encoded := encodeBody(t, body, "gzip")
+	origin := newTestOrigin(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/html")
+		w.Header().Set("Content-Encoding", "gzip")
+		w.Write(encoded)
+	})
+	defer origin.Close()
+
+	good := &closingBuffer{}
+	exec := &testExecutor{writers: []io.Writer{good}}
+	mx := newTestMux(t, config.Server{})
+	defer mx.Close()
+	mx.SetExecutor(exec)
+
+	r := httptest.NewRequest(http.MethodGet, origin.URL+"/", nil)
+	r.Header.Set("Accept-Encoding", "gzip")
+	rec := httptest.NewRecorder()
+	mx.ServeHTTP(rec, r)
+	require.Equal(http.StatusOK, rec.Code)
+	require.Equal("gzip", rec.Header().Get("Content-Encoding"))
+	require.Equal(encoded, rec.Body.Bytes())
+	require.Equal(body, good.Bytes())
+	require.True(good.closed)
+	require.Empty(exec.res.Peek("Content-Encoding"))
+	require.Equal(-1, exec.res.ContentLength())
+}
+
+func TestMux_ExecutorWithoutWriters(t *testing.T) {
+	require := require.New(t)
+	mx := newTestMux(t, config.Server{})
+	defer mx.Close()
+	mx.SetExecutor(&testExecutor{})
+
+	body := io.NopCloser(bytes.NewReader(encodeBody(t, []byte("hello"), "gzip")))
+	response := &http.Response{StatusCode: http.StatusOK, Header: http.Header{"Content-Encoding": {"gzip"}}, Body: body}
+	mx.executeBody(httptest.NewRequest(http.MethodGet, "http://example.com/", nil), response)
+	require.Equal(body, response.Body)
+}
@@ -0,0 +1,275 @@
+package core
+
+import (
+	"bytes"
+	"encoding/base64"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/pkg/errors"
+)
+
+// Export formats of ExportRequest.
+const (
+	ExportCurl   = "curl"
+	ExportHTTPie = "httpie"
+	ExportGo     = "go"
+	ExportPython = "python"
+)
+
+// ExportFormats lists the formats of ExportRequest.
+var ExportFormats = []string{ExportCurl, ExportHTTPie, ExportGo, ExportPython}
+
+// ErrUnsupportedFormat is returned by ExportRequest for an unknown format.
+var ErrUnsupportedFormat = errors.New("unsupported export format")
+
+// ExportRequest renders r as a command or a program sending it again, in
+// one of ExportFormats: a curl or HTTPie command line, a Go program using
+// net/http, or a Python script using requests. Hop-by-hop headers and
+// Content-Length are left out; the body is sent as recorded, so it must
+// not be truncated.
+func ExportRequest(format string, r *FlowRequest) (string, error) {
+	if r.BodyTruncated {
+		return "", errors.New("the request body is truncated")
+	}
+	header := r.Header.Clone()
+	if header == nil {
+		header = make(http.Header)
+	}
+	RemoveHopHeaders(header)
+	header.Del("Content-Length")
+	switch format {
+	case ExportCurl:
+		return exportCurl(r, header), nil
+	case ExportHTTPie:
+		return exportHTTPie(r, header), nil
+	case ExportGo:
+		return exportGo(r, header), nil
+	case ExportPython:
+		return exportPython(r, header), nil
+	}
+	return "", errors.Wrapf(ErrUnsupportedFormat, "format '%s'", format)
+}
+
+// eachHeader calls fn with the header values, sorted by name.
+func eachHeader(h http.Header, fn func(name, value string)) {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		for _, value := range h[name] {
+			fn(name, value)
+		}
+	}
+}
+
+func exportCurl(r *FlowRequest, header http.Header) string {
+	args := []string{"curl"}
+	piped := bytes.IndexByte(r.Body, 0) >= 0
+	if piped {
+		args[0] = pipeBody(r.Body) + "curl"
+	}
+	switch {
+	case r.Method == http.MethodHead:
+		args = append(args, "--head")
+	case r.Method != http.MethodGet || len(r.Body) > 0:
+		args = append(args, "-X "+shellQuote(r.Method))
+	}
+	switch r.Proto {
+	case "HTTP/1.0":
+		args = append(args, "--http1.0")
+	case "HTTP/2.0":
+		args = append(args, "--http2")
+	case "HTTP/3.0":
+		args = append(args, "--http3")
+	}
+	args = append(args, shellQuote(r.URL))
+	eachHeader(header, func(name, value string) {
+		args = append(args, "-H "+shellQuote(name+": "+value))
+	})
+	switch {
+	case piped:
+		args = append(args, "--data-binary @-")
+	case len(r.Body) > 0:
+		// Unlike --data-binary, --data-raw does not read a file for a body
+		// starting with @.
+		args = append(args, "--data-raw "+shellQuote(string(r.Body)))
+	}
+	if header.Get("Accept-Encoding") != "" {
+		// curl leaves the body encoded unless it is told to decode it.
+		args = append(args, "--compressed")
+	}
+	return strings.Join(args, " \\\n  ") + "\n"
+}
+
+func exportHTTPie(r *FlowRequest, header http.Header) string {
+	args := []string{"http " + shellQuote(r.Method), shellQuote(r.URL)}
+	piped := bytes.IndexByte(r.Body, 0) >= 0
+	if piped {
+		// HTTPie sends what it reads from stdin as the body.
+		args[0] = pipeBody(r.Body) + args[0]
+	}
+	eachHeader(header, func(name, value string) {
+		// HTTPie reads the value of Name:@file from the file.
+		if strings.HasPrefix(value, "@") {
+			value = `\` + value
+		}
+		args = append(args, shellQuote(name+":"+value))
+	})
+	// --raw is sent as is, it has no @file syntax.
+	if len(r.Body) > 0 && !piped {
+		args = append(args, "--raw "+shellQuote(string(r.Body)))
+	}
+	return strings.Join(args, " \\\n  ") + "\n"
+}
+
+func exportGo(r *FlowRequest, header http.Header) string {
+	var b strings.Builder
+	b.WriteString("package main\n\nimport (\n\t\"fmt\"\n\t\"io\"\n\t\"net/http\"\n")
+	if len(r.Body) > 0 {
+		b.WriteString("\t\"strings\"\n")
+	}
+	b.WriteString(")\n\nfunc main() {\n")
+	body := "nil"
+	if len(r.Body) > 0 {
+		fmt.Fprintf(&b, "\tbody := strings.NewReader(%s)\n", strconv.Quote(string(r.Body)))
+		body = "body"
+	}
+	fmt.Fprintf(&b, "\treq, err := http.NewRequest(%s, %s, %s)\n", strconv.Quote(r.Method), strconv.Quote(r.URL), body)
+	b.WriteString("\tif err != nil {\n\t\tpanic(err)\n\t}\n")
+	eachHeader(header, func(name, value string) {
+		if name == "Host" {
+			fmt.Fprintf(&b, "\treq.Host = %s\n", strconv.Quote(value))
+			return
+		}
+		fmt.Fprintf(&b, "\treq.Header.Add(%s, %s)\n", strconv.Quote(name), strconv.Quote(value))
+	})
+	b.WriteString("\tres, err := http.DefaultClient.Do(req)\n")
+	b.WriteString("\tif err != nil {\n\t\tpanic(err)\n\t}\n")
+	b.WriteString("\tdefer res.Body.Close()\n")
+	b.WriteString("\tb, err := io.ReadAll(res.Body)\n")
+	b.WriteString("\tif err != nil {\n\t\tpanic(err)\n\t}\n")
+	b.WriteString("\tfmt.Println(res.Status)\n")
+	b.WriteString("\tfmt.Println(string(b))\n")
+	b.WriteString("}\n")
+	return b.String()
+}
+
+func exportPython(r *FlowRequest, header http.Header) string {
+	var b strings.Builder
+	b.WriteString("import requests\n\n")
+	// A dict holds one value per name: repeated headers are joined.
+	b.WriteString("headers = {\n")
+	names := make([]string, 0, len(header))
+	for name := range header {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		sep := ", "
+		if name == "Cookie" {
+			sep = "; "
+		}
+		fmt.Fprintf(&b, "    %s: %s,\n", pythonQuote(name, false), pythonQuote(strings.Join(header[name], sep), false))
+	}
+	b.WriteString("}\n")
+	data := ""
+	if len(r.Body) > 0 {
+		fmt.Fprintf(&b, "data = %s\n", pythonQuote(string(r.Body), true))
+		data = ", data=data"
+	}
+	fmt.Fprintf(&b, "\nresponse = requests.request(%s, %s, headers=headers%s)\n", pythonQuote(r.Method, false), pythonQuote(r.URL, false), data)
+	b.WriteString("print(response.status_code)\n")
+	b.WriteString("print(response.text)\n")
+	return b.String()
+}
+
+// pipeBody returns a pipeline feeding body to the standard input of the
+// command that follows it. Bodies with NUL bytes are sent this way, since
+// shells cut arguments at NUL, even in $'...'.
+func pipeBody(body []byte) string {
+	return "printf '%s' " + shellQuote(base64.StdEncoding.EncodeToString(body)) + " | base64 -d | "
+}
+
+// shellQuote quotes s for POSIX shells, using ANSI-C quoting ($'...')
+// when s has control characters or is not valid UTF-8. s must not contain
+// NUL.
+func shellQuote(s string) string {
+	plain := utf8.ValidString(s)
+	for _, c := range s {
+		if (c < ' ' && c != '\n' && c != '\t') || c == 0x7f {
+			plain = false
+			break
+		}
+	}
+	if plain {
+		return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+	}
+	var b bytes.Buffer
+	b.WriteString("$'")
+	for i := 0; i < len(s); i++ {
+		switch c := s[i]; {
+		case c == '\'' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < ' ' || c >= 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		default:
+			b.WriteByte(c)
+		}
+	}
+	b.WriteByte('\'')
+	return b.String()
+}
+
+// pythonQuote returns s as a Python string literal, or as a bytes literal
+// holding its bytes if asBytes is set.
+func pythonQuote(s string, asBytes bool) string {
+	var b bytes.Buffer
+	if asBytes {
+		b.WriteByte('b')
+	}
+	b.WriteByte('"')
+	for i := 0; i < len(s); {
+		c := s[i]
+		switch {
+		case c == '"' || c == '\\':
+			b.WriteByte('\\')
+			b.WriteByte(c)
+		case c == '\n':
+			b.WriteString(`\n`)
+		case c == '\r':
+			b.WriteString(`\r`)
+		case c == '\t':
+			b.WriteString(`\t`)
+		case c < ' ' || c == 0x7f:
+			fmt.Fprintf(&b, `\x%02x`, c)
+		case c >= utf8.RuneSelf:
+			r, size := utf8.DecodeRuneInString(s[i:])
+			if asBytes || r == utf8.RuneError {
+				fmt.Fprintf(&b, `\x%02x`, c)
+				break
+			}
+			b.WriteString(s[i : i+size])
+			i += size
+			continue
+		default:
+			b.WriteByte(c)
+		}
+		i++
+	}
+	b.WriteByte('"')
+	return b.String()
+}
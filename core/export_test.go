@@ -0,0 +1,186 @@
+package core
+
+import (
+	"go/format"
+	"net/http"
+	"testing"
+
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func exportFlowRequest() *FlowRequest {
+	return &FlowRequest{
+		Method: "POST",
+		URL:    "https://example.com/api?q=it's",
+		Proto:  "HTTP/2.0",
+		Header: http.Header{
+			"Content-Type":   {"application/json"},
+			"Content-Length": {"13"},
+			"Connection":     {"keep-alive"},
+			"Cookie":         {"a=1", "b=2"},
+		},
+		Body:     []byte(`{"name":"é"}`),
+		BodySize: 13,
+	}
+}
+
+func TestExportRequest_Curl(t *testing.T) {
+	require := require.New(t)
+	s, err := ExportRequest(ExportCurl, exportFlowRequest())
+	require.NoError(err)
+	require.Equal(`curl \
+  -X 'POST' \
+  --http2 \
+  'https://example.com/api?q=it'\''s' \
+  -H 'Content-Type: application/json' \
+  -H 'Cookie: a=1' \
+  -H 'Cookie: b=2' \
+  --data-raw '{"name":"é"}'
+`, s)
+
+	s, err = ExportRequest(ExportCurl, &FlowRequest{
+		Method: "GET",
+		URL:    "http://example.com/",
+		Proto:  "HTTP/1.1",
+		Header: http.Header{"Accept-Encoding": {"gzip"}},
+	})
+	require.NoError(err)
+	require.Equal(`curl \
+  'http://example.com/' \
+  -H 'Accept-Encoding: gzip' \
+  --compressed
+`, s)
+
+	s, err = ExportRequest(ExportCurl, &FlowRequest{Method: "HEAD", URL: "http://example.com/"})
+	require.NoError(err)
+	require.Equal("curl \\\n  --head \\\n  'http://example.com/'\n", s)
+}
+
+func TestExportRequest_HTTPie(t *testing.T) {
+	require := require.New(t)
+	s, err := ExportRequest(ExportHTTPie, exportFlowRequest())
+	require.NoError(err)
+	require.Equal(`http 'POST' \
+  'https://example.com/api?q=it'\''s' \
+  'Content-Type:application/json' \
+  'Cookie:a=1' \
+  'Cookie:b=2' \
+  --raw '{"name":"é"}'
+`, s)
+}
+
+func TestExportRequest_Go(t *testing.T) {
+	require := require.New(t)
+	r := exportFlowRequest()
+	r.Header.Set("Host", "api.example.com")
+	s, err := ExportRequest(ExportGo, r)
+	require.NoError(err)
+	formatted, err := format.Source([]byte(s))
+	require.NoError(err)
+	require.Equal(string(formatted), s)
+	require.Contains(s, "\t\"strings\"\n")
+	require.Contains(s, "body := strings.NewReader(\"{\\\"name\\\":\\\"é\\\"}\")\n")
+	require.Contains(s, "http.NewRequest(\"POST\", \"https://example.com/api?q=it's\", body)\n")
+	require.Contains(s, "req.Host = \"api.example.com\"\n")
+	require.Contains(s, "req.Header.Add(\"Cookie\", \"b=2\")\n")
+	require.NotContains(s, "Content-Length")
+	require.NotContains(s, "Connection")
+
+	s, err = ExportRequest(ExportGo, &FlowRequest{Method: "GET", URL: "http://example.com/"})
+	require.NoError(err)
+	formatted, err = format.Source([]byte(s))
+	require.NoError(err)
+	require.Equal(string(formatted), s)
+	require.NotContains(s, "strings")
+	require.Contains(s, "http.NewRequest(\"GET\", \"http://example.com/\", nil)\n")
+}
+
+func TestExportRequest_Python(t *testing.T) {
+	require := require.New(t)
+	s, err := ExportRequest(ExportPython, exportFlowRequest())
+	require.NoError(err)
+	require.Equal(`import requests
+
+headers = {
+    "Content-Type": "application/json",
+    "Cookie": "a=1; b=2",
+}
+data = b"{\"name\":\"\xc3\xa9\"}"
+
+response = requests.request("POST", "https://example.com/api?q=it's", headers=headers, data=data)
+print(response.status_code)
+print(response.text)
+`, s)
+}
+
+func TestExportRequest_Binary(t *testing.T) {
+	require := require.New(t)
+	r := &FlowRequest{
+		Method: "PUT",
+		URL:    "http://example.com/upload",
+		Body:   []byte("\x00\x01'\\\r\n\xff"),
+	}
+	// Shells cut arguments at NUL, so the body is piped in.
+	s, err := ExportRequest(ExportCurl, r)
+	require.NoError(err)
+	require.Equal(`printf '%s' 'AAEnXA0K/w==' | base64 -d | curl \
+  -X 'PUT' \
+  'http://example.com/upload' \
+  --data-binary @-
+`, s)
+
+	s, err = ExportRequest(ExportHTTPie, r)
+	require.NoError(err)
+	require.Equal(`printf '%s' 'AAEnXA0K/w==' | base64 -d | http 'PUT' \
+  'http://example.com/upload'
+`, s)
+
+	s, err = ExportRequest(ExportPython, r)
+	require.NoError(err)
+	require.Contains(s, `data = b"\x00\x01'\\\r\n\xff"`)
+
+	s, err = ExportRequest(ExportGo, r)
+	require.NoError(err)
+	require.Contains(s, `strings.NewReader("\x00\x01'\\\r\n\xff")`)
+
+	r.Body = r.Body[1:]
+	s, err = ExportRequest(ExportCurl, r)
+	require.NoError(err)
+	require.Contains(s, `--data-raw $'\x01\'\\\r\n\xff'`)
+	s, err = ExportRequest(ExportHTTPie, r)
+	require.NoError(err)
+	require.Contains(s, `--raw $'\x01\'\\\r\n\xff'`)
+}
+
+func TestExportRequest_AtFile(t *testing.T) {
+	require := require.New(t)
+	r := &FlowRequest{
+		Method: "POST",
+		URL:    "http://example.com/",
+		Header: http.Header{"X-Data": {"@/etc/hosts"}},
+		Body:   []byte("@/etc/passwd"),
+	}
+	// Values starting with @ must not make the command read a local file.
+	s, err := ExportRequest(ExportCurl, r)
+	require.NoError(err)
+	require.Contains(s, "--data-raw '@/etc/passwd'")
+	require.NotContains(s, "--data-binary")
+
+	s, err = ExportRequest(ExportHTTPie, r)
+	require.NoError(err)
+	require.Contains(s, `'X-Data:\@/etc/hosts'`)
+	require.Contains(s, "--raw '@/etc/passwd'")
+}
+
+func TestExportRequest_Errors(t *testing.T) {
+	require := require.New(t)
+	r := exportFlowRequest()
+	_, err := ExportRequest("wget", r)
+	require.Equal(ErrUnsupportedFormat, errors.Cause(err))
+	require.EqualError(err, "format 'wget': unsupported export format")
+
+	r.BodyTruncated = true
+	_, err = ExportRequest(ExportCurl, r)
+	require.EqualError(err, "the request body is truncated")
+}
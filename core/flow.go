@@ -0,0 +1,313 @@
+package core
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/tls"
+	"encoding/hex"
+	"io"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// FlowBodyLimit is the number of request and response body bytes kept in a
+// Flow. Longer bodies are recorded truncated.
+var FlowBodyLimit = 1 << 20
+
+// Flow is one proxied exchange, recorded for the handlers registered with
+// Mux.HandleFlow.
+type Flow struct {
+	ID        string    `json:"id"`
+	StartedAt time.Time `json:"startedAt"`
+	// ClientAddr is the address of the client connection.
+	ClientAddr string `json:"clientAddr"`
+	// ServerAddr is the address of the upstream connection, which is the
+	// upstream proxy when one is used.
+	ServerAddr string        `json:"serverAddr,omitempty"`
+	ConnReused bool          `json:"connReused"`
+	Request    FlowRequest   `json:"request"`
+	Response   *FlowResponse `json:"response,omitempty"`
+	// TLS describes the upstream TLS connection.
+	TLS     *FlowTLS    `json:"tls,omitempty"`
+	Timings FlowTimings `json:"timings"`
+	Error   string      `json:"error,omitempty"`
+}
+
+// FlowRequest is the request of a Flow as sent by the client.
+type FlowRequest struct {
+	Method        string      `json:"method"`
+	URL           string      `json:"url"`
+	Proto         string      `json:"proto"`
+	Header        http.Header `json:"header"`
+	Body          []byte      `json:"body,omitempty"`
+	BodySize      int64       `json:"bodySize"`
+	BodyTruncated bool        `json:"bodyTruncated,omitempty"`
+}
+
+// FlowResponse is the response of a Flow as received from the origin.
+type FlowResponse struct {
+	StatusCode    int         `json:"statusCode"`
+	Proto         string      `json:"proto"`
+	Header        http.Header `json:"header"`
+	Trailer       http.Header `json:"trailer,omitempty"`
+	Body          []byte      `json:"body,omitempty"`
+	BodySize      int64       `json:"bodySize"`
+	BodyTruncated bool        `json:"bodyTruncated,omitempty"`
+}
+
+// FlowTLS describes a TLS connection.
+type FlowTLS struct {
+	Version            string            `json:"version"`
+	CipherSuite        string            `json:"cipherSuite"`
+	ServerName         string            `json:"serverName"`
+	NegotiatedProtocol string            `json:"negotiatedProtocol,omitempty"`
+	PeerCertificates   []FlowCertificate `json:"peerCertificates,omitempty"`
+}
+
+// FlowCertificate summarizes a certificate of the TLS peer.
+type FlowCertificate struct {
+	Subject   string    `json:"subject"`
+	Issuer    string    `json:"issuer"`
+	DNSNames  []string  `json:"dnsNames,omitempty"`
+	NotBefore time.Time `json:"notBefore"`
+	NotAfter  time.Time `json:"notAfter"`
+}
+
+// FlowTimings splits the duration of a Flow into its phases. Phases that
+// did not happen, such as DNS and Connect on a reused connection, are zero.
+type FlowTimings struct {
+	DNS     time.Duration `json:"dns"`
+	Connect time.Duration `json:"connect"`
+	TLS     time.Duration `json:"tls"`
+	// Send is the time spent writing the request, including its body.
+	Send time.Duration `json:"send"`
+	// Wait is the time until the first response byte.
+	Wait    time.Duration `json:"wait"`
+	Receive time.Duration `json:"receive"`
+	Total   time.Duration `json:"total"`
+}
+
+// FlowHandler is called with every completed Flow.
+type FlowHandler func(f *Flow)
+
+// HandleFlow registers h to receive the completed flows. Flows are only
+// recorded when at least one handler is registered.
+func (mx *Mux) HandleFlow(h FlowHandler) {
+	mx.flowHandlers = append(mx.flowHandlers, h)
+}
+
+type flowContextKey struct{}
+
+// FlowFromContext returns the Flow being recorded for a request, or nil.
+func FlowFromContext(ctx context.Context) *Flow {
+	if fr := flowRecorderFromContext(ctx); fr != nil {
+		return fr.flow
+	}
+	return nil
+}
+
+func flowRecorderFromContext(ctx context.Context) *flowRecorder {
+	fr, _ := ctx.Value(flowContextKey{}).(*flowRecorder)
+	return fr
+}
+
+// NewRequest returns a request that replays the recorded request. It fails
+// if the recorded body was truncated.
+func (f *Flow) NewRequest(ctx context.Context) (*http.Request, error) {
+	if f.Request.BodyTruncated {
+		return nil, errors.Errorf("flow '%s' has a truncated request body", f.ID)
+	}
+	r, err := http.NewRequestWithContext(ctx, f.Request.Method, f.Request.URL, bytes.NewReader(f.Request.Body))
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to build request of flow '%s'", f.ID)
+	}
+	for name, values := range f.Request.Header {
+		r.Header[name] = append([]string(nil), values...)
+	}
+	RemoveHopHeaders(r.Header)
+	return r, nil
+}
+
+// flowRecorder collects a Flow while its request is proxied.
+type flowRecorder struct {
+	flow      *Flow
+	reqBody   *TeeReadCloser
+	resBody   *TeeReadCloser
+	resHeader http.Header
+
+	mu           sync.Mutex
+	dnsStart     time.Time
+	dnsDone      time.Time
+	connectStart time.Time
+	connectDone  time.Time
+	tlsStart     time.Time
+	tlsDone      time.Time
+	gotConn      time.Time
+	wroteRequest time.Time
+	firstByte    time.Time
+}
+
+// startFlow begins recording r, returning r with the Flow in its context
+// and its body captured. r is returned as is if no flow handler is
+// registered.
+func (mx *Mux) startFlow(r *http.Request) *http.Request {
+	if len(mx.flowHandlers) == 0 || isWebSocketUpgrade(r) {
+		return r
+	}
+	fr := &flowRecorder{flow: &Flow{
+		ID:         newFlowID(),
+		StartedAt:  time.Now(),
+		ClientAddr: r.RemoteAddr,
+		Request: FlowRequest{
+			Method: r.Method,
+			URL:    requestURL(r),
+			Proto:  r.Proto,
+			Header: r.Header.Clone(),
+		},
+	}}
+	ctx := context.WithValue(r.Context(), flowContextKey{}, fr)
+	r = r.WithContext(httptrace.WithClientTrace(ctx, fr.trace()))
+	if r.Body != nil && r.Body != http.NoBody {
+		fr.reqBody = NewTeeReadCloser(r.Body, FlowBodyLimit)
+		r.Body = fr.reqBody
+	}
+	return r
+}
+
+// recordResponse captures the response headers as received from the
+// origin and the body as it is streamed.
+func (fr *flowRecorder) recordResponse(response *http.Response) {
+	fr.resHeader = response.Header.Clone()
+	fr.resBody = NewTeeReadCloser(response.Body, FlowBodyLimit)
+	response.Body = fr.resBody
+}
+
+// finishFlow completes the Flow and hands it to the flow handlers.
+func (mx *Mux) finishFlow(fr *flowRecorder, response *http.Response, err error) {
+	end := time.Now()
+	f := fr.flow
+	if fr.reqBody != nil {
+		f.Request.Body = append([]byte(nil), fr.reqBody.Bytes()...)
+		f.Request.BodySize = fr.reqBody.Size()
+		f.Request.BodyTruncated = fr.reqBody.Truncated()
+	}
+	if response != nil {
+		f.Response = &FlowResponse{
+			StatusCode: response.StatusCode,
+			Proto:      response.Proto,
+			Header:     fr.resHeader,
+			Trailer:    response.Trailer.Clone(),
+		}
+		if fr.resBody != nil {
+			f.Response.Body = append([]byte(nil), fr.resBody.Bytes()...)
+			f.Response.BodySize = fr.resBody.Size()
+			f.Response.BodyTruncated = fr.resBody.Truncated()
+		}
+		if response.TLS != nil {
+			f.TLS = newFlowTLS(response.TLS)
+		}
+	}
+	if err != nil {
+		f.Error = err.Error()
+	}
+
+	fr.mu.Lock()
+	t := &f.Timings
+	t.DNS = between(fr.dnsStart, fr.dnsDone)
+	t.Connect = between(fr.connectStart, fr.connectDone)
+	t.TLS = between(fr.tlsStart, fr.tlsDone)
+	t.Send = between(fr.gotConn, fr.wroteRequest)
+	t.Wait = between(fr.wroteRequest, fr.firstByte)
+	t.Receive = between(fr.firstByte, end)
+	fr.mu.Unlock()
+	t.Total = end.Sub(f.StartedAt)
+
+	for _, h := range mx.flowHandlers {
+		h(f)
+	}
+}
+
+// trace records the phase timestamps. The callbacks may run on transport
+// goroutines, hence the lock.
+func (fr *flowRecorder) trace() *httptrace.ClientTrace {
+	stamp := func(t *time.Time, once bool) {
+		fr.mu.Lock()
+		if !once || t.IsZero() {
+			*t = time.Now()
+		}
+		fr.mu.Unlock()
+	}
+	return &httptrace.ClientTrace{
+		DNSStart:          func(httptrace.DNSStartInfo) { stamp(&fr.dnsStart, true) },
+		DNSDone:           func(httptrace.DNSDoneInfo) { stamp(&fr.dnsDone, false) },
+		ConnectStart:      func(string, string) { stamp(&fr.connectStart, true) },
+		ConnectDone:       func(string, string, error) { stamp(&fr.connectDone, false) },
+		TLSHandshakeStart: func() { stamp(&fr.tlsStart, true) },
+		TLSHandshakeDone:  func(tls.ConnectionState, error) { stamp(&fr.tlsDone, false) },
+		GotConn: func(info httptrace.GotConnInfo) {
+			fr.mu.Lock()
+			fr.gotConn = time.Now()
+			fr.flow.ConnReused = info.Reused
+			if addr := info.Conn.RemoteAddr(); addr != nil {
+				fr.flow.ServerAddr = addr.String()
+			}
+			fr.mu.Unlock()
+		},
+		WroteRequest:         func(httptrace.WroteRequestInfo) { stamp(&fr.wroteRequest, false) },
+		GotFirstResponseByte: func() { stamp(&fr.firstByte, true) },
+	}
+}
+
+func between(start, end time.Time) time.Duration {
+	if start.IsZero() || end.Before(start) {
+		return 0
+	}
+	return end.Sub(start)
+}
+
+func newFlowTLS(cs *tls.ConnectionState) *FlowTLS {
+	t := &FlowTLS{
+		Version:            TLSVersionName(cs.Version),
+		CipherSuite:        tls.CipherSuiteName(cs.CipherSuite),
+		ServerName:         cs.ServerName,
+		NegotiatedProtocol: cs.NegotiatedProtocol,
+	}
+	for _, cert := range cs.PeerCertificates {
+		t.PeerCertificates = append(t.PeerCertificates, FlowCertificate{
+			Subject:   cert.Subject.String(),
+			Issuer:    cert.Issuer.String(),
+			DNSNames:  cert.DNSNames,
+			NotBefore: cert.NotBefore,
+			NotAfter:  cert.NotAfter,
+		})
+	}
+	return t
+}
+
+// TLSVersionName returns the display name of a TLS protocol version.
+func TLSVersionName(version uint16) string {
+	switch version {
+	case tls.VersionTLS10:
+		return "TLS 1.0"
+	case tls.VersionTLS11:
+		return "TLS 1.1"
+	case tls.VersionTLS12:
+		return "TLS 1.2"
+	case tls.VersionTLS13:
+		return "TLS 1.3"
+	}
+	return "unknown"
+}
+
+func newFlowID() string {
+	b := make([]byte, 12)
+	if _, err := io.ReadFull(rand.Reader, b); err != nil {
+		return time.Now().Format("20060102150405.000000000")
+	}
+	return hex.EncodeToString(b)
+}
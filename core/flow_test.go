@@ -0,0 +1,96 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/millken/httpctl/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMux_RecordsFlow(t *testing.T) {
+	require := require.New(t)
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.Header().Set("Connection", "X-Hop")
+		w.Header().Set("X-Hop", "1")
+		io.WriteString(w, "echo:"+string(body))
+	}))
+	defer origin.Close()
+
+	defer func(limit int) { FlowBodyLimit = limit }(FlowBodyLimit)
+	FlowBodyLimit = 8
+	mx := newTestMux(t, config.Server{Transport: config.Transport{InsecureSkipVerify: true}})
+	defer mx.Close()
+	flows := make(chan *Flow, 1)
+	mx.HandleFlow(func(f *Flow) { flows <- f })
+	var inContext *Flow
+	mx.Use(func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			inContext = FlowFromContext(r.Context())
+			next.ServeHTTP(w, r)
+		})
+	})
+
+	req := httptest.NewRequest(http.MethodPost, origin.URL+"/echo?q=1", strings.NewReader("hello world"))
+	req.Host = origin.Listener.Addr().String()
+	req.TLS = &tls.ConnectionState{}
+	rec := httptest.NewRecorder()
+	mx.ServeHTTP(rec, req)
+	require.Equal("echo:hello world", rec.Body.String())
+
+	f := <-flows
+	require.Equal(inContext, f)
+	require.NotEmpty(f.ID)
+	require.Equal("POST", f.Request.Method)
+	require.Equal("https://"+origin.Listener.Addr().String()+"/echo?q=1", f.Request.URL)
+	require.Equal("hello wo", string(f.Request.Body))
+	require.Equal(int64(11), f.Request.BodySize)
+	require.True(f.Request.BodyTruncated)
+
+	require.NotNil(f.Response)
+	require.Equal(http.StatusOK, f.Response.StatusCode)
+	require.Equal("text/plain", f.Response.Header.Get("Content-Type"))
+	// Headers are recorded as received from the origin.
+	require.Equal("1", f.Response.Header.Get("X-Hop"))
+	require.Equal("echo:hel", string(f.Response.Body))
+	require.Equal(int64(16), f.Response.BodySize)
+
+	require.Equal(origin.Listener.Addr().String(), f.ServerAddr)
+	require.False(f.ConnReused)
+	require.NotNil(f.TLS)
+	require.NotEmpty(f.TLS.Version)
+	require.NotEmpty(f.TLS.PeerCertificates)
+	require.True(f.Timings.Connect > 0)
+	require.True(f.Timings.TLS > 0)
+	require.True(f.Timings.Wait > 0)
+	require.True(f.Timings.Total >= f.Timings.Connect+f.Timings.TLS+f.Timings.Wait)
+	require.Empty(f.Error)
+
+	_, err := f.NewRequest(context.Background())
+	require.Error(err)
+}
+
+func TestMux_RecordsFailedFlow(t *testing.T) {
+	require := require.New(t)
+	mx := newTestMux(t, config.Server{})
+	defer mx.Close()
+	flows := make(chan *Flow, 1)
+	mx.HandleFlow(func(f *Flow) { flows <- f })
+
+	rec := serveMux(mx, http.MethodGet, "http://127.0.0.1:1/", nil)
+	require.Equal(http.StatusInternalServerError, rec.Code)
+	f := <-flows
+	require.Nil(f.Response)
+	require.NotEmpty(f.Error)
+
+	r, err := f.NewRequest(context.Background())
+	require.NoError(err)
+	require.Equal("http://127.0.0.1:1/", r.URL.String())
+}
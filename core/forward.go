@@ -0,0 +1,147 @@
+package core
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/textproto"
+	"strings"
+)
+
+// viaPseudonym identifies the proxy in Via headers.
+const viaPseudonym = "httpctl"
+
+// hopHeaders are the hop-by-hop headers of RFC 7230 section 6.1, plus the
+// non-standard ones still sent by some clients. They describe a single
+// connection and are never forwarded.
+var hopHeaders = []string{
+	"Connection",
+	"Proxy-Connection",
+	"Keep-Alive",
+	"Proxy-Authenticate",
+	"Proxy-Authorization",
+	"Te",
+	"Trailer",
+	"Transfer-Encoding",
+	"Upgrade",
+}
+
+// RemoveHopHeaders deletes the hop-by-hop headers from h, including the
+// ones listed in Connection.
+func RemoveHopHeaders(h http.Header) {
+	for _, v := range h["Connection"] {
+		for _, name := range strings.Split(v, ",") {
+			if name = textproto.TrimString(name); name != "" {
+				h.Del(name)
+			}
+		}
+	}
+	for _, name := range hopHeaders {
+		h.Del(name)
+	}
+}
+
+// outgoingRequest returns the request sent upstream for r. The headers are
+// copied so middlewares still see what the client sent.
+func (mx *Mux) outgoingRequest(r *http.Request) *http.Request {
+	outreq := r.Clone(r.Context())
+	if r.ContentLength == 0 {
+		outreq.Body = nil
+	}
+	if outreq.Header == nil {
+		outreq.Header = make(http.Header)
+	}
+	outreq.URL.Scheme = "http"
+	if r.TLS != nil {
+		outreq.URL.Scheme = "https"
+	}
+	outreq.URL.Host = r.Host
+	if target := upstreamURL(r.Context()); target != nil {
+		outreq.URL.Scheme, outreq.URL.Host = target.Scheme, target.Host
+	}
+	outreq.RequestURI = ""
+	// The upstream connection is pooled whatever the client asked for.
+	outreq.Close = false
+
+	upgrade := ""
+	if headerHasToken(r.Header, "Connection", "upgrade") {
+		upgrade = r.Header.Get("Upgrade")
+	}
+	RemoveHopHeaders(outreq.Header)
+	// Te: trailers is end-to-end, it tells the origin trailers are read.
+	if headerHasToken(r.Header, "Te", "trailers") {
+		outreq.Header.Set("Te", "trailers")
+	}
+	if upgrade != "" {
+		outreq.Header.Set("Connection", "Upgrade")
+		outreq.Header.Set("Upgrade", upgrade)
+	}
+	mx.addForwardHeaders(outreq.Header, r)
+	return outreq
+}
+
+// addForwardHeaders adds the Via and X-Forwarded-* headers enabled in the
+// config to the upstream request headers h.
+func (mx *Mux) addForwardHeaders(h http.Header, r *http.Request) {
+	if mx.forward.Via {
+		h.Add("Via", viaValue(r))
+	}
+	if mx.forward.XForwardedFor {
+		if ip, _, err := net.SplitHostPort(r.RemoteAddr); err == nil {
+			if prior := h.Values("X-Forwarded-For"); len(prior) > 0 {
+				ip = strings.Join(prior, ", ") + ", " + ip
+			}
+			h.Set("X-Forwarded-For", ip)
+		}
+	}
+	if mx.forward.XForwardedHost && h.Get("X-Forwarded-Host") == "" {
+		h.Set("X-Forwarded-Host", r.Host)
+	}
+	if mx.forward.XForwardedProto && h.Get("X-Forwarded-Proto") == "" {
+		proto := "http"
+		if r.TLS != nil {
+			proto = "https"
+		}
+		h.Set("X-Forwarded-Proto", proto)
+	}
+}
+
+// copyResponseHeader copies the end-to-end headers of response into w and
+// announces its trailers, which are sent by copyTrailer.
+func (mx *Mux) copyResponseHeader(w http.ResponseWriter, r *http.Request, response *http.Response) {
+	RemoveHopHeaders(response.Header)
+	if mx.stripAltSvc {
+		response.Header.Del("Alt-Svc")
+	}
+	if mx.forward.Via {
+		response.Header.Add("Via", viaValue(r))
+	}
+	header := w.Header()
+	for name, values := range response.Header {
+		header[name] = values
+	}
+	if len(response.Trailer) > 0 {
+		names := make([]string, 0, len(response.Trailer))
+		for name := range response.Trailer {
+			names = append(names, name)
+		}
+		header.Set("Trailer", strings.Join(names, ", "))
+	}
+}
+
+// copyTrailer sends the trailers of response once its body was read. The
+// http.TrailerPrefix form also covers trailers that were not announced.
+func copyTrailer(w http.ResponseWriter, response *http.Response) {
+	header := w.Header()
+	for name, values := range response.Trailer {
+		header[http.TrailerPrefix+name] = values
+	}
+}
+
+// viaValue returns the Via entry for a request received over r.Proto.
+func viaValue(r *http.Request) string {
+	if r.ProtoMajor == 1 {
+		return fmt.Sprintf("%d.%d %s", r.ProtoMajor, r.ProtoMinor, viaPseudonym)
+	}
+	return fmt.Sprintf("%d %s", r.ProtoMajor, viaPseudonym)
+}
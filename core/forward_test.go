@@ -0,0 +1,135 @@
+package core
+
+import (
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+
+	"github.com/millken/httpctl/config"
+	"github.com/stretchr/testify/require"
+)
+
+func TestMux_StripsHopHeaders(t *testing.T) {
+	require := require.New(t)
+	received := make(chan http.Header, 1)
+	origin := newTestOrigin(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+		w.Header().Set("Connection", "X-Secret")
+		w.Header().Set("X-Secret", "hop")
+		w.Header().Set("Keep-Alive", "timeout=5")
+		w.Header().Set("Proxy-Authenticate", "Basic")
+		w.Header().Set("X-Kept", "yes")
+		w.WriteHeader(http.StatusCreated)
+		io.WriteString(w, "created")
+	})
+	defer origin.Close()
+
+	mx := newTestMux(t, config.Server{})
+	defer mx.Close()
+	req := httptest.NewRequest(http.MethodGet, origin.URL+"/", nil)
+	req.Header.Set("Connection", "X-Custom, keep-alive")
+	req.Header.Set("X-Custom", "hop")
+	req.Header.Set("Keep-Alive", "timeout=5")
+	req.Header.Set("Proxy-Connection", "keep-alive")
+	req.Header.Set("Proxy-Authorization", "Basic dXNlcjpwYXNz")
+	req.Header.Set("Te", "trailers, deflate")
+	req.Header.Set("X-End", "yes")
+	rec := httptest.NewRecorder()
+	mx.ServeHTTP(rec, req)
+
+	require.Equal(http.StatusCreated, rec.Code)
+	require.Equal("created", rec.Body.String())
+	require.Equal("yes", rec.Header().Get("X-Kept"))
+	for _, name := range []string{"Connection", "X-Secret", "Keep-Alive", "Proxy-Authenticate", "Via"} {
+		require.Empty(rec.Header().Values(name), name)
+	}
+
+	h := <-received
+	require.Equal("yes", h.Get("X-End"))
+	require.Equal("trailers", h.Get("Te"))
+	for _, name := range []string{"X-Custom", "Keep-Alive", "Proxy-Connection", "Proxy-Authorization", "Via", "X-Forwarded-For"} {
+		require.Empty(h.Values(name), name)
+	}
+	// Middlewares still see what the client sent.
+	require.Equal("hop", req.Header.Get("X-Custom"))
+}
+
+func TestMux_ForwardHeaders(t *testing.T) {
+	require := require.New(t)
+	received := make(chan http.Header, 1)
+	origin := newTestOrigin(func(w http.ResponseWriter, r *http.Request) {
+		received <- r.Header.Clone()
+	})
+	defer origin.Close()
+
+	mx := newTestMux(t, config.Server{Forward: config.Forward{
+		Via:             true,
+		XForwardedFor:   true,
+		XForwardedHost:  true,
+		XForwardedProto: true,
+	}})
+	defer mx.Close()
+	req := httptest.NewRequest(http.MethodGet, origin.URL+"/", nil)
+	req.Header.Set("X-Forwarded-For", "10.0.0.1")
+	rec := httptest.NewRecorder()
+	mx.ServeHTTP(rec, req)
+
+	require.Equal(http.StatusOK, rec.Code)
+	require.Equal("1.1 httpctl", rec.Header().Get("Via"))
+	h := <-received
+	require.Equal("1.1 httpctl", h.Get("Via"))
+	require.Equal("10.0.0.1, 192.0.2.1", h.Get("X-Forwarded-For"))
+	require.Equal(origin.Listener.Addr().String(), h.Get("X-Forwarded-Host"))
+	require.Equal("http", h.Get("X-Forwarded-Proto"))
+}
+
+func TestMux_Trailers(t *testing.T) {
+	require := require.New(t)
+	origin := newTestOrigin(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Trailer", "X-Checksum")
+		io.WriteString(w, "body")
+		w.Header().Set("X-Checksum", "abc")
+		w.Header().Set(http.TrailerPrefix+"X-Late", "late")
+	})
+	defer origin.Close()
+
+	mx := newTestMux(t, config.Server{})
+	defer mx.Close()
+	proxy := httptest.NewServer(mx)
+	defer proxy.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/", nil)
+	req.Host = origin.Listener.Addr().String()
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(err)
+	defer res.Body.Close()
+	require.Contains(res.Trailer, "X-Checksum")
+	body, err := io.ReadAll(res.Body)
+	require.NoError(err)
+	require.Equal("body", string(body))
+	require.Equal("abc", res.Trailer.Get("X-Checksum"))
+	require.Equal("late", res.Trailer.Get("X-Late"))
+}
+
+func TestMux_UpstreamURL(t *testing.T) {
+	require := require.New(t)
+	received := make(chan *http.Request, 1)
+	origin := newTestOrigin(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+	})
+	defer origin.Close()
+	target, err := url.Parse(origin.URL)
+	require.NoError(err)
+
+	mx := newTestMux(t, config.Server{})
+	defer mx.Close()
+	req := httptest.NewRequest(http.MethodGet, "http://api.example.com/users?id=1", nil)
+	rec := httptest.NewRecorder()
+	mx.ServeHTTP(rec, WithUpstreamURL(req, target))
+	require.Equal(http.StatusOK, rec.Code)
+	r := <-received
+	require.Equal("api.example.com", r.Host)
+	require.Equal("/users?id=1", r.RequestURI)
+}
@@ -0,0 +1,318 @@
+package core
+
+import (
+	"encoding/base64"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"time"
+	"unicode/utf8"
+)
+
+// HAR is an HTTP Archive 1.2 document, see
+// http://www.softwareishard.com/blog/har-12-spec/.
+type HAR struct {
+	Log HARLog `json:"log"`
+}
+
+type HARLog struct {
+	Version string     `json:"version"`
+	Creator HARCreator `json:"creator"`
+	Pages   []HARPage  `json:"pages"`
+	Entries []HAREntry `json:"entries"`
+}
+
+type HARCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type HARPage struct {
+	StartedDateTime string `json:"startedDateTime"`
+	ID              string `json:"id"`
+	Title           string `json:"title"`
+}
+
+type HAREntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            float64     `json:"time"`
+	Request         HARRequest  `json:"request"`
+	Response        HARResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         HARTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+	Comment         string      `json:"comment,omitempty"`
+}
+
+type HARRequest struct {
+	Method      string         `json:"method"`
+	URL         string         `json:"url"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	QueryString []HARNameValue `json:"queryString"`
+	PostData    *HARPostData   `json:"postData,omitempty"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARResponse struct {
+	Status      int            `json:"status"`
+	StatusText  string         `json:"statusText"`
+	HTTPVersion string         `json:"httpVersion"`
+	Cookies     []HARCookie    `json:"cookies"`
+	Headers     []HARNameValue `json:"headers"`
+	Content     HARContent     `json:"content"`
+	RedirectURL string         `json:"redirectURL"`
+	HeadersSize int            `json:"headersSize"`
+	BodySize    int64          `json:"bodySize"`
+}
+
+type HARNameValue struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+type HARCookie struct {
+	Name     string `json:"name"`
+	Value    string `json:"value"`
+	Path     string `json:"path,omitempty"`
+	Domain   string `json:"domain,omitempty"`
+	Expires  string `json:"expires,omitempty"`
+	HTTPOnly bool   `json:"httpOnly,omitempty"`
+	Secure   bool   `json:"secure,omitempty"`
+}
+
+type HARPostData struct {
+	MimeType string         `json:"mimeType"`
+	Params   []HARNameValue `json:"params,omitempty"`
+	Text     string         `json:"text"`
+	// Encoding is "base64" when Text holds a binary body.
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+type HARContent struct {
+	Size        int64  `json:"size"`
+	Compression int64  `json:"compression,omitempty"`
+	MimeType    string `json:"mimeType"`
+	Text        string `json:"text,omitempty"`
+	// Encoding is "base64" when Text holds a binary body.
+	Encoding string `json:"encoding,omitempty"`
+	Comment  string `json:"comment,omitempty"`
+}
+
+// HARTimings are in milliseconds; -1 marks a phase that did not happen.
+// Connect includes SSL, as the spec requires.
+type HARTimings struct {
+	Blocked float64 `json:"blocked"`
+	DNS     float64 `json:"dns"`
+	Connect float64 `json:"connect"`
+	Send    float64 `json:"send"`
+	Wait    float64 `json:"wait"`
+	Receive float64 `json:"receive"`
+	SSL     float64 `json:"ssl"`
+}
+
+const harTruncated = "body truncated by httpctl"
+
+// NewHAR returns an empty HAR document created by httpctl.
+func NewHAR() *HAR {
+	return &HAR{Log: HARLog{
+		Version: "1.2",
+		Creator: HARCreator{Name: "httpctl", Version: Version},
+		Pages:   []HARPage{},
+		Entries: []HAREntry{},
+	}}
+}
+
+// NewHAREntry converts a recorded Flow. Flows that failed before a response
+// arrived get status 0, like browsers export aborted requests.
+func NewHAREntry(f *Flow) HAREntry {
+	e := HAREntry{
+		StartedDateTime: f.StartedAt.Format(time.RFC3339Nano),
+		Time:            milliseconds(f.Timings.Total),
+		Request:         newHARRequest(&f.Request),
+		Response: HARResponse{
+			Cookies:     []HARCookie{},
+			Headers:     []HARNameValue{},
+			HeadersSize: -1,
+			BodySize:    -1,
+			Content:     HARContent{MimeType: "x-unknown"},
+		},
+		Timings: harTimings(&f.Timings),
+		Comment: f.Error,
+	}
+	if host, _, err := net.SplitHostPort(f.ServerAddr); err == nil {
+		e.ServerIPAddress = host
+	}
+	if f.Response != nil {
+		e.Response = newHARResponse(f.Response)
+	}
+	return e
+}
+
+func newHARRequest(r *FlowRequest) HARRequest {
+	req := HARRequest{
+		Method:      r.Method,
+		URL:         r.URL,
+		HTTPVersion: harVersion(r.Proto),
+		Cookies:     []HARCookie{},
+		Headers:     harHeaders(r.Header),
+		QueryString: []HARNameValue{},
+		HeadersSize: -1,
+		BodySize:    r.BodySize,
+	}
+	h := &RequestHeader{}
+	for name, values := range r.Header {
+		for _, v := range values {
+			h.Add(name, v)
+		}
+	}
+	h.VisitAllCookie(func(key, value []byte) {
+		req.Cookies = append(req.Cookies, HARCookie{Name: string(key), Value: string(value)})
+	})
+	if u, err := url.Parse(r.URL); err == nil {
+		req.QueryString = harValues(u.Query())
+	}
+	if r.BodySize > 0 {
+		mimeType := r.Header.Get("Content-Type")
+		req.PostData = &HARPostData{MimeType: mimeType}
+		if utf8.Valid(r.Body) {
+			req.PostData.Text = string(r.Body)
+		} else {
+			req.PostData.Text = base64.StdEncoding.EncodeToString(r.Body)
+			req.PostData.Encoding = "base64"
+		}
+		if r.BodyTruncated {
+			req.PostData.Comment = harTruncated
+		}
+		if mediaType, _, _ := mime.ParseMediaType(mimeType); mediaType == "application/x-www-form-urlencoded" && !r.BodyTruncated {
+			if values, err := url.ParseQuery(string(r.Body)); err == nil {
+				req.PostData.Params = harValues(values)
+			}
+		}
+	}
+	return req
+}
+
+func newHARResponse(r *FlowResponse) HARResponse {
+	res := HARResponse{
+		Status:      r.StatusCode,
+		StatusText:  http.StatusText(r.StatusCode),
+		HTTPVersion: harVersion(r.Proto),
+		Cookies:     []HARCookie{},
+		Headers:     harHeaders(r.Header),
+		RedirectURL: r.Header.Get("Location"),
+		HeadersSize: -1,
+		BodySize:    r.BodySize,
+		Content: HARContent{
+			Size:     r.BodySize,
+			MimeType: r.Header.Get("Content-Type"),
+		},
+	}
+	h := &ResponseHeader{}
+	for _, v := range r.Header.Values("Set-Cookie") {
+		h.Add("Set-Cookie", v)
+	}
+	h.VisitAllCookie(func(key, value []byte) {
+		parsed := (&http.Response{Header: http.Header{"Set-Cookie": {string(value)}}}).Cookies()
+		if len(parsed) == 0 {
+			return
+		}
+		c := parsed[0]
+		cookie := HARCookie{
+			Name:     c.Name,
+			Value:    c.Value,
+			Path:     c.Path,
+			Domain:   c.Domain,
+			HTTPOnly: c.HttpOnly,
+			Secure:   c.Secure,
+		}
+		if !c.Expires.IsZero() {
+			cookie.Expires = c.Expires.Format(time.RFC3339)
+		}
+		res.Cookies = append(res.Cookies, cookie)
+	})
+	body, truncated := r.Body, r.BodyTruncated
+	if codings := ContentEncoding(r.Header); len(codings) > 0 && CanDecode(codings...) {
+		// The content is described decoded; Compression is what the
+		// encoding saved.
+		decoded, cut, err := DecodeBody(r.Body, FlowBodyLimit, codings...)
+		if err == nil || (truncated && len(decoded) > 0) {
+			body, truncated = decoded, truncated || cut
+			if !truncated {
+				res.Content.Size = int64(len(decoded))
+				res.Content.Compression = res.Content.Size - r.BodySize
+			}
+		}
+	}
+	if utf8.Valid(body) {
+		res.Content.Text = string(body)
+	} else {
+		res.Content.Text = base64.StdEncoding.EncodeToString(body)
+		res.Content.Encoding = "base64"
+	}
+	if truncated {
+		res.Content.Comment = harTruncated
+	}
+	return res
+}
+
+func harTimings(t *FlowTimings) HARTimings {
+	optional := func(d time.Duration) float64 {
+		if d == 0 {
+			return -1
+		}
+		return milliseconds(d)
+	}
+	timings := HARTimings{
+		Blocked: -1,
+		DNS:     optional(t.DNS),
+		Connect: optional(t.Connect + t.TLS),
+		SSL:     optional(t.TLS),
+		Send:    milliseconds(t.Send),
+		Wait:    milliseconds(t.Wait),
+		Receive: milliseconds(t.Receive),
+	}
+	return timings
+}
+
+// harHeaders lists the headers sorted by name, as net/http does not keep
+// their order.
+func harHeaders(h http.Header) []HARNameValue {
+	names := make([]string, 0, len(h))
+	for name := range h {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	list := []HARNameValue{}
+	for _, name := range names {
+		for _, v := range h[name] {
+			list = append(list, HARNameValue{Name: name, Value: v})
+		}
+	}
+	return list
+}
+
+func harValues(values url.Values) []HARNameValue {
+	return harHeaders(http.Header(values))
+}
+
+// harVersion returns the HTTP version the way browsers export it.
+func harVersion(proto string) string {
+	if proto == "" {
+		return "HTTP/1.1"
+	}
+	if strings.HasPrefix(proto, "HTTP/2") {
+		return "HTTP/2.0"
+	}
+	return proto
+}
+
+func milliseconds(d time.Duration) float64 {
+	return float64(d) / float64(time.Millisecond)
+}
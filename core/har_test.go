@@ -0,0 +1,120 @@
+package core
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHAREntry(t *testing.T) {
+	require := require.New(t)
+	f := &Flow{
+		StartedAt:  time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC),
+		ServerAddr: "93.184.216.34:443",
+		Request: FlowRequest{
+			Method: "POST",
+			URL:    "https://example.com/login?next=%2Fhome&lang=en",
+			Proto:  "HTTP/2.0",
+			Header: http.Header{
+				"Content-Type": {"application/x-www-form-urlencoded"},
+				"Cookie":       {"session=s1; theme=dark"},
+			},
+			Body:     []byte("user=me&pass=secret"),
+			BodySize: 19,
+		},
+		Response: &FlowResponse{
+			StatusCode: http.StatusFound,
+			Proto:      "HTTP/1.1",
+			Header: http.Header{
+				"Content-Type": {"image/png"},
+				"Location":     {"/home"},
+				"Set-Cookie":   {"session=s2; Path=/; HttpOnly; Secure"},
+			},
+			Body:          []byte{0x89, 'P', 'N', 'G', 0xff},
+			BodySize:      10,
+			BodyTruncated: true,
+		},
+		Timings: FlowTimings{
+			Connect: 20 * time.Millisecond,
+			TLS:     30 * time.Millisecond,
+			Send:    time.Millisecond,
+			Wait:    100 * time.Millisecond,
+			Receive: 5 * time.Millisecond,
+			Total:   160 * time.Millisecond,
+		},
+	}
+
+	e := NewHAREntry(f)
+	require.Equal("2022-06-01T12:00:00Z", e.StartedDateTime)
+	require.Equal(160.0, e.Time)
+	require.Equal("93.184.216.34", e.ServerIPAddress)
+
+	require.Equal("HTTP/2.0", e.Request.HTTPVersion)
+	require.Equal([]HARCookie{{Name: "session", Value: "s1"}, {Name: "theme", Value: "dark"}}, e.Request.Cookies)
+	require.Equal([]HARNameValue{{Name: "lang", Value: "en"}, {Name: "next", Value: "/home"}}, e.Request.QueryString)
+	require.NotNil(e.Request.PostData)
+	require.Equal("user=me&pass=secret", e.Request.PostData.Text)
+	require.Equal([]HARNameValue{{Name: "pass", Value: "secret"}, {Name: "user", Value: "me"}}, e.Request.PostData.Params)
+
+	require.Equal(302, e.Response.Status)
+	require.Equal("Found", e.Response.StatusText)
+	require.Equal("/home", e.Response.RedirectURL)
+	require.Equal([]HARCookie{{Name: "session", Value: "s2", Path: "/", HTTPOnly: true, Secure: true}}, e.Response.Cookies)
+	require.Equal("base64", e.Response.Content.Encoding)
+	require.Equal("iVBOR/8=", e.Response.Content.Text)
+	require.Equal(int64(10), e.Response.Content.Size)
+	require.NotEmpty(e.Response.Content.Comment)
+
+	require.Equal(HARTimings{Blocked: -1, DNS: -1, Connect: 50, SSL: 30, Send: 1, Wait: 100, Receive: 5}, e.Timings)
+}
+
+func TestNewHAREntry_Failed(t *testing.T) {
+	require := require.New(t)
+	e := NewHAREntry(&Flow{
+		Request: FlowRequest{Method: "GET", URL: "http://example.com/"},
+		Error:   "connection refused",
+	})
+	require.Equal(0, e.Response.Status)
+	require.Equal("connection refused", e.Comment)
+	require.Nil(e.Request.PostData)
+	require.NotNil(e.Response.Headers)
+}
+
+func TestNewHAREntry_BinaryPostData(t *testing.T) {
+	require := require.New(t)
+	e := NewHAREntry(&Flow{
+		Request: FlowRequest{
+			Method:   "PUT",
+			URL:      "http://example.com/upload",
+			Header:   http.Header{"Content-Type": {"application/octet-stream"}},
+			Body:     []byte{0x00, 0xff, 'x'},
+			BodySize: 3,
+		},
+	})
+	require.NotNil(e.Request.PostData)
+	require.Equal("AP94", e.Request.PostData.Text)
+	require.Equal("base64", e.Request.PostData.Encoding)
+}
+
+func TestNewHAREntry_DecodesContent(t *testing.T) {
+	require := require.New(t)
+	body := []byte(strings.Repeat("{\"ok\":true}", 50))
+	encoded := encodeBody(t, body, "br")
+	e := NewHAREntry(&Flow{
+		Request: FlowRequest{Method: "GET", URL: "https://example.com/api"},
+		Response: &FlowResponse{
+			StatusCode: http.StatusOK,
+			Header:     http.Header{"Content-Encoding": {"br"}, "Content-Type": {"application/json"}},
+			Body:       encoded,
+			BodySize:   int64(len(encoded)),
+		},
+	})
+	require.Equal(string(body), e.Response.Content.Text)
+	require.Empty(e.Response.Content.Encoding)
+	require.Equal(int64(len(body)), e.Response.Content.Size)
+	require.Equal(int64(len(body)-len(encoded)), e.Response.Content.Compression)
+	require.Equal(int64(len(encoded)), e.Response.BodySize)
+}
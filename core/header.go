@@ -1,6 +1,11 @@
 package core
 
-import "bytes"
+import (
+	"bytes"
+	"net/http"
+	"strconv"
+	"strings"
+)
 
 // HTTP methods were copied from net/http.
 const (
@@ -27,11 +32,23 @@ var (
 	strHTTP             = []byte("http")
 	strHTTPS            = []byte("https")
 	strHTTP11           = []byte("HTTP/1.1")
+	strHTTP10           = []byte("HTTP/1.0")
 	strColon            = []byte(":")
 	strColonSlashSlash  = []byte("://")
 	strColonSpace       = []byte(": ")
 	strGMT              = []byte("GMT")
 	strAt               = []byte("@")
+	strClose            = []byte("close")
+
+	strHost          = []byte("Host")
+	strContentLength = []byte("Content-Length")
+	strContentType   = []byte("Content-Type")
+	strUserAgent     = []byte("User-Agent")
+	strServer        = []byte("Server")
+	strConnection    = []byte("Connection")
+	strCookie        = []byte("Cookie")
+	strSetCookie     = []byte("Set-Cookie")
+	strDate          = []byte("Date")
 
 	strGet     = []byte(MethodGet)
 	strHead    = []byte(MethodHead)
@@ -57,6 +74,7 @@ type ResponseHeader struct {
 	noDefaultDate        bool
 
 	statusCode         int
+	statusMessage      []byte
 	contentLength      int
 	contentLengthBytes []byte
 
@@ -67,6 +85,11 @@ type ResponseHeader struct {
 	bufKV argsKV
 
 	cookies []argsKV
+
+	// stores an immutable copy of headers as they were received from the
+	// wire.
+	rawHeaders []byte
+	wire       *wireHeader
 }
 
 type RequestHeader struct {
@@ -91,6 +114,7 @@ type RequestHeader struct {
 	// stores an immutable copy of headers as they were received from the
 	// wire.
 	rawHeaders []byte
+	wire       *wireHeader
 }
 
 // ConnectionClose returns true if 'Connection: close' header is set.
@@ -296,7 +320,485 @@ func (h *ResponseHeader) StatusCode() int {
 	return h.statusCode
 }
 
-// SetStatusCode sets response status code.
+// SetStatusCode sets response status code. The status message is reset to
+// the standard one of statusCode.
 func (h *ResponseHeader) SetStatusCode(statusCode int) {
 	h.statusCode = statusCode
+	h.statusMessage = h.statusMessage[:0]
+}
+
+// StatusMessage returns the reason phrase of the status line, such as
+// "Not Found".
+func (h *ResponseHeader) StatusMessage() []byte {
+	if len(h.statusMessage) > 0 {
+		return h.statusMessage
+	}
+	if text := http.StatusText(h.StatusCode()); text != "" {
+		return []byte(text)
+	}
+	return []byte("Unknown Status Code")
+}
+
+// SetStatusMessage sets the reason phrase of the status line, for
+// instance as sent by the origin.
+func (h *ResponseHeader) SetStatusMessage(statusMessage []byte) {
+	h.statusMessage = append(h.statusMessage[:0], statusMessage...)
+}
+
+// DisableNormalizing disables header key normalization, so keys are stored
+// and matched exactly as given instead of as "Content-Type".
+func (h *RequestHeader) DisableNormalizing() {
+	h.disableNormalizing = true
+}
+
+// ContentLength returns Content-Length header value, or -1 if unknown.
+func (h *RequestHeader) ContentLength() int {
+	return h.contentLength
+}
+
+// SetContentLength sets Content-Length header value. A negative value
+// removes the header.
+func (h *RequestHeader) SetContentLength(contentLength int) {
+	h.contentLength = contentLength
+	if contentLength < 0 {
+		h.contentLengthBytes = h.contentLengthBytes[:0]
+		return
+	}
+	h.contentLengthBytes = strconv.AppendInt(h.contentLengthBytes[:0], int64(contentLength), 10)
+}
+
+// Peek returns the value of the given header key, or nil if it is missing.
+func (h *RequestHeader) Peek(key string) []byte {
+	switch {
+	case strings.EqualFold(key, "Host"):
+		return h.Host()
+	case strings.EqualFold(key, "Content-Type"):
+		return h.ContentType()
+	case strings.EqualFold(key, "User-Agent"):
+		return h.UserAgent()
+	case strings.EqualFold(key, "Content-Length"):
+		return h.contentLengthBytes
+	case strings.EqualFold(key, "Connection"):
+		if h.ConnectionClose() {
+			return strClose
+		}
+	case strings.EqualFold(key, "Cookie"):
+		if len(h.cookies) > 0 {
+			return appendRequestCookieBytes(nil, h.cookies)
+		}
+		return nil
+	}
+	return peekArgBytes(h.h, normalizeHeaderKey(key, h.disableNormalizing))
+}
+
+// Set sets the given header, replacing any existing values.
+func (h *RequestHeader) Set(key, value string) {
+	if strings.EqualFold(key, "Cookie") {
+		// setSpecialHeader appends the parsed cookies.
+		h.cookies = h.cookies[:0]
+	}
+	if h.setSpecialHeader(key, value) {
+		return
+	}
+	h.h = setArgBytes(h.h, normalizeHeaderKey(key, h.disableNormalizing), []byte(value))
+}
+
+// Add adds a value to the given header, keeping existing values.
+func (h *RequestHeader) Add(key, value string) {
+	if h.setSpecialHeader(key, value) {
+		return
+	}
+	h.h = appendArgBytes(h.h, normalizeHeaderKey(key, h.disableNormalizing), []byte(value))
+}
+
+// Del deletes all values of the given header.
+func (h *RequestHeader) Del(key string) {
+	switch {
+	case strings.EqualFold(key, "Host"):
+		h.host = h.host[:0]
+	case strings.EqualFold(key, "Content-Type"):
+		h.contentType = h.contentType[:0]
+	case strings.EqualFold(key, "User-Agent"):
+		h.userAgent = h.userAgent[:0]
+	case strings.EqualFold(key, "Content-Length"):
+		h.SetContentLength(-1)
+	case strings.EqualFold(key, "Connection"):
+		h.connectionClose = false
+	case strings.EqualFold(key, "Cookie"):
+		h.cookies = h.cookies[:0]
+	}
+	h.h = delAllArgsBytes(h.h, normalizeHeaderKey(key, h.disableNormalizing))
+}
+
+// setSpecialHeader stores headers kept in dedicated fields, returning false
+// for any other header.
+func (h *RequestHeader) setSpecialHeader(key, value string) bool {
+	switch {
+	case strings.EqualFold(key, "Host"):
+		h.SetHost(value)
+	case strings.EqualFold(key, "Content-Type"):
+		h.SetContentType(value)
+	case strings.EqualFold(key, "User-Agent"):
+		h.SetUserAgent(value)
+	case strings.EqualFold(key, "Content-Length"):
+		if n, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+			h.SetContentLength(n)
+		}
+	case strings.EqualFold(key, "Connection") && strings.EqualFold(value, "close"):
+		h.SetConnectionClose()
+	case strings.EqualFold(key, "Cookie"):
+		h.cookies = parseRequestCookies(h.cookies, value)
+	default:
+		return false
+	}
+	return true
+}
+
+// VisitAll calls f for each header, including Host, Content-Length and
+// Cookie. f must not retain references to key and value.
+func (h *RequestHeader) VisitAll(f func(key, value []byte)) {
+	if host := h.Host(); len(host) > 0 {
+		f(strHost, host)
+	}
+	if len(h.contentLengthBytes) > 0 {
+		f(strContentLength, h.contentLengthBytes)
+	}
+	if contentType := h.ContentType(); len(contentType) > 0 {
+		f(strContentType, contentType)
+	}
+	if userAgent := h.UserAgent(); len(userAgent) > 0 {
+		f(strUserAgent, userAgent)
+	}
+	for i := range h.h {
+		f(h.h[i].key, h.h[i].value)
+	}
+	if len(h.cookies) > 0 {
+		f(strCookie, appendRequestCookieBytes(nil, h.cookies))
+	}
+	if h.ConnectionClose() {
+		f(strConnection, strClose)
+	}
+}
+
+// Cookie returns the value of the request cookie with the given name.
+func (h *RequestHeader) Cookie(key string) []byte {
+	return peekArgBytes(h.cookies, []byte(key))
+}
+
+// SetCookie sets the request cookie with the given name.
+func (h *RequestHeader) SetCookie(key, value string) {
+	h.cookies = setArgBytes(h.cookies, []byte(key), []byte(value))
+}
+
+// DelCookie removes the request cookie with the given name.
+func (h *RequestHeader) DelCookie(key string) {
+	h.cookies = delAllArgsBytes(h.cookies, []byte(key))
+}
+
+// VisitAllCookie calls f for each request cookie.
+func (h *RequestHeader) VisitAllCookie(f func(key, value []byte)) {
+	for i := range h.cookies {
+		f(h.cookies[i].key, h.cookies[i].value)
+	}
+}
+
+// RawHeaders returns the header lines the header was built from, without
+// the request line. The returned value must not be modified.
+func (h *RequestHeader) RawHeaders() []byte {
+	return h.rawHeaders
+}
+
+// DisableNormalizing disables header key normalization, so keys are stored
+// and matched exactly as given instead of as "Content-Type".
+func (h *ResponseHeader) DisableNormalizing() {
+	h.disableNormalizing = true
+}
+
+// ContentLength returns Content-Length header value, or -1 if unknown.
+func (h *ResponseHeader) ContentLength() int {
+	return h.contentLength
+}
+
+// SetContentLength sets Content-Length header value. A negative value
+// removes the header.
+func (h *ResponseHeader) SetContentLength(contentLength int) {
+	h.contentLength = contentLength
+	if contentLength < 0 {
+		h.contentLengthBytes = h.contentLengthBytes[:0]
+		return
+	}
+	h.contentLengthBytes = strconv.AppendInt(h.contentLengthBytes[:0], int64(contentLength), 10)
+}
+
+// ConnectionClose returns true if 'Connection: close' header is set.
+func (h *ResponseHeader) ConnectionClose() bool {
+	return h.connectionClose
+}
+
+// SetConnectionClose sets 'Connection: close' header.
+func (h *ResponseHeader) SetConnectionClose() {
+	h.connectionClose = true
+}
+
+// Peek returns the value of the given header key, or nil if it is missing.
+func (h *ResponseHeader) Peek(key string) []byte {
+	switch {
+	case strings.EqualFold(key, "Content-Type"):
+		return h.ContentType()
+	case strings.EqualFold(key, "Server"):
+		return h.Server()
+	case strings.EqualFold(key, "Content-Length"):
+		return h.contentLengthBytes
+	case strings.EqualFold(key, "Connection"):
+		if h.ConnectionClose() {
+			return strClose
+		}
+	case strings.EqualFold(key, "Set-Cookie"):
+		if len(h.cookies) > 0 {
+			return h.cookies[0].value
+		}
+		return nil
+	}
+	return peekArgBytes(h.h, normalizeHeaderKey(key, h.disableNormalizing))
+}
+
+// Set sets the given header, replacing any existing values.
+func (h *ResponseHeader) Set(key, value string) {
+	if strings.EqualFold(key, "Set-Cookie") {
+		// setSpecialHeader appends to the Set-Cookie list.
+		h.cookies = h.cookies[:0]
+	}
+	if h.setSpecialHeader(key, value) {
+		return
+	}
+	h.h = setArgBytes(h.h, normalizeHeaderKey(key, h.disableNormalizing), []byte(value))
+}
+
+// Add adds a value to the given header, keeping existing values.
+func (h *ResponseHeader) Add(key, value string) {
+	if h.setSpecialHeader(key, value) {
+		return
+	}
+	h.h = appendArgBytes(h.h, normalizeHeaderKey(key, h.disableNormalizing), []byte(value))
+}
+
+// Del deletes all values of the given header.
+func (h *ResponseHeader) Del(key string) {
+	switch {
+	case strings.EqualFold(key, "Content-Type"):
+		h.contentType = h.contentType[:0]
+	case strings.EqualFold(key, "Server"):
+		h.server = h.server[:0]
+	case strings.EqualFold(key, "Content-Length"):
+		h.SetContentLength(-1)
+	case strings.EqualFold(key, "Connection"):
+		h.connectionClose = false
+	case strings.EqualFold(key, "Set-Cookie"):
+		h.cookies = h.cookies[:0]
+	}
+	h.h = delAllArgsBytes(h.h, normalizeHeaderKey(key, h.disableNormalizing))
+}
+
+// setSpecialHeader stores headers kept in dedicated fields, returning false
+// for any other header.
+func (h *ResponseHeader) setSpecialHeader(key, value string) bool {
+	switch {
+	case strings.EqualFold(key, "Content-Type"):
+		h.SetContentType(value)
+	case strings.EqualFold(key, "Server"):
+		h.SetServer(value)
+	case strings.EqualFold(key, "Content-Length"):
+		if n, err := strconv.Atoi(strings.TrimSpace(value)); err == nil {
+			h.SetContentLength(n)
+		}
+	case strings.EqualFold(key, "Connection") && strings.EqualFold(value, "close"):
+		h.SetConnectionClose()
+	case strings.EqualFold(key, "Set-Cookie"):
+		// Cookies of the same name may differ by Domain or Path, so every
+		// Set-Cookie is kept.
+		if name := setCookieName(value); name != "" {
+			h.cookies = appendArgBytes(h.cookies, []byte(name), []byte(value))
+		}
+	default:
+		return false
+	}
+	return true
+}
+
+// VisitAll calls f for each header, including Content-Length and every
+// Set-Cookie. f must not retain references to key and value.
+func (h *ResponseHeader) VisitAll(f func(key, value []byte)) {
+	if len(h.contentLengthBytes) > 0 {
+		f(strContentLength, h.contentLengthBytes)
+	}
+	if contentType := h.ContentType(); len(contentType) > 0 {
+		f(strContentType, contentType)
+	}
+	if server := h.Server(); len(server) > 0 {
+		f(strServer, server)
+	}
+	for i := range h.h {
+		f(h.h[i].key, h.h[i].value)
+	}
+	for i := range h.cookies {
+		f(strSetCookie, h.cookies[i].value)
+	}
+	if h.ConnectionClose() {
+		f(strConnection, strClose)
+	}
+}
+
+// Cookie returns the first Set-Cookie value of the cookie with the given
+// name.
+func (h *ResponseHeader) Cookie(key string) []byte {
+	return peekArgBytes(h.cookies, []byte(key))
+}
+
+// SetCookie sets the given Set-Cookie, replacing the cookie of the same
+// name, domain and path.
+func (h *ResponseHeader) SetCookie(cookie *http.Cookie) {
+	v := cookie.String()
+	if v == "" {
+		return
+	}
+	for i := range h.cookies {
+		if string(h.cookies[i].key) == cookie.Name && sameCookieScope(h.cookies[i].value, cookie) {
+			h.cookies[i].value = append(h.cookies[i].value[:0], v...)
+			return
+		}
+	}
+	h.cookies = appendArgBytes(h.cookies, []byte(cookie.Name), []byte(v))
+}
+
+// DelCookie removes the Set-Cookie of every cookie with the given name.
+func (h *ResponseHeader) DelCookie(key string) {
+	h.cookies = delAllArgsBytes(h.cookies, []byte(key))
+}
+
+// VisitAllCookie calls f for each Set-Cookie with the cookie name and the
+// whole header value.
+func (h *ResponseHeader) VisitAllCookie(f func(key, value []byte)) {
+	for i := range h.cookies {
+		f(h.cookies[i].key, h.cookies[i].value)
+	}
+}
+
+// RawHeaders returns the header lines the header was built from, without
+// the status line. The returned value must not be modified.
+func (h *ResponseHeader) RawHeaders() []byte {
+	return h.rawHeaders
+}
+
+// normalizeHeaderKey returns key in canonical form, e.g. "Content-Type",
+// unless normalization is disabled.
+func normalizeHeaderKey(key string, disableNormalizing bool) []byte {
+	b := []byte(key)
+	if disableNormalizing {
+		return b
+	}
+	upper := true
+	for i, c := range b {
+		if upper && 'a' <= c && c <= 'z' {
+			c -= 'a' - 'A'
+		} else if !upper && 'A' <= c && c <= 'Z' {
+			c += 'a' - 'A'
+		}
+		b[i] = c
+		upper = c == '-'
+	}
+	return b
+}
+
+func peekArgBytes(h []argsKV, key []byte) []byte {
+	for i := range h {
+		if bytes.Equal(h[i].key, key) {
+			return h[i].value
+		}
+	}
+	return nil
+}
+
+// setArgBytes replaces the first value of key and drops the others.
+func setArgBytes(h []argsKV, key, value []byte) []argsKV {
+	for i := range h {
+		if bytes.Equal(h[i].key, key) {
+			h[i].value = append(h[i].value[:0], value...)
+			return append(h[:i+1], delAllArgsBytes(h[i+1:], key)...)
+		}
+	}
+	return appendArgBytes(h, key, value)
+}
+
+func appendArgBytes(h []argsKV, key, value []byte) []argsKV {
+	return append(h, argsKV{
+		key:   append([]byte(nil), key...),
+		value: append([]byte(nil), value...),
+	})
+}
+
+func delAllArgsBytes(h []argsKV, key []byte) []argsKV {
+	n := 0
+	for _, kv := range h {
+		if !bytes.Equal(kv.key, key) {
+			h[n] = kv
+			n++
+		}
+	}
+	return h[:n]
+}
+
+// parseRequestCookies appends the cookies of a Cookie header value.
+func parseRequestCookies(cookies []argsKV, value string) []argsKV {
+	for _, part := range strings.Split(value, ";") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		name, val := part, ""
+		if i := strings.IndexByte(part, '='); i >= 0 {
+			name, val = part[:i], part[i+1:]
+		}
+		cookies = append(cookies, argsKV{
+			key:     []byte(name),
+			value:   []byte(val),
+			noValue: !strings.Contains(part, "="),
+		})
+	}
+	return cookies
+}
+
+func appendRequestCookieBytes(dst []byte, cookies []argsKV) []byte {
+	for i, kv := range cookies {
+		if i > 0 {
+			dst = append(dst, "; "...)
+		}
+		dst = append(dst, kv.key...)
+		if !kv.noValue {
+			dst = append(dst, '=')
+			dst = append(dst, kv.value...)
+		}
+	}
+	return dst
+}
+
+// sameCookieScope reports whether the Set-Cookie value applies to the same
+// domain and path as cookie.
+func sameCookieScope(value []byte, cookie *http.Cookie) bool {
+	parsed := (&http.Response{Header: http.Header{"Set-Cookie": {string(value)}}}).Cookies()
+	if len(parsed) == 0 {
+		return false
+	}
+	domain := func(d string) string { return strings.ToLower(strings.TrimPrefix(d, ".")) }
+	return domain(parsed[0].Domain) == domain(cookie.Domain) && parsed[0].Path == cookie.Path
+}
+
+// setCookieName returns the cookie name of a Set-Cookie value.
+func setCookieName(value string) string {
+	if i := strings.IndexByte(value, ';'); i >= 0 {
+		value = value[:i]
+	}
+	if i := strings.IndexByte(value, '='); i >= 0 {
+		value = value[:i]
+	}
+	return strings.TrimSpace(value)
 }
@@ -0,0 +1,66 @@
+//go:build go1.18
+// +build go1.18
+
+package core
+
+import (
+	"bufio"
+	"strings"
+	"testing"
+)
+
+// A header that parses must be written back as the bytes it was read from,
+// and must still parse back to the same header once modified.
+
+func FuzzRequestHeaderRead(f *testing.F) {
+	f.Add("GET / HTTP/1.1\r\nHost: example.com\r\n\r\n")
+	f.Add("POST /a?b=c HTTP/1.0\r\nContent-Length: 3\r\nCookie: a=1; b\r\nConnection: close\r\n\r\n")
+	f.Add("PUT /x HTTP/1.1\r\nX-Folded: a\r\n\tb\r\nTransfer-Encoding: chunked\r\n\r\n")
+	f.Add("GET / HTTP/1.1\r\nX-Empty:\r\n \r\n\r\n")
+	f.Fuzz(func(t *testing.T, raw string) {
+		var h RequestHeader
+		if err := h.Read(bufio.NewReader(strings.NewReader(raw))); err != nil {
+			return
+		}
+		out := h.String()
+		if !strings.HasPrefix(raw, out) {
+			t.Fatalf("header not written back as read:\n%q\n%q", raw, out)
+		}
+		h.Set("X-Fuzz", "1")
+		out = h.String()
+		var h2 RequestHeader
+		if err := h2.Read(bufio.NewReader(strings.NewReader(out))); err != nil {
+			t.Fatalf("cannot read back %q: %v", out, err)
+		}
+		if out2 := h2.String(); out2 != out {
+			t.Fatalf("round trip changed the header:\n%q\n%q", out, out2)
+		}
+	})
+}
+
+func FuzzResponseHeaderRead(f *testing.F) {
+	f.Add("HTTP/1.1 200 OK\r\nContent-Type: text/html\r\nContent-Length: 5\r\n\r\n")
+	f.Add("HTTP/1.0 302 Found\r\nLocation: /\r\nSet-Cookie: a=1; Path=/\r\n\r\n")
+	f.Add("HTTP/1.1 599 Custom\r\nConnection: close\r\n\r\n")
+	f.Fuzz(func(t *testing.T, raw string) {
+		var h ResponseHeader
+		h.SetNoDefaultDate(true)
+		if err := h.Read(bufio.NewReader(strings.NewReader(raw))); err != nil {
+			return
+		}
+		out := h.String()
+		if !strings.HasPrefix(raw, out) {
+			t.Fatalf("header not written back as read:\n%q\n%q", raw, out)
+		}
+		h.Set("X-Fuzz", "1")
+		out = h.String()
+		var h2 ResponseHeader
+		h2.SetNoDefaultDate(true)
+		if err := h2.Read(bufio.NewReader(strings.NewReader(out))); err != nil {
+			t.Fatalf("cannot read back %q: %v", out, err)
+		}
+		if out2 := h2.String(); out2 != out {
+			t.Fatalf("round trip changed the header:\n%q\n%q", out, out2)
+		}
+	})
+}
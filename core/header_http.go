@@ -0,0 +1,86 @@
+package core
+
+import (
+	"bytes"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+// NewRequestHeader returns the header of r, as received by the proxy. The
+// values are copied, so r may change afterwards.
+func NewRequestHeader(r *http.Request) *RequestHeader {
+	h := &RequestHeader{contentLength: int(r.ContentLength)}
+	h.SetMethod(r.Method)
+	h.SetRequestURI(r.URL.RequestURI())
+	h.SetHost(r.Host)
+	if r.TLS != nil {
+		h.SetHTTPS()
+	}
+	h.noHTTP11 = !r.ProtoAtLeast(1, 1)
+
+	header := withTransferEncoding(r.Header, r.TransferEncoding)
+	visitHeader(header, h.Add)
+	if r.Close {
+		h.SetConnectionClose()
+	}
+
+	var raw bytes.Buffer
+	raw.WriteString("Host: ")
+	raw.WriteString(r.Host)
+	raw.Write(strCRLF)
+	header.Write(&raw)
+	h.rawHeaders = raw.Bytes()
+	return h
+}
+
+// NewResponseHeader returns the header of response. The values are copied,
+// so response may change afterwards.
+func NewResponseHeader(response *http.Response) *ResponseHeader {
+	h := &ResponseHeader{contentLength: int(response.ContentLength)}
+	h.SetStatusCode(response.StatusCode)
+	// Status holds the reason phrase the origin sent, e.g. "404 Not Found".
+	if i := strings.IndexByte(response.Status, ' '); i >= 0 {
+		h.SetStatusMessage([]byte(response.Status[i+1:]))
+	}
+	h.noHTTP11 = !response.ProtoAtLeast(1, 1)
+	// Only report the Content-Type the origin actually sent.
+	h.noDefaultContentType = response.Header.Get("Content-Type") == ""
+
+	header := withTransferEncoding(response.Header, response.TransferEncoding)
+	visitHeader(header, h.Add)
+	if response.Close {
+		h.SetConnectionClose()
+	}
+
+	var raw bytes.Buffer
+	header.Write(&raw)
+	h.rawHeaders = raw.Bytes()
+	return h
+}
+
+// withTransferEncoding puts back the Transfer-Encoding that net/http moves
+// out of the header map.
+func withTransferEncoding(header http.Header, te []string) http.Header {
+	if len(te) == 0 {
+		return header
+	}
+	header = header.Clone()
+	header["Transfer-Encoding"] = te
+	return header
+}
+
+// visitHeader calls f for each header value, sorted by key since the order
+// on the wire is not kept by net/http.
+func visitHeader(header http.Header, f func(key, value string)) {
+	keys := make([]string, 0, len(header))
+	for k := range header {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		for _, v := range header[k] {
+			f(k, v)
+		}
+	}
+}
@@ -0,0 +1,169 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewRequestHeader(t *testing.T) {
+	require := require.New(t)
+	r := httptest.NewRequest(http.MethodPost, "http://example.com/upload?x=1", strings.NewReader("body"))
+	r.Header.Set("Content-Type", "text/plain")
+	r.Header.Set("User-Agent", "curl/7.79.1")
+	r.Header.Set("Content-Length", "4")
+	r.Header.Set("X-Request-Id", "abc")
+	r.Header.Add("Cookie", "session=s1; theme=dark")
+	r.Header.Add("Cookie", "flag")
+
+	h := NewRequestHeader(r)
+	require.True(h.IsPost())
+	require.Equal("/upload?x=1", string(h.RequestURI()))
+	require.Equal("example.com", string(h.Host()))
+	require.Equal("example.com", string(h.Peek("host")))
+	require.Equal("text/plain", string(h.Peek("Content-Type")))
+	require.Equal("curl/7.79.1", string(h.Peek("user-agent")))
+	require.Equal(4, h.ContentLength())
+	require.Equal("4", string(h.Peek("Content-Length")))
+	require.Equal("abc", string(h.Peek("x-request-id")))
+
+	require.Equal("s1", string(h.Cookie("session")))
+	require.Equal("dark", string(h.Cookie("theme")))
+	require.Equal("session=s1; theme=dark; flag", string(h.Peek("Cookie")))
+	h.DelCookie("theme")
+	require.Nil(h.Cookie("theme"))
+
+	raw := string(h.RawHeaders())
+	require.True(strings.HasPrefix(raw, "Host: example.com\r\n"), raw)
+	require.Contains(raw, "X-Request-Id: abc\r\n")
+
+	// Changes to r after the conversion are not seen.
+	r.Header.Set("X-Request-Id", "changed")
+	require.Equal("abc", string(h.Peek("X-Request-Id")))
+}
+
+func TestRequestHeader_SetAddDel(t *testing.T) {
+	require := require.New(t)
+	h := &RequestHeader{}
+	h.Set("accept-encoding", "gzip")
+	h.Add("X-Forwarded-For", "10.0.0.1")
+	h.Add("x-forwarded-for", "10.0.0.2")
+	h.Set("Connection", "close")
+	h.Set("Host", "example.com")
+
+	var visited []string
+	h.VisitAll(func(key, value []byte) {
+		visited = append(visited, string(key)+": "+string(value))
+	})
+	require.Equal([]string{
+		"Host: example.com",
+		"Accept-Encoding: gzip",
+		"X-Forwarded-For: 10.0.0.1",
+		"X-Forwarded-For: 10.0.0.2",
+		"Connection: close",
+	}, visited)
+
+	h.Set("X-Forwarded-For", "10.0.0.3")
+	require.Equal("10.0.0.3", string(h.Peek("X-Forwarded-For")))
+	n := 0
+	h.VisitAll(func(key, value []byte) {
+		if string(key) == "X-Forwarded-For" {
+			n++
+		}
+	})
+	require.Equal(1, n)
+
+	h.Del("x-forwarded-for")
+	h.Del("Connection")
+	require.Nil(h.Peek("X-Forwarded-For"))
+	require.False(h.ConnectionClose())
+}
+
+func TestRequestHeader_DisableNormalizing(t *testing.T) {
+	require := require.New(t)
+	h := &RequestHeader{}
+	h.DisableNormalizing()
+	h.Set("x-lower", "1")
+	require.Equal("1", string(h.Peek("x-lower")))
+	require.Nil(h.Peek("X-Lower"))
+}
+
+func TestNewResponseHeader(t *testing.T) {
+	require := require.New(t)
+	origin := newTestOrigin(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Server", "nginx")
+		http.SetCookie(w, &http.Cookie{Name: "session", Value: "s1", Path: "/"})
+		http.SetCookie(w, &http.Cookie{Name: "theme", Value: "dark"})
+		w.Header().Set("X-Cache", "HIT")
+		w.WriteHeader(http.StatusAccepted)
+	})
+	defer origin.Close()
+	response, err := http.Get(origin.URL)
+	require.NoError(err)
+	response.Body.Close()
+
+	h := NewResponseHeader(response)
+	require.Equal(http.StatusAccepted, h.StatusCode())
+	require.True(h.IsHTTP11())
+	require.Equal("nginx", string(h.Peek("server")))
+	require.Equal("HIT", string(h.Peek("X-Cache")))
+	require.Equal("0", string(h.Peek("Content-Length")))
+	// The origin sent no Content-Type, so none is made up.
+	require.Empty(h.ContentType())
+	require.Equal("session=s1; Path=/", string(h.Cookie("session")))
+	require.Equal("theme=dark", string(h.Cookie("theme")))
+	require.Contains(string(h.RawHeaders()), "X-Cache: HIT\r\n")
+
+	h.SetCookie(&http.Cookie{Name: "theme", Value: "light"})
+	var cookies []string
+	h.VisitAllCookie(func(key, value []byte) {
+		cookies = append(cookies, string(value))
+	})
+	require.Equal([]string{"session=s1; Path=/", "theme=light"}, cookies)
+
+	h.Del("Set-Cookie")
+	require.Nil(h.Peek("Set-Cookie"))
+}
+
+func TestRequestHeader_SetCookie(t *testing.T) {
+	require := require.New(t)
+	h := &RequestHeader{}
+	h.Set("Cookie", "session=s1; theme=dark")
+	h.Add("Cookie", "flag")
+	require.Equal("session=s1; theme=dark; flag", string(h.Peek("Cookie")))
+
+	h.Set("Cookie", "session=s2")
+	require.Equal("session=s2", string(h.Peek("Cookie")))
+	require.Nil(h.Cookie("theme"))
+}
+
+func TestResponseHeader_SetCookie(t *testing.T) {
+	require := require.New(t)
+	h := &ResponseHeader{}
+	h.Add("Set-Cookie", "id=a; Path=/")
+	h.Add("Set-Cookie", "id=b; Path=/admin")
+	h.Add("Set-Cookie", "id=c; Domain=example.com")
+	cookies := func() []string {
+		var values []string
+		h.VisitAll(func(key, value []byte) {
+			if string(key) == "Set-Cookie" {
+				values = append(values, string(value))
+			}
+		})
+		return values
+	}
+	require.Equal([]string{"id=a; Path=/", "id=b; Path=/admin", "id=c; Domain=example.com"}, cookies())
+	require.Equal("id=a; Path=/", string(h.Cookie("id")))
+
+	h.SetCookie(&http.Cookie{Name: "id", Value: "d", Path: "/admin"})
+	h.SetCookie(&http.Cookie{Name: "id", Value: "e", Path: "/other"})
+	require.Equal([]string{"id=a; Path=/", "id=d; Path=/admin", "id=c; Domain=example.com", "id=e; Path=/other"}, cookies())
+
+	h.Set("Set-Cookie", "only=1")
+	require.Equal([]string{"only=1"}, cookies())
+	h.DelCookie("only")
+	require.Empty(cookies())
+}
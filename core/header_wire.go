@@ -0,0 +1,366 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/pkg/errors"
+)
+
+// MaxHeaderBytes is the largest header accepted by Read, including the
+// request or status line.
+const MaxHeaderBytes = http.DefaultMaxHeaderBytes
+
+// wireHeader is a header as read by Read, kept so the message can be
+// written back exactly.
+type wireHeader struct {
+	// first is the request or status line and end the empty line ending
+	// the header, both with their line endings.
+	first []byte
+	end   []byte
+	// lines are the header lines, keyed as spelled on the wire.
+	lines []argsKV
+	// state is the header as built from its fields right after Read. The
+	// bytes read are written back as long as the header still builds to
+	// it.
+	state []byte
+}
+
+// appendTo appends the header built from first and lines to dst: the bytes
+// read if it was not modified, and otherwise lines in the order and with
+// the key spelling they had on the wire, followed by those added since.
+func (w *wireHeader) appendTo(dst, first []byte, lines []argsKV, raw []byte) []byte {
+	if bytes.Equal(appendHeaderLines(append([]byte(nil), first...), lines), w.state) {
+		dst = append(dst, w.first...)
+		dst = append(dst, raw...)
+		return append(dst, w.end...)
+	}
+	dst = append(dst, first...)
+	used := make([]bool, len(lines))
+	for _, kv := range w.lines {
+		for i := range lines {
+			if !used[i] && bytes.EqualFold(lines[i].key, kv.key) {
+				used[i] = true
+				dst = appendHeaderLine(dst, kv.key, lines[i].value)
+				break
+			}
+		}
+	}
+	for i := range lines {
+		if !used[i] {
+			dst = appendHeaderLine(dst, lines[i].key, lines[i].value)
+		}
+	}
+	return append(dst, strCRLF...)
+}
+
+// SetNoDefaultContentType stops the text/plain default Content-Type from
+// being reported and written when the response has none.
+func (h *ResponseHeader) SetNoDefaultContentType(noDefaultContentType bool) {
+	h.noDefaultContentType = noDefaultContentType
+}
+
+// SetNoDefaultDate stops a Date header from being written when the
+// response has none.
+func (h *ResponseHeader) SetNoDefaultDate(noDefaultDate bool) {
+	h.noDefaultDate = noDefaultDate
+}
+
+// Reset clears the header. Normalization settings are kept.
+func (h *RequestHeader) Reset() {
+	*h = RequestHeader{disableNormalizing: h.disableNormalizing}
+}
+
+// Reset clears the header. Normalization and default settings are kept.
+func (h *ResponseHeader) Reset() {
+	*h = ResponseHeader{
+		disableNormalizing:   h.disableNormalizing,
+		noDefaultContentType: h.noDefaultContentType,
+		noDefaultDate:        h.noDefaultDate,
+	}
+}
+
+// AppendBytes appends the request line and headers, terminated by an empty
+// line, to dst. A header read with Read is written back as it was read,
+// or, once modified, in the order and with the key spelling of the wire.
+func (h *RequestHeader) AppendBytes(dst []byte) []byte {
+	first := h.appendRequestLine(nil)
+	lines := visitLines(h.VisitAll)
+	if h.wire != nil {
+		return h.wire.appendTo(dst, first, lines, h.rawHeaders)
+	}
+	dst = appendHeaderLines(append(dst, first...), lines)
+	return append(dst, strCRLF...)
+}
+
+func (h *RequestHeader) appendRequestLine(dst []byte) []byte {
+	dst = append(dst, h.Method()...)
+	dst = append(dst, ' ')
+	dst = append(dst, h.RequestURI()...)
+	dst = append(dst, ' ')
+	if h.IsHTTP11() {
+		dst = append(dst, strHTTP11...)
+	} else {
+		dst = append(dst, strHTTP10...)
+	}
+	return append(dst, strCRLF...)
+}
+
+// WriteTo writes the request line and headers to w.
+func (h *RequestHeader) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(h.AppendBytes(nil))
+	return int64(n), err
+}
+
+// String returns the request line and headers.
+func (h *RequestHeader) String() string {
+	return string(h.AppendBytes(nil))
+}
+
+// AppendBytes appends the status line and headers, terminated by an empty
+// line, to dst. A header read with Read is written back as it was read,
+// or, once modified, in the order and with the key spelling of the wire.
+// Otherwise a Date header is added unless disabled with SetNoDefaultDate.
+func (h *ResponseHeader) AppendBytes(dst []byte) []byte {
+	first := h.appendStatusLine(nil)
+	lines := visitLines(h.VisitAll)
+	if h.wire != nil {
+		return h.wire.appendTo(dst, first, lines, h.rawHeaders)
+	}
+	dst = append(dst, first...)
+	if !h.noDefaultDate && !hasArgFold(h.h, strDate) {
+		dst = appendHeaderLine(dst, strDate, []byte(time.Now().UTC().Format(http.TimeFormat)))
+	}
+	dst = appendHeaderLines(dst, lines)
+	return append(dst, strCRLF...)
+}
+
+func (h *ResponseHeader) appendStatusLine(dst []byte) []byte {
+	if h.IsHTTP11() {
+		dst = append(dst, strHTTP11...)
+	} else {
+		dst = append(dst, strHTTP10...)
+	}
+	dst = append(dst, ' ')
+	dst = strconv.AppendInt(dst, int64(h.StatusCode()), 10)
+	dst = append(dst, ' ')
+	dst = append(dst, h.StatusMessage()...)
+	return append(dst, strCRLF...)
+}
+
+// WriteTo writes the status line and headers to w.
+func (h *ResponseHeader) WriteTo(w io.Writer) (int64, error) {
+	n, err := w.Write(h.AppendBytes(nil))
+	return int64(n), err
+}
+
+// String returns the status line and headers.
+func (h *ResponseHeader) String() string {
+	return string(h.AppendBytes(nil))
+}
+
+// Read parses a request line and headers from r, up to and including the
+// empty line that ends them. The body is left unread. io.EOF is returned if
+// r is empty.
+func (h *RequestHeader) Read(r *bufio.Reader) error {
+	h.Reset()
+	first, lines, raw, end, err := readHeaderBlock(r)
+	if err != nil {
+		return err
+	}
+	wire := &wireHeader{first: first, end: end, lines: lines}
+	first = trimEOL(first)
+	method, rest := cutByte(first, ' ')
+	requestURI, proto := cutByte(rest, ' ')
+	if len(method) == 0 || len(requestURI) == 0 {
+		return errors.Errorf("invalid request line %q", first)
+	}
+	h.SetMethodBytes(method)
+	h.SetRequestURIBytes(requestURI)
+	switch {
+	case bytes.Equal(proto, strHTTP11):
+	case bytes.Equal(proto, strHTTP10), len(proto) == 0:
+		h.noHTTP11 = true
+	default:
+		return errors.Errorf("unsupported protocol %q", proto)
+	}
+	h.contentLength = -1
+	for _, kv := range lines {
+		h.Add(string(kv.key), string(kv.value))
+	}
+	if len(h.contentLengthBytes) == 0 && !h.chunked() {
+		h.contentLength = 0
+	}
+	h.rawHeaders = raw
+	wire.state = appendHeaderLines(h.appendRequestLine(nil), visitLines(h.VisitAll))
+	h.wire = wire
+	return nil
+}
+
+func (h *RequestHeader) chunked() bool {
+	return bytes.Contains(bytes.ToLower(h.Peek("Transfer-Encoding")), []byte("chunked"))
+}
+
+// Read parses a status line and headers from r, up to and including the
+// empty line that ends them. The body is left unread. io.EOF is returned if
+// r is empty.
+func (h *ResponseHeader) Read(r *bufio.Reader) error {
+	h.Reset()
+	first, lines, raw, end, err := readHeaderBlock(r)
+	if err != nil {
+		return err
+	}
+	wire := &wireHeader{first: first, end: end, lines: lines}
+	first = trimEOL(first)
+	proto, rest := cutByte(first, ' ')
+	code, message := cutByte(rest, ' ')
+	switch {
+	case bytes.Equal(proto, strHTTP11):
+	case bytes.Equal(proto, strHTTP10):
+		h.noHTTP11 = true
+	default:
+		return errors.Errorf("invalid status line %q", first)
+	}
+	statusCode, err := strconv.Atoi(string(code))
+	if err != nil || len(code) != 3 || statusCode < 100 {
+		return errors.Errorf("invalid status code in %q", first)
+	}
+	h.SetStatusCode(statusCode)
+	h.SetStatusMessage(message)
+	h.contentLength = -1
+	for _, kv := range lines {
+		h.Add(string(kv.key), string(kv.value))
+	}
+	// Only report the Content-Type the message actually has.
+	h.noDefaultContentType = h.noDefaultContentType || len(h.contentType) == 0
+	h.rawHeaders = raw
+	wire.state = appendHeaderLines(h.appendStatusLine(nil), visitLines(h.VisitAll))
+	h.wire = wire
+	return nil
+}
+
+// readHeaderBlock reads the first line and the header lines of a message.
+// first and end are the first and the empty last line as read. raw holds
+// the header lines as read, without those.
+func readHeaderBlock(r *bufio.Reader) (first []byte, lines []argsKV, raw, end []byte, err error) {
+	var size int
+	readLine := func() ([]byte, error) {
+		line, err := r.ReadSlice('\n')
+		size += len(line)
+		if size > MaxHeaderBytes {
+			return nil, errors.New("header too large")
+		}
+		if err == bufio.ErrBufferFull {
+			// Lines longer than the reader buffer are assembled in a copy.
+			long := append([]byte(nil), line...)
+			for err == bufio.ErrBufferFull {
+				line, err = r.ReadSlice('\n')
+				size += len(line)
+				if size > MaxHeaderBytes {
+					return nil, errors.New("header too large")
+				}
+				long = append(long, line...)
+			}
+			line = long
+		}
+		return line, err
+	}
+
+	line, err := readLine()
+	if err != nil {
+		if err == io.EOF && len(line) == 0 {
+			return nil, nil, nil, nil, io.EOF
+		}
+		return nil, nil, nil, nil, wrapReadError(err)
+	}
+	first = append([]byte(nil), line...)
+	for {
+		line, err := readLine()
+		if err != nil {
+			return nil, nil, nil, nil, wrapReadError(err)
+		}
+		content := trimEOL(line)
+		if len(content) == 0 {
+			return first, lines, raw, append([]byte(nil), line...), nil
+		}
+		raw = append(raw, line...)
+		if content[0] == ' ' || content[0] == '\t' {
+			// obs-fold continues the previous value, see RFC 7230 3.2.4.
+			if len(lines) == 0 {
+				return nil, nil, nil, nil, errors.Errorf("invalid header line %q", content)
+			}
+			kv := &lines[len(lines)-1]
+			if folded := bytes.Trim(content, " \t"); len(folded) > 0 {
+				if len(kv.value) > 0 {
+					kv.value = append(kv.value, ' ')
+				}
+				kv.value = append(kv.value, folded...)
+			}
+			continue
+		}
+		i := bytes.IndexByte(content, ':')
+		if i <= 0 || bytes.ContainsAny(content[:i], " \t") {
+			return nil, nil, nil, nil, errors.Errorf("invalid header line %q", content)
+		}
+		lines = append(lines, argsKV{
+			key:   append([]byte(nil), content[:i]...),
+			value: append([]byte(nil), bytes.Trim(content[i+1:], " \t")...),
+		})
+	}
+}
+
+func wrapReadError(err error) error {
+	if err == io.EOF {
+		err = io.ErrUnexpectedEOF
+	}
+	return errors.Wrap(err, "failed to read header")
+}
+
+func hasArgFold(h []argsKV, key []byte) bool {
+	for i := range h {
+		if bytes.EqualFold(h[i].key, key) {
+			return true
+		}
+	}
+	return false
+}
+
+// visitLines returns copies of the header lines visited by visitAll.
+func visitLines(visitAll func(func(key, value []byte))) []argsKV {
+	var lines []argsKV
+	visitAll(func(key, value []byte) {
+		lines = appendArgBytes(lines, key, value)
+	})
+	return lines
+}
+
+func appendHeaderLines(dst []byte, lines []argsKV) []byte {
+	for _, kv := range lines {
+		dst = appendHeaderLine(dst, kv.key, kv.value)
+	}
+	return dst
+}
+
+func appendHeaderLine(dst, key, value []byte) []byte {
+	dst = append(dst, key...)
+	dst = append(dst, strColonSpace...)
+	dst = append(dst, value...)
+	return append(dst, strCRLF...)
+}
+
+func trimEOL(line []byte) []byte {
+	line = bytes.TrimSuffix(line, []byte("\n"))
+	return bytes.TrimSuffix(line, []byte("\r"))
+}
+
+// cutByte splits b around the first c.
+func cutByte(b []byte, c byte) (before, after []byte) {
+	if i := bytes.IndexByte(b, c); i >= 0 {
+		return b[:i], b[i+1:]
+	}
+	return b, nil
+}
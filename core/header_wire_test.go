@@ -0,0 +1,174 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestRequestHeader_ReadWrite(t *testing.T) {
+	require := require.New(t)
+	raw := "POST /login?next=%2F HTTP/1.1\r\n" +
+		"Host: example.com\r\n" +
+		"content-type: application/x-www-form-urlencoded\r\n" +
+		"Content-Length: 7\r\n" +
+		"X-Folded: first\r\n" +
+		"  second\r\n" +
+		"Cookie: a=1; b=2\r\n" +
+		"\r\n" +
+		"user=me"
+	br := bufio.NewReader(strings.NewReader(raw))
+	h := &RequestHeader{}
+	require.NoError(h.Read(br))
+	require.True(h.IsPost())
+	require.True(h.IsHTTP11())
+	require.Equal("/login?next=%2F", string(h.RequestURI()))
+	require.Equal("example.com", string(h.Host()))
+	require.Equal("application/x-www-form-urlencoded", string(h.ContentType()))
+	require.Equal(7, h.ContentLength())
+	require.Equal("first second", string(h.Peek("X-Folded")))
+	require.Equal("2", string(h.Cookie("b")))
+	require.Contains(string(h.RawHeaders()), "X-Folded: first\r\n  second\r\n")
+
+	body, err := io.ReadAll(br)
+	require.NoError(err)
+	require.Equal("user=me", string(body))
+
+	// The header is written back exactly as read.
+	require.Equal(strings.TrimSuffix(raw, "user=me"), h.String())
+
+	var b bytes.Buffer
+	n, err := h.WriteTo(&b)
+	require.NoError(err)
+	require.Equal(int64(b.Len()), n)
+	require.Equal(h.String(), b.String())
+
+	// Once modified, it keeps the order and key spelling of the wire.
+	h.SetContentType("text/plain")
+	h.Add("X-Added", "1")
+	require.Equal("POST /login?next=%2F HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"content-type: text/plain\r\n"+
+		"Content-Length: 7\r\n"+
+		"X-Folded: first second\r\n"+
+		"Cookie: a=1; b=2\r\n"+
+		"X-Added: 1\r\n"+
+		"\r\n", h.String())
+	h.Del("Content-Type")
+	h.SetMethod("PUT")
+	require.Equal("PUT /login?next=%2F HTTP/1.1\r\n"+
+		"Host: example.com\r\n"+
+		"Content-Length: 7\r\n"+
+		"X-Folded: first second\r\n"+
+		"Cookie: a=1; b=2\r\n"+
+		"X-Added: 1\r\n"+
+		"\r\n", h.String())
+}
+
+func TestRequestHeader_ReadWriteExact(t *testing.T) {
+	require := require.New(t)
+	for _, raw := range []string{
+		"GET / HTTP/1.1\r\nhost: example.com\r\nX-Spaced:   v  \r\n\r\n",
+		"GET / HTTP/1.1\nHost: example.com\nConnection: Close\n\n",
+		"GET /old\r\nCookie: a=1\r\ncookie: b=2\r\n\r\n",
+	} {
+		h := &RequestHeader{}
+		require.NoError(h.Read(bufio.NewReader(strings.NewReader(raw))), raw)
+		require.Equal(raw, h.String())
+	}
+}
+
+func TestRequestHeader_ReadDisableNormalizing(t *testing.T) {
+	require := require.New(t)
+	h := &RequestHeader{}
+	h.DisableNormalizing()
+	require.NoError(h.Read(bufio.NewReader(strings.NewReader("GET / HTTP/1.0\r\nx-lower-CASE: v\r\n\r\n"))))
+	require.False(h.IsHTTP11())
+	require.Equal("GET / HTTP/1.0\r\nx-lower-CASE: v\r\n\r\n", h.String())
+
+	// Reset keeps the setting.
+	require.NoError(h.Read(bufio.NewReader(strings.NewReader("GET / HTTP/1.1\r\nx-other: v\r\n\r\n"))))
+	require.Equal("v", string(h.Peek("x-other")))
+}
+
+func TestRequestHeader_ReadErrors(t *testing.T) {
+	require := require.New(t)
+	h := &RequestHeader{}
+	require.Equal(io.EOF, h.Read(bufio.NewReader(strings.NewReader(""))))
+	for _, raw := range []string{
+		"GET / HTTP/1.1\r\nHost: example.com\r\n",
+		"GET\r\n\r\n",
+		"GET / SPDY/3\r\n\r\n",
+		"GET / HTTP/1.1\r\nBad Key: v\r\n\r\n",
+		"GET / HTTP/1.1\r\n folded\r\n\r\n",
+		"GET / HTTP/1.1\r\nX-Long: " + strings.Repeat("a", MaxHeaderBytes) + "\r\n\r\n",
+	} {
+		require.Error(h.Read(bufio.NewReader(strings.NewReader(raw))), raw)
+	}
+}
+
+func TestResponseHeader_ReadWrite(t *testing.T) {
+	require := require.New(t)
+	raw := "HTTP/1.1 404 Nope\r\n" +
+		"Server: nginx\r\n" +
+		"Date: Mon, 02 Jan 2006 15:04:05 GMT\r\n" +
+		"Set-Cookie: a=1; Path=/\r\n" +
+		"Set-Cookie: b=2\r\n" +
+		"Connection: close\r\n" +
+		"\r\n"
+	h := &ResponseHeader{}
+	require.NoError(h.Read(bufio.NewReader(strings.NewReader(raw))))
+	require.Equal(404, h.StatusCode())
+	require.True(h.ConnectionClose())
+	require.Equal(-1, h.ContentLength())
+	// No Content-Type was sent, so none is added.
+	require.Empty(h.ContentType())
+	require.Equal("a=1; Path=/", string(h.Cookie("a")))
+	require.Equal("Nope", string(h.StatusMessage()))
+	require.Equal(raw, h.String())
+
+	h.Set("server", "envoy")
+	require.Equal("HTTP/1.1 404 Nope\r\n"+
+		"Server: envoy\r\n"+
+		"Date: Mon, 02 Jan 2006 15:04:05 GMT\r\n"+
+		"Set-Cookie: a=1; Path=/\r\n"+
+		"Set-Cookie: b=2\r\n"+
+		"Connection: close\r\n"+
+		"\r\n", h.String())
+	h.SetStatusCode(410)
+	require.True(strings.HasPrefix(h.String(), "HTTP/1.1 410 Gone\r\n"))
+}
+
+func TestResponseHeader_ReadWriteExact(t *testing.T) {
+	require := require.New(t)
+	h := &ResponseHeader{}
+	h.DisableNormalizing()
+	for _, raw := range []string{
+		"HTTP/1.1 200 OK\r\ncontent-type: text/html\r\nx-lower: v\r\ncontent-length: 0\r\n\r\n",
+		"HTTP/1.0 599\r\nSet-Cookie: id=a; Path=/\r\nSet-Cookie: id=b; Path=/admin\r\n\r\n",
+		"HTTP/1.1 302 Moved  Elsewhere\nLocation: /\nX-Folded: a\n\tb\n\n",
+	} {
+		require.NoError(h.Read(bufio.NewReader(strings.NewReader(raw))), raw)
+		require.Equal(raw, h.String())
+	}
+}
+
+func TestResponseHeader_Defaults(t *testing.T) {
+	require := require.New(t)
+	h := &ResponseHeader{}
+	h.SetContentLength(2)
+	out := h.String()
+	require.True(strings.HasPrefix(out, "HTTP/1.1 200 OK\r\nDate: "), out)
+	require.Contains(out, "Content-Type: text/plain; charset=utf-8\r\n")
+
+	h.SetNoDefaultDate(true)
+	h.SetNoDefaultContentType(true)
+	require.Equal("HTTP/1.1 200 OK\r\nContent-Length: 2\r\n\r\n", h.String())
+
+	require.Error(h.Read(bufio.NewReader(strings.NewReader("HTTP/1.1 2000 OK\r\n\r\n"))))
+	require.Error(h.Read(bufio.NewReader(strings.NewReader("ICY 200 OK\r\n\r\n"))))
+}
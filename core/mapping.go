@@ -0,0 +1,38 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"net/url"
+)
+
+type upstreamURLKey struct{}
+
+// WithUpstreamURL returns r set up to be proxied to the scheme and host of
+// target instead of the host it is addressed to. The Host header is kept,
+// so cookies and virtual hosts work as they do for the original host.
+func WithUpstreamURL(r *http.Request, target *url.URL) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), upstreamURLKey{}, target))
+}
+
+func upstreamURL(ctx context.Context) *url.URL {
+	target, _ := ctx.Value(upstreamURLKey{}).(*url.URL)
+	return target
+}
+
+type responderKey struct{}
+
+// Responder answers a request in place of its origin.
+type Responder func(r *http.Request) *http.Response
+
+// WithResponder returns r set up to be answered by respond instead of being
+// proxied. The response goes through the Mux like one from an origin, so
+// it is recorded and handed to the executors the same way.
+func WithResponder(r *http.Request, respond Responder) *http.Request {
+	return r.WithContext(context.WithValue(r.Context(), responderKey{}, respond))
+}
+
+func responder(ctx context.Context) Responder {
+	respond, _ := ctx.Value(responderKey{}).(Responder)
+	return respond
+}
@@ -1,38 +1,90 @@
 package core
 
 import (
-	"bytes"
-	"context"
-	"crypto/tls"
-	"fmt"
 	"io"
 	"log"
-	"net"
+	"mime"
 	"net/http"
-	"time"
+	"sync"
 
-	"github.com/lucas-clemente/quic-go"
-	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/millken/httpctl/certer"
+	"github.com/millken/httpctl/config"
 	"github.com/millken/httpctl/resolver"
+	"github.com/millken/httpctl/upstream"
 	"github.com/pkg/errors"
-	"golang.org/x/net/http2"
 )
 
 type Mux struct {
 	resolver *resolver.Resolver
+	certCA   *certer.CertCA
+	dialer   *upstream.Dialer
+	// transport is shared by all proxied requests so upstream connections
+	// are kept alive and reused.
+	transport *protocolTransport
+	client    *http.Client
+	// stripAltSvc removes Alt-Svc from responses so clients keep using the
+	// TCP listeners when HTTP/3 is not intercepted.
+	stripAltSvc bool
+	forward     config.Forward
+	executor    Executor
+
+	flowHandlers []FlowHandler
+	breakpoints  *Breakpoints
+
+	wsInspect    bool
+	wsMaxPayload int
+	wsHandlers   []WebSocketHandler
 	// The middleware stack
 	middlewares []func(http.Handler) http.Handler
 }
 
-func NewMux(resolver *resolver.Resolver) *Mux {
+func NewMux(cfg config.Server, resolver *resolver.Resolver, certCA *certer.CertCA) (*Mux, error) {
+	dialer, err := upstream.NewDialer(cfg.Proxy, cfg.ProxyRules, resolver)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to init upstream dialer")
+	}
+	transport, err := newProtocolTransport(cfg, dialer)
+	if err != nil {
+		return nil, err
+	}
 	mux := &Mux{
-		resolver: resolver,
+		resolver:     resolver,
+		certCA:       certCA,
+		dialer:       dialer,
+		transport:    transport,
+		stripAltSvc:  cfg.Http3.Listen == "" && cfg.Http3.StripAltSvc,
+		forward:      cfg.Forward,
+		wsInspect:    cfg.WebSocket.Inspect,
+		wsMaxPayload: cfg.WebSocket.MaxPayload,
+		client: &http.Client{
+			Transport: transport,
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
 	}
-	return mux
+	return mux, nil
+}
+
+// Transport returns the pooled upstream transport used by the Mux.
+func (mx *Mux) Transport() http.RoundTripper {
+	return mx.transport
+}
+
+// Close releases idle upstream connections.
+func (mx *Mux) Close() {
+	mx.transport.CloseIdleConnections()
 }
 
 // ServeHTTP is the single method of the http.Handler interface
 func (mx *Mux) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	// CONNECT is answered before the middleware chain, which may wrap the
+	// ResponseWriter in a way that cannot be hijacked.
+	if r.Method == MethodConnect {
+		mx.handleConnect(w, r)
+		return
+	}
+	r = mx.startFlow(r)
 	Chain(mx.middlewares...).Handler(mx.proxyHandler()).ServeHTTP(w, r)
 }
 
@@ -44,146 +96,101 @@ func (mx *Mux) Use(middlewares ...func(http.Handler) http.Handler) {
 //curl https://babel-api.mainnet.iotex.io  -H "User-Agent: Mozilla/5.0 (Macintosh; Intel Mac OS X 10_15_7) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/102.0.0.0 Safari/537.36" -v --http2-prior-knowledge
 func (mx *Mux) proxyHandler() http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		// Read the content
-		var rBytes []byte
+		if isWebSocketUpgrade(r) {
+			mx.handleWebSocket(w, r)
+			return
+		}
+		fr := flowRecorderFromContext(r.Context())
 		var err error
-		if r.Body != nil {
-			rBytes, err = io.ReadAll(r.Body)
-			if err != nil {
-				log.Printf("Failed to read request body: %v", err)
+		if mx.breakpoints != nil {
+			if r, err = mx.breakpoints.holdRequest(r); err != nil {
+				mx.abortFlow(w, fr, err)
 				return
 			}
-			r.Body = io.NopCloser(bytes.NewBuffer(rBytes))
 		}
+		// The request body is streamed upstream as the client sends it.
 		response, err := mx.handleHTTP(r)
 		if err != nil {
+			if fr != nil {
+				mx.finishFlow(fr, nil, err)
+			}
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
-		//r.Body has been read, so we can renew it.
-		if r.Body != nil {
-			r.Body = io.NopCloser(bytes.NewBuffer(rBytes))
+		reportProto(r.Context(), response.Proto)
+		if mx.breakpoints != nil {
+			if err = mx.breakpoints.holdResponse(r, response); err != nil {
+				response.Body.Close()
+				mx.abortFlow(w, fr, err)
+				return
+			}
 		}
+		if fr != nil {
+			fr.recordResponse(response)
+		}
+		mx.executeBody(r, response)
+		defer response.Body.Close()
 
+		// Headers must be in place before WriteHeader now that the body is
+		// no longer buffered by the logging middleware.
+		mx.copyResponseHeader(w, r, response)
 		w.WriteHeader(response.StatusCode)
-		for name, values := range response.Header {
-			w.Header()[name] = values
+		if len(response.Trailer) > 0 {
+			// Force chunking so the trailers can follow the body.
+			if f, ok := w.(http.Flusher); ok {
+				f.Flush()
+			}
 		}
-		// bodyBuff, _ := io.ReadAll(response.Body)
-		// w.Write(bodyBuff)
-		defer response.Body.Close()
-		if _, err := io.Copy(w, response.Body); err != nil {
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+		if _, err = copyBody(w, response); err != nil {
+			log.Printf("Failed to copy response body: %v", err)
+		} else {
+			copyTrailer(w, response)
+		}
+		if fr != nil {
+			mx.finishFlow(fr, response, err)
 		}
 	}
 }
 
-func (mx *Mux) handleHTTP(r *http.Request) (*http.Response, error) {
-	// ips, _, err := mx.resolver.Lookup(r.Host)
-	// if err != nil {
-	// 	return nil, err
-	// }
-	if r.TLS == nil {
-		r.URL.Scheme = "http"
-	} else {
-		r.URL.Scheme = "https"
-	}
-	r.URL.Host = r.Host
-	r.RequestURI = ""
-
-	client := &http.Client{
-		Transport: CreateHTTPTransport(nil),
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
+// abortFlow answers a flow aborted at a breakpoint.
+func (mx *Mux) abortFlow(w http.ResponseWriter, fr *flowRecorder, err error) {
+	if fr != nil {
+		mx.finishFlow(fr, nil, err)
 	}
-	return client.Do(r)
+	http.Error(w, err.Error(), http.StatusBadGateway)
 }
 
-func (mx *Mux) handleHTTP2(r *http.Request) (*http.Response, error) {
-	if r.TLS == nil {
-		return nil, fmt.Errorf("http2 only support https")
+// copyBody streams the response body to the client. Event streams and
+// responses of unknown length are flushed after every read so long-polls and
+// SSE are not held back by buffering.
+func copyBody(w http.ResponseWriter, response *http.Response) (int64, error) {
+	var dst io.Writer = w
+	if f, ok := w.(http.Flusher); ok && isStreaming(response) {
+		dst = flushWriter{w: w, f: f}
 	}
-
-	ips, _, err := mx.resolver.Lookup(r.Host)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to lookup host '%s'", r.Host)
-	}
-	r.URL.Scheme = "https"
-	r.RequestURI = ""
-	conf := &tls.Config{
-		NextProtos: []string{"h2"},
-		ServerName: r.Host,
-	}
-	host, port := ips[0], r.URL.Port()
-	if port == "" {
-		port = "443"
-	}
-	dialHost := net.JoinHostPort(host, port)
-
-	dialer := &net.Dialer{
-		Timeout:   30 * time.Second,
-		KeepAlive: 60 * time.Second,
-		DualStack: true,
-	}
-	tcpConn, err := tls.DialWithDialer(dialer, "tcp", dialHost, conf)
-	if err != nil {
-		return nil, errors.Wrapf(err, "failed to dial host '%s'", dialHost)
-	}
-	defer tcpConn.Close()
-
-	t := http2.Transport{}
-	http2ClientConn, err := t.NewClientConn(tcpConn)
-	if err != nil {
-		return nil, errors.Wrap(err, "failed to new client conn")
-	}
-
-	return http2ClientConn.RoundTrip(r)
+	buf := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(buf)
+	return io.CopyBuffer(dst, response.Body, *buf)
 }
 
-func (mx *Mux) handleHTTP3(r *http.Request) (*http.Response, error) {
-	if r.TLS == nil {
-		return nil, fmt.Errorf("http2 only support https")
+func isStreaming(response *http.Response) bool {
+	if response.ContentLength == -1 {
+		return true
 	}
+	mediaType, _, _ := mime.ParseMediaType(response.Header.Get("Content-Type"))
+	return mediaType == "text/event-stream"
+}
 
-	r.URL.Scheme = "https"
-	r.URL.Host = r.Host
-	r.RequestURI = ""
-
-	var qconf quic.Config
-
-	roundTripper := &http3.RoundTripper{
-		Dial: func(ctx context.Context, network, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
-			host, port, _ := net.SplitHostPort(addr)
-			ips, _, err := mx.resolver.Lookup(host)
-			if err != nil {
-				return nil, err
-			}
-			if port == "" {
-				port = "443"
-			}
-			dialHost := net.JoinHostPort(ips[0], port)
-			udpAddr, err := net.ResolveUDPAddr("udp", dialHost)
-			if err != nil {
-				return nil, err
-			}
-			udpConn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
-			if err != nil {
-				return nil, err
-			}
+var copyBufPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 32*1024)
+		return &b
+	},
+}
 
-			return quic.DialEarly(udpConn, udpAddr, r.Host, tlsCfg, cfg)
-		},
-		TLSClientConfig: &tls.Config{
-			InsecureSkipVerify: true,
-		},
-		QuicConfig: &qconf,
-	}
-	defer roundTripper.Close()
-	hclient := &http.Client{
-		Transport: roundTripper,
+func (mx *Mux) handleHTTP(r *http.Request) (*http.Response, error) {
+	if respond := responder(r.Context()); respond != nil {
+		return respond(r), nil
 	}
-
-	return hclient.Do(r)
+	return mx.client.Do(mx.outgoingRequest(r))
 }
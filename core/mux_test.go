@@ -0,0 +1,119 @@
+package core
+
+import (
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+
+	"github.com/millken/httpctl/config"
+	"github.com/stretchr/testify/require"
+)
+
+func newTestMux(t testing.TB, cfg config.Server) *Mux {
+	mx, err := NewMux(cfg, nil, nil)
+	require.NoError(t, err)
+	return mx
+}
+
+func newTestOrigin(handler http.HandlerFunc) *httptest.Server {
+	if handler == nil {
+		handler = func(w http.ResponseWriter, r *http.Request) {
+			io.WriteString(w, "hello")
+		}
+	}
+	return httptest.NewServer(handler)
+}
+
+func serveMux(mx *Mux, method, target string, body io.Reader) *httptest.ResponseRecorder {
+	rec := httptest.NewRecorder()
+	mx.ServeHTTP(rec, httptest.NewRequest(method, target, body))
+	return rec
+}
+
+func TestMux_ReusesUpstreamConnections(t *testing.T) {
+	require := require.New(t)
+	var conns int32
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, "hello")
+	}))
+	origin.Config.ConnState = func(c net.Conn, state http.ConnState) {
+		if state == http.StateNew {
+			atomic.AddInt32(&conns, 1)
+		}
+	}
+	origin.Start()
+	defer origin.Close()
+
+	mx := newTestMux(t, config.Server{})
+	defer mx.Close()
+	for i := 0; i < 5; i++ {
+		rec := serveMux(mx, http.MethodGet, origin.URL+"/", nil)
+		require.Equal(http.StatusOK, rec.Code)
+		require.Equal("hello", rec.Body.String())
+	}
+	require.Equal(int32(1), atomic.LoadInt32(&conns))
+}
+
+func TestMux_StreamsEventStream(t *testing.T) {
+	require := require.New(t)
+	release := make(chan struct{})
+	origin := newTestOrigin(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		io.WriteString(w, "data: first\n\n")
+		w.(http.Flusher).Flush()
+		<-release
+		io.WriteString(w, "data: second\n\n")
+	})
+	defer origin.Close()
+	defer close(release)
+
+	mx := newTestMux(t, config.Server{})
+	defer mx.Close()
+	proxy := httptest.NewServer(mx)
+	defer proxy.Close()
+
+	req, _ := http.NewRequest(http.MethodGet, proxy.URL+"/events", nil)
+	req.Host = origin.Listener.Addr().String()
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(err)
+	defer res.Body.Close()
+	require.Equal("text/event-stream", res.Header.Get("Content-Type"))
+
+	// The first event must arrive while the origin is still holding the
+	// response open.
+	buf := make([]byte, len("data: first\n\n"))
+	_, err = io.ReadFull(res.Body, buf)
+	require.NoError(err)
+	require.Equal("data: first\n\n", string(buf))
+}
+
+func benchmarkMux(b *testing.B, mx *Mux) {
+	origin := newTestOrigin(nil)
+	defer origin.Close()
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rec := serveMux(mx, http.MethodGet, origin.URL+"/", nil)
+		if rec.Code != http.StatusOK {
+			b.Fatalf("unexpected status %d", rec.Code)
+		}
+	}
+}
+
+func BenchmarkMux_PooledTransport(b *testing.B) {
+	mx := newTestMux(b, config.Server{})
+	defer mx.Close()
+	benchmarkMux(b, mx)
+}
+
+// BenchmarkMux_NoKeepAlive measures the former behaviour of dialing a new
+// upstream connection for every request.
+func BenchmarkMux_NoKeepAlive(b *testing.B) {
+	mx := newTestMux(b, config.Server{})
+	defer mx.Close()
+	mx.transport.auto.DisableKeepAlives = true
+	benchmarkMux(b, mx)
+}
@@ -0,0 +1,243 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/log"
+	"github.com/millken/httpctl/upstream"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+	"golang.org/x/net/http2"
+)
+
+// Upstream protocols that can be forced per host.
+const (
+	ProtocolAuto  = "auto"
+	ProtocolHTTP1 = "h1"
+	ProtocolHTTP2 = "h2"
+	ProtocolHTTP3 = "h3"
+)
+
+type protocolRule struct {
+	hosts    []string
+	protocol string
+}
+
+// protocolTransport selects the upstream protocol for each origin. HTTP/2 is
+// negotiated with ALPN, HTTP/3 is used once an origin advertised it with
+// Alt-Svc, and per-host rules may force any of h1, h2 or h3. Plain http://
+// origins always use HTTP/1.1.
+type protocolTransport struct {
+	dialer *upstream.Dialer
+	auto   *http.Transport
+	h1     *http.Transport
+	h2     *http.Transport
+	h3     *http3.RoundTripper
+	altSvc *altSvcCache
+	rules  []protocolRule
+	log    *zap.Logger
+
+	udpOnce sync.Once
+	udpConn net.PacketConn
+	udpErr  error
+}
+
+func newProtocolTransport(cfg config.Server, dialer *upstream.Dialer) (*protocolTransport, error) {
+	auto := CreateHTTPTransport(cfg.Transport, dialer)
+	auto.ForceAttemptHTTP2 = true
+	h1 := CreateHTTPTransport(cfg.Transport, dialer)
+	// A non-nil empty map disables HTTP/2.
+	h1.TLSNextProto = make(map[string]func(string, *tls.Conn) http.RoundTripper)
+
+	h2 := CreateHTTPTransport(cfg.Transport, dialer)
+	h2.ForceAttemptHTTP2 = true
+
+	t := &protocolTransport{
+		dialer: dialer,
+		auto:   auto,
+		h1:     h1,
+		h2:     h2,
+		altSvc: newAltSvcCache(),
+		log:    log.Logger("mux"),
+	}
+	h2.DialTLSContext = t.dialTLS
+	t.h3 = &http3.RoundTripper{
+		TLSClientConfig: auto.TLSClientConfig,
+		QuicConfig:      &quic.Config{},
+		Dial:            t.dialQUIC,
+	}
+	for _, r := range cfg.Protocols {
+		switch r.Protocol {
+		case ProtocolAuto, ProtocolHTTP1, ProtocolHTTP2, ProtocolHTTP3:
+		default:
+			return nil, errors.Errorf("unknown protocol '%s'", r.Protocol)
+		}
+		t.rules = append(t.rules, protocolRule{hosts: r.Hosts, protocol: r.Protocol})
+	}
+	return t, nil
+}
+
+// protocol returns the protocol configured for host, or ProtocolAuto.
+func (t *protocolTransport) protocol(host string) string {
+	for _, r := range t.rules {
+		for _, pattern := range r.hosts {
+			if upstream.MatchHost(pattern, host) {
+				return r.protocol
+			}
+		}
+	}
+	return ProtocolAuto
+}
+
+func (t *protocolTransport) RoundTrip(r *http.Request) (*http.Response, error) {
+	if r.URL.Scheme != "https" {
+		return t.auto.RoundTrip(r)
+	}
+	host, origin := r.URL.Hostname(), canonicalAddr(r.URL)
+	switch t.protocol(host) {
+	case ProtocolHTTP1:
+		return t.h1.RoundTrip(r)
+	case ProtocolHTTP2:
+		return t.h2.RoundTrip(r)
+	case ProtocolHTTP3:
+		if t.dialer.Proxy(host).IsDirect() {
+			return t.h3.RoundTrip(r)
+		}
+		t.log.Warn("h3 is not possible through an upstream proxy", zap.String("host", host))
+	default:
+		if _, ok := t.altSvc.Lookup(origin); ok && t.dialer.Proxy(host).IsDirect() {
+			res, err := t.h3.RoundTrip(r)
+			if err == nil {
+				return res, nil
+			}
+			// The origin is not tried over h3 again until it advertises
+			// it anew, even if this request can't fall back.
+			t.altSvc.Delete(origin)
+			if !isReplayable(r) {
+				return nil, err
+			}
+			t.log.Debug("h3 failed, falling back", zap.String("origin", origin), zap.Error(err))
+		}
+	}
+	res, err := t.auto.RoundTrip(r)
+	if err == nil {
+		t.altSvc.Update(origin, res.Header.Get("Alt-Svc"))
+	}
+	return res, err
+}
+
+// CloseIdleConnections closes idle connections of every protocol.
+func (t *protocolTransport) CloseIdleConnections() {
+	t.auto.CloseIdleConnections()
+	t.h1.CloseIdleConnections()
+	t.h2.CloseIdleConnections()
+	t.h3.Close()
+}
+
+// dialTLS opens a TLS connection for the forced HTTP/2 transport and makes
+// sure the origin agreed to speak h2. ctx is the one of the request
+// needing the connection.
+func (t *protocolTransport) dialTLS(ctx context.Context, network, addr string) (net.Conn, error) {
+	conn, err := t.h2.DialContext(ctx, network, addr)
+	if err != nil {
+		return nil, err
+	}
+	cfg := &tls.Config{}
+	if t.h2.TLSClientConfig != nil {
+		cfg = t.h2.TLSClientConfig.Clone()
+	}
+	if cfg.ServerName == "" {
+		cfg.ServerName, _, _ = net.SplitHostPort(addr)
+	}
+	cfg.NextProtos = []string{http2.NextProtoTLS}
+	tlsConn := tls.Client(conn, cfg)
+	if err := tlsConn.HandshakeContext(ctx); err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "failed to handshake with '%s'", addr)
+	}
+	if proto := tlsConn.ConnectionState().NegotiatedProtocol; proto != http2.NextProtoTLS {
+		tlsConn.Close()
+		return nil, errors.Errorf("'%s' does not support h2, negotiated '%s'", addr, proto)
+	}
+	return tlsConn, nil
+}
+
+// dialEarlyQUIC dials QUIC connections, it is replaced by tests.
+var dialEarlyQUIC = quic.DialEarlyContext
+
+// dialQUIC resolves addr with the custom resolver and dials it over a UDP
+// socket shared by all HTTP/3 connections, trying each resolved IP in turn
+// like the TCP dialer. The port advertised by Alt-Svc takes precedence over
+// the port of the request URL.
+func (t *protocolTransport) dialQUIC(ctx context.Context, network, addr string, tlsCfg *tls.Config, cfg *quic.Config) (quic.EarlyConnection, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if altPort, ok := t.altSvc.Lookup(addr); ok {
+		port = altPort
+	}
+	ips := []string{host}
+	if net.ParseIP(host) == nil {
+		if ips, err = t.dialer.Lookup(host); err != nil {
+			return nil, err
+		}
+	}
+	t.udpOnce.Do(func() {
+		t.udpConn, t.udpErr = net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4zero, Port: 0})
+	})
+	if t.udpErr != nil {
+		return nil, errors.Wrap(t.udpErr, "failed to listen on udp")
+	}
+	var lastErr error
+	for _, ip := range ips {
+		var udpAddr *net.UDPAddr
+		udpAddr, lastErr = net.ResolveUDPAddr("udp", net.JoinHostPort(ip, port))
+		if lastErr != nil {
+			continue
+		}
+		conn, err := dialEarlyQUIC(ctx, t.udpConn, udpAddr, host, tlsCfg, cfg)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// canonicalAddr returns the host:port of u, adding the default port of its
+// scheme if missing.
+func canonicalAddr(u *url.URL) string {
+	port := u.Port()
+	if port == "" {
+		port = "80"
+		if u.Scheme == "https" {
+			port = "443"
+		}
+	}
+	return net.JoinHostPort(u.Hostname(), port)
+}
+
+// isReplayable returns true if r can be sent again after a failed attempt.
+func isReplayable(r *http.Request) bool {
+	if r.ContentLength != 0 && r.Body != nil && r.Body != http.NoBody && r.GetBody == nil {
+		return false
+	}
+	switch strings.ToUpper(r.Method) {
+	case MethodGet, MethodHead, MethodOptions, MethodTrace:
+		return true
+	}
+	return false
+}
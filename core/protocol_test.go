@@ -0,0 +1,193 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/lucas-clemente/quic-go"
+	"github.com/miekg/dns"
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/resolver"
+	"github.com/millken/httpctl/upstream"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestAltSvcCache(t *testing.T) {
+	require := require.New(t)
+	c := newAltSvcCache()
+
+	c.Update("example.com:443", `h3-29=":443", h3=":8443"; ma=3600`)
+	port, ok := c.Lookup("example.com:443")
+	require.True(ok)
+	require.Equal("8443", port)
+
+	c.Update("example.com:443", "clear")
+	_, ok = c.Lookup("example.com:443")
+	require.False(ok)
+
+	c.Update("other.com:443", `h3="alt.other.com:443"`)
+	_, ok = c.Lookup("other.com:443")
+	require.False(ok)
+
+	c.Update("expired.com:443", `h3=":443"; ma=0`)
+	_, ok = c.Lookup("expired.com:443")
+	require.False(ok)
+}
+
+func TestProtocolTransport(t *testing.T) {
+	require := require.New(t)
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Alt-Svc", `h3=":443"`)
+	}))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	defer origin.Close()
+
+	dialer, err := upstream.NewDialer("", nil, nil)
+	require.NoError(err)
+
+	tests := []struct {
+		protocol string
+		proto    string
+	}{
+		{ProtocolAuto, "HTTP/2.0"},
+		{ProtocolHTTP1, "HTTP/1.1"},
+		{ProtocolHTTP2, "HTTP/2.0"},
+	}
+	for _, tt := range tests {
+		tr, err := newProtocolTransport(config.Server{
+			Transport: config.Transport{InsecureSkipVerify: true},
+			Protocols: []config.ProtocolRule{{Hosts: []string{"127.0.0.1"}, Protocol: tt.protocol}},
+		}, dialer)
+		require.NoError(err)
+		req, _ := http.NewRequest(http.MethodGet, origin.URL, nil)
+		res, err := tr.RoundTrip(req)
+		require.NoError(err, tt.protocol)
+		res.Body.Close()
+		require.Equal(tt.proto, res.Proto, tt.protocol)
+		tr.CloseIdleConnections()
+	}
+
+	_, err = newProtocolTransport(config.Server{
+		Protocols: []config.ProtocolRule{{Hosts: []string{"*"}, Protocol: "spdy"}},
+	}, dialer)
+	require.Error(err)
+}
+
+func TestProtocolTransport_H3Failure(t *testing.T) {
+	require := require.New(t)
+	origin := httptest.NewTLSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.Copy(io.Discard, r.Body)
+	}))
+	defer origin.Close()
+	dialer, err := upstream.NewDialer("", nil, nil)
+	require.NoError(err)
+	tr, err := newProtocolTransport(config.Server{Transport: config.Transport{InsecureSkipVerify: true}}, dialer)
+	require.NoError(err)
+	defer tr.CloseIdleConnections()
+	dials := 0
+	tr.h3.Dial = func(context.Context, string, string, *tls.Config, *quic.Config) (quic.EarlyConnection, error) {
+		dials++
+		return nil, errors.New("h3 unreachable")
+	}
+	u, err := url.Parse(origin.URL)
+	require.NoError(err)
+	originAddr := canonicalAddr(u)
+	tr.altSvc.Update(originAddr, `h3=":443"`)
+
+	// A streamed body can't be sent again over h2, but the broken h3
+	// endpoint is forgotten.
+	post := func() (*http.Response, error) {
+		req, _ := http.NewRequest(http.MethodPost, origin.URL, io.NopCloser(strings.NewReader("streamed")))
+		return tr.RoundTrip(req)
+	}
+	_, err = post()
+	require.Error(err)
+	_, ok := tr.altSvc.Lookup(originAddr)
+	require.False(ok)
+	res, err := post()
+	require.NoError(err)
+	res.Body.Close()
+	require.Equal(http.StatusOK, res.StatusCode)
+	require.Equal(1, dials)
+}
+
+func TestProtocolTransport_H2Context(t *testing.T) {
+	require := require.New(t)
+	// The origin accepts connections but never answers the TLS handshake.
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(err)
+	defer ln.Close()
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+		}
+	}()
+	dialer, err := upstream.NewDialer("", nil, nil)
+	require.NoError(err)
+	tr, err := newProtocolTransport(config.Server{
+		Protocols: []config.ProtocolRule{{Hosts: []string{"127.0.0.1"}, Protocol: ProtocolHTTP2}},
+	}, dialer)
+	require.NoError(err)
+	defer tr.CloseIdleConnections()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	req, _ := http.NewRequestWithContext(ctx, http.MethodGet, "https://"+ln.Addr().String(), nil)
+	start := time.Now()
+	_, err = tr.RoundTrip(req)
+	require.Error(err)
+	require.True(time.Since(start) < 5*time.Second)
+}
+
+func TestProtocolTransport_QUICFallback(t *testing.T) {
+	require := require.New(t)
+	// A nameserver resolving every host to two addresses.
+	pc, err := net.ListenPacket("udp", "127.0.0.1:0")
+	require.NoError(err)
+	ns := &dns.Server{PacketConn: pc, Handler: dns.HandlerFunc(func(w dns.ResponseWriter, m *dns.Msg) {
+		res := new(dns.Msg)
+		res.SetReply(m)
+		for _, ip := range []string{"127.0.0.2", "127.0.0.3"} {
+			rr, _ := dns.NewRR(m.Question[0].Name + " 60 IN A " + ip)
+			res.Answer = append(res.Answer, rr)
+		}
+		w.WriteMsg(res)
+	})}
+	go ns.ActivateAndServe()
+	defer ns.Shutdown()
+
+	dialer, err := upstream.NewDialer("", nil, resolver.NewResolver(pc.LocalAddr().String()))
+	require.NoError(err)
+	tr, err := newProtocolTransport(config.Server{}, dialer)
+	require.NoError(err)
+	defer tr.CloseIdleConnections()
+
+	var dialed []string
+	defer func(dial func(context.Context, net.PacketConn, net.Addr, string, *tls.Config, *quic.Config) (quic.EarlyConnection, error)) {
+		dialEarlyQUIC = dial
+	}(dialEarlyQUIC)
+	dialEarlyQUIC = func(_ context.Context, _ net.PacketConn, addr net.Addr, host string, _ *tls.Config, _ *quic.Config) (quic.EarlyConnection, error) {
+		dialed = append(dialed, addr.String())
+		require.Equal("example.test", host)
+		return nil, errors.New("unreachable")
+	}
+	tr.altSvc.Update("example.test:443", `h3=":8443"`)
+
+	_, err = tr.dialQUIC(context.Background(), "udp", "example.test:443", &tls.Config{}, &quic.Config{})
+	require.EqualError(err, "unreachable")
+	require.Equal([]string{"127.0.0.2:8443", "127.0.0.3:8443"}, dialed)
+}
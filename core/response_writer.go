@@ -0,0 +1,179 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"hash"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/pkg/errors"
+)
+
+// LimitedBuffer is an io.Writer that keeps at most limit bytes and silently
+// discards the rest, so it never slows down or fails the stream it observes.
+type LimitedBuffer struct {
+	buf       bytes.Buffer
+	limit     int
+	truncated bool
+}
+
+// NewLimitedBuffer returns a LimitedBuffer capturing up to limit bytes.
+func NewLimitedBuffer(limit int) *LimitedBuffer {
+	return &LimitedBuffer{limit: limit}
+}
+
+func (b *LimitedBuffer) Write(p []byte) (int, error) {
+	n := len(p)
+	if room := b.limit - b.buf.Len(); room < n {
+		if room > 0 {
+			b.buf.Write(p[:room])
+		}
+		b.truncated = b.truncated || n > 0
+		return n, nil
+	}
+	b.buf.Write(p)
+	return n, nil
+}
+
+// Bytes returns the captured prefix.
+func (b *LimitedBuffer) Bytes() []byte {
+	return b.buf.Bytes()
+}
+
+// Truncated returns true if more bytes were written than captured.
+func (b *LimitedBuffer) Truncated() bool {
+	return b.truncated
+}
+
+// TeeReadCloser captures a bounded prefix of everything read from the
+// underlying body, e.g. to log a request body while it streams upstream.
+type TeeReadCloser struct {
+	io.ReadCloser
+	*LimitedBuffer
+	n int64
+}
+
+// NewTeeReadCloser wraps rc, capturing up to limit bytes of what is read.
+func NewTeeReadCloser(rc io.ReadCloser, limit int) *TeeReadCloser {
+	return &TeeReadCloser{ReadCloser: rc, LimitedBuffer: NewLimitedBuffer(limit)}
+}
+
+func (t *TeeReadCloser) Read(p []byte) (int, error) {
+	n, err := t.ReadCloser.Read(p)
+	if n > 0 {
+		t.n += int64(n)
+		t.LimitedBuffer.Write(p[:n])
+	}
+	return n, err
+}
+
+// Size returns the number of bytes read so far.
+func (t *TeeReadCloser) Size() int64 {
+	return t.n
+}
+
+// TeeResponseWriter forwards the response to the client as it is written,
+// while recording the status, the body size and a bounded prefix of the body.
+type TeeResponseWriter struct {
+	http.ResponseWriter
+	*LimitedBuffer
+	digest      hash.Hash
+	status      int
+	size        int64
+	wroteHeader bool
+}
+
+// NewTeeResponseWriter wraps w, capturing up to limit bytes of the body. A
+// zero limit captures nothing.
+func NewTeeResponseWriter(w http.ResponseWriter, limit int) *TeeResponseWriter {
+	return &TeeResponseWriter{ResponseWriter: w, LimitedBuffer: NewLimitedBuffer(limit)}
+}
+
+func (w *TeeResponseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+func (w *TeeResponseWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	n, err := w.ResponseWriter.Write(b)
+	if n > 0 {
+		w.size += int64(n)
+		w.LimitedBuffer.Write(b[:n])
+		if w.digest != nil {
+			w.digest.Write(b[:n])
+		}
+	}
+	return n, err
+}
+
+// SetDigest makes every body byte sent to the client go through h too, so
+// the whole body can be hashed while only a prefix is kept.
+func (w *TeeResponseWriter) SetDigest(h hash.Hash) {
+	w.digest = h
+}
+
+// Flush sends any buffered data to the client.
+func (w *TeeResponseWriter) Flush() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// Hijack lets the caller take over the client connection. The status is
+// recorded as 101 since the caller answers on the raw connection.
+func (w *TeeResponseWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	hj, ok := w.ResponseWriter.(http.Hijacker)
+	if !ok {
+		return nil, nil, errors.New("response writer does not support hijacking")
+	}
+	conn, rw, err := hj.Hijack()
+	if err == nil && !w.wroteHeader {
+		w.wroteHeader = true
+		w.status = http.StatusSwitchingProtocols
+	}
+	return conn, rw, err
+}
+
+// Push initiates an HTTP/2 server push if the client connection supports it.
+func (w *TeeResponseWriter) Push(target string, opts *http.PushOptions) error {
+	p, ok := w.ResponseWriter.(http.Pusher)
+	if !ok {
+		return http.ErrNotSupported
+	}
+	return p.Push(target, opts)
+}
+
+// Status returns the response status code, or 0 if nothing was written.
+func (w *TeeResponseWriter) Status() int {
+	return w.status
+}
+
+// Size returns the number of body bytes sent to the client.
+func (w *TeeResponseWriter) Size() int64 {
+	return w.size
+}
+
+// flushWriter flushes after every write so streamed responses such as
+// text/event-stream reach the client without delay.
+type flushWriter struct {
+	w http.ResponseWriter
+	f http.Flusher
+}
+
+func (fw flushWriter) Write(b []byte) (int, error) {
+	n, err := fw.w.Write(b)
+	fw.f.Flush()
+	return n, err
+}
@@ -0,0 +1,44 @@
+package core
+
+import (
+	"crypto/tls"
+	"net/http"
+
+	"github.com/lucas-clemente/quic-go/http3"
+	"github.com/millken/httpctl/certer"
+	"github.com/pkg/errors"
+	"golang.org/x/net/http2"
+)
+
+// NewHTTPSServer returns the server of the HTTPS listener, which clients
+// reach in DNS-hijack mode. It presents certificates signed by certCA for
+// the requested server name and serves h2 to clients that negotiate it,
+// like the real site would.
+func NewHTTPSServer(handler http.Handler, certCA *certer.CertCA) (*http.Server, error) {
+	srv := &http.Server{
+		Handler: handler,
+		TLSConfig: &tls.Config{
+			GetCertificate: certCA.GetCertificate,
+			NextProtos:     []string{http2.NextProtoTLS, "http/1.1"},
+		},
+	}
+	if err := http2.ConfigureServer(srv, nil); err != nil {
+		return nil, errors.Wrap(err, "failed to configure HTTP/2 server")
+	}
+	return srv, nil
+}
+
+// NewHTTP3Server returns the server of the optional HTTP/3 listener at
+// addr. Like the HTTPS listener, it presents certificates signed by certCA
+// for the requested server name.
+func NewHTTP3Server(addr string, handler http.Handler, certCA *certer.CertCA) *http3.Server {
+	return &http3.Server{
+		Server: &http.Server{
+			Addr:    addr,
+			Handler: handler,
+			TLSConfig: &tls.Config{
+				GetCertificate: certCA.GetCertificate,
+			},
+		},
+	}
+}
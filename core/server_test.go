@@ -0,0 +1,74 @@
+package core
+
+import (
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestNewHTTPSServer(t *testing.T) {
+	require := require.New(t)
+	ca, pool := newTestCA(t)
+	srv, err := NewHTTPSServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Host+" over "+r.Proto)
+	}), ca)
+	require.NoError(err)
+	ln, err := tls.Listen("tcp", "127.0.0.1:0", srv.TLSConfig)
+	require.NoError(err)
+	go srv.Serve(ln)
+	defer srv.Close()
+
+	// Clients resolve the site to httpctl in DNS-hijack mode.
+	for _, h2 := range []bool{true, false} {
+		tr := &http.Transport{
+			DialContext: func(ctx context.Context, network, _ string) (net.Conn, error) {
+				return (&net.Dialer{}).DialContext(ctx, network, ln.Addr().String())
+			},
+			TLSClientConfig:   &tls.Config{RootCAs: pool},
+			ForceAttemptHTTP2: h2,
+		}
+		res, err := (&http.Client{Transport: tr}).Get("https://www.example.com/")
+		require.NoError(err)
+		body, err := io.ReadAll(res.Body)
+		res.Body.Close()
+		tr.CloseIdleConnections()
+		require.NoError(err)
+		require.Equal([]string{"www.example.com"}, res.TLS.PeerCertificates[0].DNSNames)
+		if h2 {
+			require.Equal("h2", res.TLS.NegotiatedProtocol)
+			require.Equal("www.example.com over HTTP/2.0", string(body))
+		} else {
+			require.Equal("www.example.com over HTTP/1.1", string(body))
+		}
+	}
+}
+
+func TestNewHTTP3Server(t *testing.T) {
+	require := require.New(t)
+	ca, pool := newTestCA(t)
+	srv := NewHTTP3Server("127.0.0.1:8443", http.NotFoundHandler(), ca)
+	require.Equal("127.0.0.1:8443", srv.Addr)
+
+	getCertificate := func(serverName string) *x509.Certificate {
+		cert, err := srv.TLSConfig.GetCertificate(&tls.ClientHelloInfo{ServerName: serverName})
+		require.NoError(err)
+		leaf, err := x509.ParseCertificate(cert.Certificate[0])
+		require.NoError(err)
+		return leaf
+	}
+	leaf := getCertificate("www.example.com")
+	require.Equal([]string{"www.example.com"}, leaf.DNSNames)
+	_, err := leaf.Verify(x509.VerifyOptions{DNSName: "www.example.com", Roots: pool})
+	require.NoError(err)
+	// Certificates are signed once per host.
+	require.Equal(leaf.SerialNumber, getCertificate("www.example.com").SerialNumber)
+	other := getCertificate("api.example.com")
+	require.Equal([]string{"api.example.com"}, other.DNSNames)
+	require.NotEqual(leaf.SerialNumber, other.SerialNumber)
+}
@@ -0,0 +1,89 @@
+package core
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+)
+
+// UpstreamConn describes the upstream connection a request was sent on.
+type UpstreamConn struct {
+	mu     sync.Mutex
+	addr   string
+	reused bool
+	mapped string
+	proto  string
+}
+
+type upstreamConnKey struct{}
+
+// TraceUpstream returns r set up to record the upstream connection the Mux
+// sends it on. The returned UpstreamConn is filled in once the proxy has a
+// connection, so read it after the Mux has handled r.
+func TraceUpstream(r *http.Request) (*http.Request, *UpstreamConn) {
+	uc := &UpstreamConn{}
+	trace := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			uc.mu.Lock()
+			if addr := info.Conn.RemoteAddr(); addr != nil {
+				uc.addr = addr.String()
+			}
+			uc.reused = info.Reused
+			uc.mu.Unlock()
+		},
+	}
+	ctx := context.WithValue(r.Context(), upstreamConnKey{}, uc)
+	return r.WithContext(httptrace.WithClientTrace(ctx, trace)), uc
+}
+
+// ReportMapping records that the request of ctx was mapped to target, such
+// as a local file, instead of its own origin. It does nothing if the
+// request is not traced by TraceUpstream.
+func ReportMapping(ctx context.Context, target string) {
+	if uc, ok := ctx.Value(upstreamConnKey{}).(*UpstreamConn); ok {
+		uc.mu.Lock()
+		uc.mapped = target
+		uc.mu.Unlock()
+	}
+}
+
+// reportProto records the protocol of the upstream response to the request
+// of ctx, if it is traced by TraceUpstream.
+func reportProto(ctx context.Context, proto string) {
+	if uc, ok := ctx.Value(upstreamConnKey{}).(*UpstreamConn); ok {
+		uc.mu.Lock()
+		uc.proto = proto
+		uc.mu.Unlock()
+	}
+}
+
+// Mapped returns the target reported by ReportMapping, or "".
+func (uc *UpstreamConn) Mapped() string {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	return uc.mapped
+}
+
+// Addr returns the remote address of the upstream connection, or "" if no
+// connection was made.
+func (uc *UpstreamConn) Addr() string {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	return uc.addr
+}
+
+// Reused returns true if the connection was taken from the idle pool.
+func (uc *UpstreamConn) Reused() bool {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	return uc.reused
+}
+
+// Proto returns the protocol of the upstream response, such as "HTTP/2.0",
+// or "" if none was received.
+func (uc *UpstreamConn) Proto() string {
+	uc.mu.Lock()
+	defer uc.mu.Unlock()
+	return uc.proto
+}
@@ -0,0 +1,39 @@
+package core
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestTraceUpstream(t *testing.T) {
+	require := require.New(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {}))
+	defer origin.Close()
+	client := origin.Client()
+
+	for _, reused := range []bool{false, true} {
+		r, err := http.NewRequest("GET", origin.URL, nil)
+		require.NoError(err)
+		r, uc := TraceUpstream(r)
+		require.Empty(uc.Addr())
+		response, err := client.Do(r)
+		require.NoError(err)
+		response.Body.Close()
+		require.Equal(origin.Listener.Addr().String(), uc.Addr())
+		require.Equal(reused, uc.Reused())
+	}
+}
+
+func TestReportMapping(t *testing.T) {
+	require := require.New(t)
+	r := httptest.NewRequest("GET", "http://example.com/app.js", nil)
+	// Untraced requests are ignored.
+	ReportMapping(r.Context(), "file:/tmp/app.js")
+	r, uc := TraceUpstream(r)
+	require.Empty(uc.Mapped())
+	ReportMapping(r.Context(), "file:/tmp/app.js")
+	require.Equal("file:/tmp/app.js", uc.Mapped())
+}
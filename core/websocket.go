@@ -0,0 +1,189 @@
+package core
+
+import (
+	"bufio"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"strings"
+
+	"github.com/millken/httpctl/log"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// WebSocketHandler is called for every message decoded on a proxied
+// WebSocket connection. r is the upgrade request.
+type WebSocketHandler func(r *http.Request, msg *WebSocketMessage)
+
+// HandleWebSocket registers h to receive decoded WebSocket messages. Messages
+// are only decoded when at least one handler is registered or inspection is
+// enabled in the config. Handlers are called concurrently for the two
+// directions of a connection.
+func (mx *Mux) HandleWebSocket(h WebSocketHandler) {
+	mx.wsHandlers = append(mx.wsHandlers, h)
+}
+
+// isWebSocketUpgrade returns true if r asks to switch to the WebSocket
+// protocol.
+func isWebSocketUpgrade(r *http.Request) bool {
+	return headerHasToken(r.Header, "Connection", "upgrade") &&
+		strings.EqualFold(r.Header.Get("Upgrade"), "websocket")
+}
+
+// headerHasToken returns true if the comma separated values of header name
+// contain token, compared case-insensitively.
+func headerHasToken(h http.Header, name, token string) bool {
+	for _, v := range h[http.CanonicalHeaderKey(name)] {
+		for _, t := range strings.Split(v, ",") {
+			if strings.EqualFold(strings.TrimSpace(t), token) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// handleWebSocket relays an upgrade request to the origin and, once the
+// origin switched protocols, copies frames in both directions until either
+// side closes.
+func (mx *Mux) handleWebSocket(w http.ResponseWriter, r *http.Request) {
+	logger := log.Logger("websocket").With(zap.String("host", r.Host), zap.String("uri", r.RequestURI))
+	hj, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "connection hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	outreq := mx.outgoingRequest(r)
+	upConn, err := mx.dialWebSocket(r, outreq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	defer upConn.Close()
+
+	if err := outreq.Write(upConn); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	upReader := bufio.NewReader(upConn)
+	response, err := http.ReadResponse(upReader, outreq)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if response.StatusCode != http.StatusSwitchingProtocols {
+		// The origin refused the upgrade; hand its answer to the client.
+		defer response.Body.Close()
+		mx.copyResponseHeader(w, r, response)
+		w.WriteHeader(response.StatusCode)
+		copyBody(w, response)
+		return
+	}
+
+	clientConn, clientRW, err := hj.Hijack()
+	if err != nil {
+		logger.Error("failed to hijack client connection", zap.Error(err))
+		return
+	}
+	defer clientConn.Close()
+	if _, err := fmt.Fprintf(clientRW, "HTTP/1.1 %s\r\n", response.Status); err != nil {
+		return
+	}
+	if err := response.Header.Write(clientRW); err != nil {
+		return
+	}
+	if _, err := clientRW.WriteString("\r\n"); err != nil {
+		return
+	}
+	if err := clientRW.Flush(); err != nil {
+		return
+	}
+
+	var fromClient io.Reader = clientRW.Reader
+	var fromOrigin io.Reader = upReader
+	if mx.wsInspect || len(mx.wsHandlers) > 0 {
+		extensions := strings.Join(response.Header.Values("Sec-WebSocket-Extensions"), ",")
+		deflate := strings.Contains(strings.ToLower(extensions), "permessage-deflate")
+		emit := func(msg *WebSocketMessage) {
+			mx.emitWebSocketMessage(logger, r, msg)
+		}
+		fromClient = io.TeeReader(fromClient, newFrameParser(true, deflate, mx.wsMaxPayload, emit))
+		fromOrigin = io.TeeReader(fromOrigin, newFrameParser(false, deflate, mx.wsMaxPayload, emit))
+	}
+	logger.Debug("websocket established")
+
+	errc := make(chan error, 2)
+	go func() {
+		_, err := io.Copy(upConn, fromClient)
+		errc <- err
+	}()
+	go func() {
+		_, err := io.Copy(clientConn, fromOrigin)
+		errc <- err
+	}()
+	// Once one side is done, closing both connections unblocks the other.
+	if err := <-errc; err != nil {
+		logger.Debug("websocket relay ended", zap.Error(err))
+	}
+	clientConn.Close()
+	upConn.Close()
+	<-errc
+	logger.Debug("websocket closed")
+}
+
+// dialWebSocket opens the upstream connection for outreq, speaking TLS to
+// wss:// origins. Only HTTP/1.1 is offered since the upgrade needs it.
+func (mx *Mux) dialWebSocket(r *http.Request, outreq *http.Request) (net.Conn, error) {
+	addr := canonicalAddr(outreq.URL)
+	conn, err := mx.dialer.DialContext(r.Context(), "tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	if outreq.URL.Scheme != "https" {
+		return conn, nil
+	}
+	tlsConfig := &tls.Config{}
+	if mx.transport.auto.TLSClientConfig != nil {
+		tlsConfig = mx.transport.auto.TLSClientConfig.Clone()
+	}
+	tlsConfig.ServerName = outreq.URL.Hostname()
+	tlsConfig.NextProtos = []string{"http/1.1"}
+	tlsConn := tls.Client(conn, tlsConfig)
+	if err := tlsConn.HandshakeContext(r.Context()); err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "failed to handshake with '%s'", addr)
+	}
+	return tlsConn, nil
+}
+
+func (mx *Mux) emitWebSocketMessage(logger *zap.Logger, r *http.Request, msg *WebSocketMessage) {
+	if mx.wsInspect {
+		direction := "origin"
+		if msg.FromClient {
+			direction = "client"
+		}
+		fields := []zap.Field{
+			zap.String("from", direction),
+			zap.String("type", msg.Type()),
+			zap.Int64("size", msg.Size),
+			zap.Bool("compressed", msg.Compressed),
+			zap.Bool("truncated", msg.Truncated),
+		}
+		switch msg.Opcode {
+		case OpText:
+			fields = append(fields, zap.ByteString("payload", msg.Payload))
+		case OpClose:
+			fields = append(fields, zap.Int("code", msg.CloseCode()))
+		default:
+			fields = append(fields, zap.Binary("payload", msg.Payload))
+		}
+		logger.Info("websocket message", fields...)
+	}
+	for _, h := range mx.wsHandlers {
+		h(r, msg)
+	}
+}
@@ -0,0 +1,238 @@
+package core
+
+import (
+	"bytes"
+	"compress/flate"
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// WebSocket opcodes, see RFC 6455 section 5.2.
+const (
+	OpContinuation = 0x0
+	OpText         = 0x1
+	OpBinary       = 0x2
+	OpClose        = 0x8
+	OpPing         = 0x9
+	OpPong         = 0xa
+)
+
+// DefaultWebSocketMaxPayload is the largest message payload decoded when no
+// limit is configured. Bigger messages are reported without their payload.
+const DefaultWebSocketMaxPayload = 1 << 20
+
+// deflateTail is appended to a permessage-deflate payload before inflating,
+// see RFC 7692 section 7.2.2.
+var deflateTail = []byte{0x00, 0x00, 0xff, 0xff, 0x01, 0x00, 0x00, 0xff, 0xff}
+
+// WebSocketMessage is a control frame or a reassembled data message observed
+// on a proxied WebSocket connection.
+type WebSocketMessage struct {
+	Time       time.Time
+	FromClient bool
+	Opcode     int
+	// Payload is the unmasked and, if Compressed, inflated payload. It is
+	// empty when Truncated is true.
+	Payload    []byte
+	Size       int64
+	Compressed bool
+	Truncated  bool
+}
+
+// Type returns the name of the message opcode.
+func (m *WebSocketMessage) Type() string {
+	switch m.Opcode {
+	case OpText:
+		return "text"
+	case OpBinary:
+		return "binary"
+	case OpClose:
+		return "close"
+	case OpPing:
+		return "ping"
+	case OpPong:
+		return "pong"
+	}
+	return "unknown"
+}
+
+// CloseCode returns the status code of a close message, or 0.
+func (m *WebSocketMessage) CloseCode() int {
+	if m.Opcode != OpClose || len(m.Payload) < 2 {
+		return 0
+	}
+	return int(binary.BigEndian.Uint16(m.Payload))
+}
+
+// frameParser decodes the WebSocket frames of one direction of a connection.
+// Bytes are fed to it with Write as they are relayed; it never returns an
+// error so the relay is never disturbed by inspection.
+type frameParser struct {
+	fromClient bool
+	deflate    bool
+	maxPayload int
+	emit       func(*WebSocketMessage)
+
+	buf  []byte
+	skip int64
+	// current fragmented data message
+	msg *WebSocketMessage
+	// dict is the sliding window of inflated output used for context
+	// takeover between compressed messages.
+	dict   []byte
+	broken bool
+}
+
+func newFrameParser(fromClient, deflate bool, maxPayload int, emit func(*WebSocketMessage)) *frameParser {
+	if maxPayload <= 0 {
+		maxPayload = DefaultWebSocketMaxPayload
+	}
+	return &frameParser{
+		fromClient: fromClient,
+		deflate:    deflate,
+		maxPayload: maxPayload,
+		emit:       emit,
+	}
+}
+
+func (p *frameParser) Write(b []byte) (int, error) {
+	n := len(b)
+	if p.broken {
+		return n, nil
+	}
+	if p.skip > 0 {
+		if int64(len(b)) <= p.skip {
+			p.skip -= int64(len(b))
+			return n, nil
+		}
+		b = b[p.skip:]
+		p.skip = 0
+	}
+	p.buf = append(p.buf, b...)
+	for p.parse() {
+	}
+	return n, nil
+}
+
+// parse consumes one frame from buf, returning false if more data is needed.
+func (p *frameParser) parse() bool {
+	if len(p.buf) < 2 {
+		return false
+	}
+	fin := p.buf[0]&0x80 != 0
+	rsv1 := p.buf[0]&0x40 != 0
+	opcode := int(p.buf[0] & 0x0f)
+	masked := p.buf[1]&0x80 != 0
+	length := int64(p.buf[1] & 0x7f)
+	pos := 2
+	switch length {
+	case 126:
+		if len(p.buf) < pos+2 {
+			return false
+		}
+		length = int64(binary.BigEndian.Uint16(p.buf[pos:]))
+		pos += 2
+	case 127:
+		if len(p.buf) < pos+8 {
+			return false
+		}
+		length = int64(binary.BigEndian.Uint64(p.buf[pos:]))
+		pos += 8
+		if length < 0 {
+			p.broken = true
+			return false
+		}
+	}
+	var mask []byte
+	if masked {
+		if len(p.buf) < pos+4 {
+			return false
+		}
+		mask = p.buf[pos : pos+4]
+		pos += 4
+	}
+
+	if length > int64(p.maxPayload) {
+		// Too big to inspect: report it and skip the payload.
+		p.finish(fin, opcode, rsv1, nil, length, true)
+		if rest := int64(len(p.buf) - pos); rest < length {
+			p.skip = length - rest
+			p.buf = p.buf[:0]
+			return false
+		}
+		p.buf = p.buf[pos+int(length):]
+		return true
+	}
+	if int64(len(p.buf)-pos) < length {
+		return false
+	}
+	payload := make([]byte, length)
+	copy(payload, p.buf[pos:pos+int(length)])
+	if masked {
+		for i := range payload {
+			payload[i] ^= mask[i%4]
+		}
+	}
+	p.buf = p.buf[pos+int(length):]
+	p.finish(fin, opcode, rsv1, payload, length, false)
+	return true
+}
+
+// finish records a decoded frame, emitting control frames immediately and
+// data messages once their final fragment arrived.
+func (p *frameParser) finish(fin bool, opcode int, rsv1 bool, payload []byte, size int64, truncated bool) {
+	if opcode >= OpClose {
+		p.emit(&WebSocketMessage{
+			Time:       time.Now(),
+			FromClient: p.fromClient,
+			Opcode:     opcode,
+			Payload:    payload,
+			Size:       size,
+			Truncated:  truncated,
+		})
+		return
+	}
+	if opcode != OpContinuation || p.msg == nil {
+		p.msg = &WebSocketMessage{
+			FromClient: p.fromClient,
+			Opcode:     opcode,
+			Compressed: p.deflate && rsv1,
+		}
+	}
+	m := p.msg
+	m.Size += size
+	m.Truncated = m.Truncated || truncated || m.Size > int64(p.maxPayload)
+	if !m.Truncated {
+		m.Payload = append(m.Payload, payload...)
+	}
+	if !fin {
+		return
+	}
+	p.msg = nil
+	m.Time = time.Now()
+	if m.Truncated {
+		m.Payload = nil
+		// The inflate window is lost with the skipped payload.
+		if m.Compressed {
+			p.dict = nil
+		}
+	} else if m.Compressed {
+		m.Payload = p.inflate(m.Payload)
+	}
+	p.emit(m)
+}
+
+func (p *frameParser) inflate(payload []byte) []byte {
+	r := flate.NewReaderDict(io.MultiReader(bytes.NewReader(payload), bytes.NewReader(deflateTail)), p.dict)
+	defer r.Close()
+	var out bytes.Buffer
+	if _, err := io.Copy(&out, io.LimitReader(r, int64(p.maxPayload))); err != nil && err != io.ErrUnexpectedEOF {
+		return payload
+	}
+	p.dict = append(p.dict, out.Bytes()...)
+	if len(p.dict) > 32*1024 {
+		p.dict = p.dict[len(p.dict)-32*1024:]
+	}
+	return out.Bytes()
+}
@@ -0,0 +1,159 @@
+package core
+
+import (
+	"bufio"
+	"bytes"
+	"compress/flate"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+
+	"github.com/millken/httpctl/config"
+	"github.com/stretchr/testify/require"
+)
+
+// appendFrame appends a single WebSocket frame, masked when mask is set.
+func appendFrame(b []byte, fin bool, rsv1 bool, opcode int, payload []byte, mask bool) []byte {
+	b0 := byte(opcode)
+	if fin {
+		b0 |= 0x80
+	}
+	if rsv1 {
+		b0 |= 0x40
+	}
+	b = append(b, b0)
+	var maskBit byte
+	if mask {
+		maskBit = 0x80
+	}
+	switch {
+	case len(payload) < 126:
+		b = append(b, maskBit|byte(len(payload)))
+	case len(payload) <= 0xffff:
+		b = append(b, maskBit|126, byte(len(payload)>>8), byte(len(payload)))
+	default:
+		b = append(b, maskBit|127)
+		for i := 7; i >= 0; i-- {
+			b = append(b, byte(uint64(len(payload))>>(8*uint(i))))
+		}
+	}
+	if !mask {
+		return append(b, payload...)
+	}
+	key := []byte{1, 2, 3, 4}
+	b = append(b, key...)
+	for i, c := range payload {
+		b = append(b, c^key[i%4])
+	}
+	return b
+}
+
+func deflatePayload(t *testing.T, w *flate.Writer, buf *bytes.Buffer, payload string) []byte {
+	buf.Reset()
+	_, err := w.Write([]byte(payload))
+	require.NoError(t, err)
+	require.NoError(t, w.Flush())
+	return bytes.TrimSuffix(buf.Bytes(), []byte{0x00, 0x00, 0xff, 0xff})
+}
+
+func TestFrameParser(t *testing.T) {
+	require := require.New(t)
+	var msgs []*WebSocketMessage
+	p := newFrameParser(true, true, 64, func(m *WebSocketMessage) {
+		msgs = append(msgs, m)
+	})
+
+	var buf bytes.Buffer
+	fw, _ := flate.NewWriter(&buf, flate.BestSpeed)
+	var stream []byte
+	stream = appendFrame(stream, false, false, OpText, []byte("hel"), true)
+	stream = appendFrame(stream, true, false, OpPing, []byte("p"), true)
+	stream = appendFrame(stream, true, false, OpContinuation, []byte("lo"), true)
+	stream = appendFrame(stream, true, true, OpText, deflatePayload(t, fw, &buf, "compressed hello"), true)
+	// Compressed with context takeover from the previous message.
+	stream = appendFrame(stream, true, true, OpText, deflatePayload(t, fw, &buf, "compressed hello"), true)
+	stream = appendFrame(stream, true, false, OpBinary, bytes.Repeat([]byte{1}, 100), true)
+	stream = appendFrame(stream, true, false, OpClose, []byte{0x03, 0xe8}, true)
+
+	// Feed the stream byte by byte to exercise partial frames.
+	for i := range stream {
+		p.Write(stream[i : i+1])
+	}
+
+	require.Len(msgs, 6)
+	require.Equal("ping", msgs[0].Type())
+	require.Equal("hello", string(msgs[1].Payload))
+	require.Equal("compressed hello", string(msgs[2].Payload))
+	require.True(msgs[2].Compressed)
+	require.Equal("compressed hello", string(msgs[3].Payload))
+	require.True(msgs[4].Truncated)
+	require.Equal(int64(100), msgs[4].Size)
+	require.Empty(msgs[4].Payload)
+	require.Equal(1000, msgs[5].CloseCode())
+}
+
+func TestMux_WebSocket(t *testing.T) {
+	require := require.New(t)
+	origin := newTestOrigin(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "websocket" {
+			http.Error(w, "upgrade required", http.StatusUpgradeRequired)
+			return
+		}
+		conn, rw, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		fmt.Fprint(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+		// Echo the first frame back unmasked.
+		header := make([]byte, 6)
+		io.ReadFull(rw, header)
+		payload := make([]byte, header[1]&0x7f)
+		io.ReadFull(rw, payload)
+		for i := range payload {
+			payload[i] ^= header[2+i%4]
+		}
+		conn.Write(appendFrame(nil, true, false, OpText, payload, false))
+	})
+	defer origin.Close()
+
+	mx := newTestMux(t, config.Server{})
+	defer mx.Close()
+	var mu sync.Mutex
+	var msgs []*WebSocketMessage
+	done := make(chan struct{}, 2)
+	mx.HandleWebSocket(func(r *http.Request, msg *WebSocketMessage) {
+		mu.Lock()
+		msgs = append(msgs, msg)
+		mu.Unlock()
+		done <- struct{}{}
+	})
+	proxy := httptest.NewServer(mx)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	require.NoError(err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /chat HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", origin.Listener.Addr())
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	require.NoError(err)
+	require.Equal(http.StatusSwitchingProtocols, res.StatusCode)
+
+	conn.Write(appendFrame(nil, true, false, OpText, []byte("hello"), true))
+	echo := make([]byte, 7)
+	_, err = io.ReadFull(br, echo)
+	require.NoError(err)
+	require.Equal("hello", string(echo[2:]))
+
+	<-done
+	<-done
+	mu.Lock()
+	defer mu.Unlock()
+	require.Len(msgs, 2)
+	require.True(msgs[0].FromClient)
+	require.False(msgs[1].FromClient)
+	require.Equal("hello", string(msgs[1].Payload))
+}
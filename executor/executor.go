@@ -3,48 +3,199 @@ package executor
 import (
 	"context"
 	"io"
-	"io/ioutil"
+	"net/http"
+	"sync/atomic"
 
 	"github.com/millken/httpctl/config"
 	"github.com/millken/httpctl/core"
 	"github.com/millken/httpctl/log"
+	"github.com/pkg/errors"
 	"go.uber.org/zap"
 )
 
+// ErrExecutorNotFound is returned for an executor that is not configured.
+var ErrExecutorNotFound = errors.New("executor not configured")
+
 type Executor interface {
 	Writer(*core.RequestHeader, *core.ResponseHeader) io.Writer
 }
 
+// FlowRecorder is implemented by executors that record whole flows rather
+// than response bodies.
+type FlowRecorder interface {
+	RecordFlow(*core.Flow)
+}
+
+// WebSocketRecorder is implemented by executors that record the messages
+// of proxied WebSocket connections.
+type WebSocketRecorder interface {
+	RecordWebSocket(*http.Request, *core.WebSocketMessage)
+}
+
+// transportUser is implemented by executors that make their own upstream
+// requests.
+type transportUser interface {
+	setTransport(http.RoundTripper)
+}
+
 type Execute struct {
 	cfg       config.Executor
 	log       *zap.Logger
-	executors []Executor
+	executors []*namedExecutor
+}
+
+// namedExecutor is a configured executor, named after its config key. It
+// can be disabled at runtime.
+type namedExecutor struct {
+	Executor
+	name     string
+	disabled int32
+}
+
+func (x *namedExecutor) enabled() bool {
+	return atomic.LoadInt32(&x.disabled) == 0
+}
+
+// ExecutorState tells whether a configured executor is enabled.
+type ExecutorState struct {
+	Name    string `json:"name"`
+	Enabled bool   `json:"enabled"`
 }
 
 func NewExecutor(ctx context.Context, cfg config.Executor) *Execute {
 	e := &Execute{
 		cfg:       cfg,
 		log:       log.Logger("executor"),
-		executors: []Executor{},
+		executors: []*namedExecutor{},
 	}
 	if cfg.Example.Enable {
-		e.executors = append(e.executors, newExampleExecutor(ctx, cfg.Example))
+		e.add("example", newExampleExecutor(ctx, cfg.Example))
 	}
 	if cfg.SiteCopy.Enable {
-		e.executors = append(e.executors, newSiteCopyExecutor(ctx, cfg.SiteCopy))
+		e.add("sitecopy", newSiteCopyExecutor(ctx, cfg.SiteCopy))
 	}
 	if cfg.SourceMap.Enable {
-		e.executors = append(e.executors, newSourceMapExecutor(ctx, cfg.SourceMap))
+		e.add("sourcemap", newSourceMapExecutor(ctx, cfg.SourceMap))
+	}
+	if cfg.Flow.Enable {
+		e.add("flow", newFlowExecutor(ctx, cfg.Flow))
+	}
+	if cfg.Har.Enable {
+		e.add("har", newHarExecutor(ctx, cfg.Har))
 	}
 	return e
 }
 
+func (e *Execute) add(name string, executor Executor) {
+	e.executors = append(e.executors, &namedExecutor{Executor: executor, name: name})
+}
+
+// SetTransport makes the executors that fetch from origins go through rt,
+// usually the upstream transport of the Mux, so they share its connections,
+// proxy rules and resolver.
+func (e *Execute) SetTransport(rt http.RoundTripper) {
+	for _, x := range e.executors {
+		if u, ok := x.Executor.(transportUser); ok {
+			u.setTransport(rt)
+		}
+	}
+}
+
+// Executors returns the configured executors, in the order they run.
+func (e *Execute) Executors() []ExecutorState {
+	states := make([]ExecutorState, 0, len(e.executors))
+	for _, x := range e.executors {
+		states = append(states, ExecutorState{Name: x.name, Enabled: x.enabled()})
+	}
+	return states
+}
+
+// SetEnabled enables or disables the configured executor name. A disabled
+// executor is skipped until it is enabled again.
+func (e *Execute) SetEnabled(name string, enabled bool) error {
+	for _, x := range e.executors {
+		if x.name != name {
+			continue
+		}
+		var disabled int32
+		if !enabled {
+			disabled = 1
+		}
+		atomic.StoreInt32(&x.disabled, disabled)
+		e.log.Info("executor toggled", zap.String("executor", name), zap.Bool("enabled", enabled))
+		return nil
+	}
+	return errors.Wrapf(ErrExecutorNotFound, "executor '%s'", name)
+}
+
+// FlowStore returns the store of the flow executor, or nil if flows are
+// not recorded.
+func (e *Execute) FlowStore() *FlowStore {
+	for _, x := range e.executors {
+		if f, ok := x.Executor.(*FlowExecutor); ok {
+			return f.Store()
+		}
+	}
+	return nil
+}
+
+// Writer returns the writers of the enabled executors for the response
+// body, or none if no executor reads it.
 func (e *Execute) Writer(req *core.RequestHeader, res *core.ResponseHeader) []io.Writer {
-	writers := []io.Writer{ioutil.Discard}
+	var writers []io.Writer
 	for _, executor := range e.executors {
+		if !executor.enabled() {
+			continue
+		}
 		if writer := executor.Writer(req, res); writer != nil {
 			writers = append(writers, writer)
 		}
 	}
 	return writers
 }
+
+// Recording returns true if an executor records flows, see RecordFlow.
+func (e *Execute) Recording() bool {
+	for _, executor := range e.executors {
+		if _, ok := executor.Executor.(FlowRecorder); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordingWebSocket returns true if an executor records WebSocket
+// messages, see RecordWebSocket.
+func (e *Execute) RecordingWebSocket() bool {
+	for _, executor := range e.executors {
+		if _, ok := executor.Executor.(WebSocketRecorder); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// RecordWebSocket hands msg, received on the connection upgraded by r, to
+// the executors recording WebSocket messages.
+func (e *Execute) RecordWebSocket(r *http.Request, msg *core.WebSocketMessage) {
+	for _, executor := range e.executors {
+		if !executor.enabled() {
+			continue
+		}
+		if wr, ok := executor.Executor.(WebSocketRecorder); ok {
+			wr.RecordWebSocket(r, msg)
+		}
+	}
+}
+
+// RecordFlow hands f to the executors recording flows.
+func (e *Execute) RecordFlow(f *core.Flow) {
+	for _, executor := range e.executors {
+		if !executor.enabled() {
+			continue
+		}
+		if r, ok := executor.Executor.(FlowRecorder); ok {
+			r.RecordFlow(f)
+		}
+	}
+}
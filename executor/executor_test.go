@@ -0,0 +1,147 @@
+package executor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/core"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestExecute_SetEnabled(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	e := NewExecutor(context.Background(), config.Executor{
+		Flow: config.FlowExecutor{Enable: true, OutputPath: dir},
+		Har:  config.HarExecutor{Enable: true, OutputPath: t.TempDir()},
+	})
+	require.Equal([]ExecutorState{{Name: "flow", Enabled: true}, {Name: "har", Enabled: true}}, e.Executors())
+	store := e.FlowStore()
+	require.NotNil(store)
+
+	record := func(id string) {
+		e.RecordFlow(&core.Flow{
+			ID:        id,
+			StartedAt: time.Now(),
+			Request:   core.FlowRequest{Method: "GET", URL: "https://example.com/" + id},
+		})
+	}
+	require.NoError(e.SetEnabled("flow", false))
+	require.Equal([]ExecutorState{{Name: "flow", Enabled: false}, {Name: "har", Enabled: true}}, e.Executors())
+	record("skipped")
+	require.NoError(e.SetEnabled("flow", true))
+	record("recorded")
+	flows, err := store.List(FlowFilter{})
+	require.NoError(err)
+	require.Len(flows, 1)
+	require.Equal("recorded", flows[0].ID)
+
+	err = e.SetEnabled("sitecopy", true)
+	require.Equal(ErrExecutorNotFound, errors.Cause(err))
+}
+
+func TestExecute_Writer(t *testing.T) {
+	require := require.New(t)
+	// The Mux leaves the body alone when there is no writer.
+	e := NewExecutor(context.Background(), config.Executor{Flow: config.FlowExecutor{Enable: true, OutputPath: t.TempDir()}})
+	require.Empty(e.Writer(&core.RequestHeader{}, &core.ResponseHeader{}))
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(r *http.Request) (*http.Response, error) {
+	return f(r)
+}
+
+func TestExecute_SetTransport(t *testing.T) {
+	require := require.New(t)
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e := NewExecutor(ctx, config.Executor{
+		SourceMap: config.SourceMapExecutor{Enable: true, OutputPath: t.TempDir()},
+	})
+	var fetched []string
+	e.SetTransport(roundTripperFunc(func(r *http.Request) (*http.Response, error) {
+		fetched = append(fetched, r.URL.String())
+		return &http.Response{
+			StatusCode: http.StatusOK,
+			Body:       io.NopCloser(strings.NewReader("{}")),
+			Request:    r,
+		}, nil
+	}))
+	sourceMap := e.executors[0].Executor.(*SourceMapExecutor)
+	for i := 0; i < 2; i++ {
+		source, err := sourceMap.fetchSource("https://example.com/app.js")
+		require.NoError(err)
+		require.Equal("{}", string(source))
+	}
+	require.Equal([]string{"https://example.com/app.js.map", "https://example.com/app.js.map"}, fetched)
+}
+
+func TestExecute_RecordWebSocket(t *testing.T) {
+	require := require.New(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		conn, rw, _ := w.(http.Hijacker).Hijack()
+		defer conn.Close()
+		fmt.Fprint(rw, "HTTP/1.1 101 Switching Protocols\r\nUpgrade: websocket\r\nConnection: Upgrade\r\n\r\n")
+		rw.Flush()
+		// Answer once the masked "hi" of the client is read.
+		io.ReadFull(rw, make([]byte, 8))
+		conn.Write([]byte("\x81\x05hello"))
+	}))
+	defer origin.Close()
+
+	dir := t.TempDir()
+	e := NewExecutor(context.Background(), config.Executor{Flow: config.FlowExecutor{Enable: true, OutputPath: dir}})
+	require.True(e.RecordingWebSocket())
+	mx, err := core.NewMux(config.Server{}, nil, nil)
+	require.NoError(err)
+	defer mx.Close()
+	mx.HandleWebSocket(e.RecordWebSocket)
+	proxy := httptest.NewServer(mx)
+	defer proxy.Close()
+
+	conn, err := net.Dial("tcp", proxy.Listener.Addr().String())
+	require.NoError(err)
+	defer conn.Close()
+	fmt.Fprintf(conn, "GET /chat HTTP/1.1\r\nHost: %s\r\nUpgrade: websocket\r\nConnection: Upgrade\r\nSec-WebSocket-Version: 13\r\nSec-WebSocket-Key: dGhlIHNhbXBsZSBub25jZQ==\r\n\r\n", origin.Listener.Addr())
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, nil)
+	require.NoError(err)
+	require.Equal(http.StatusSwitchingProtocols, res.StatusCode)
+	// A text frame masked with a zero key.
+	conn.Write([]byte("\x81\x82\x00\x00\x00\x00hi"))
+	echo := make([]byte, 7)
+	_, err = io.ReadFull(br, echo)
+	require.NoError(err)
+
+	// Both messages were handed to the executor before being relayed.
+	names, err := filepath.Glob(filepath.Join(dir, "websockets-*.jsonl"))
+	require.NoError(err)
+	require.Len(names, 1)
+	b, err := os.ReadFile(names[0])
+	require.NoError(err)
+	var recs []WebSocketRecord
+	for _, line := range strings.Split(strings.TrimSpace(string(b)), "\n") {
+		var rec WebSocketRecord
+		require.NoError(json.Unmarshal([]byte(line), &rec))
+		recs = append(recs, rec)
+	}
+	require.Len(recs, 2)
+	wsURL := "ws://" + origin.Listener.Addr().String() + "/chat"
+	require.Equal(WebSocketRecord{Time: recs[0].Time, URL: wsURL, FromClient: true, Type: "text", Size: 2, Text: "hi"}, recs[0])
+	require.Equal(WebSocketRecord{Time: recs[1].Time, URL: wsURL, Type: "text", Size: 5, Text: "hello"}, recs[1])
+}
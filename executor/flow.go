@@ -3,25 +3,121 @@ package executor
 import (
 	"context"
 	"io"
+	"net/http"
+	"net/url"
 
 	"github.com/millken/httpctl/config"
 	"github.com/millken/httpctl/core"
 	"github.com/millken/httpctl/log"
+	"github.com/millken/httpctl/upstream"
 	"go.uber.org/zap"
 )
 
+const defaultFlowMaxDays = 7
+
 type FlowExecutor struct {
-	cfg config.FlowExecutor
-	log *zap.Logger
+	cfg   config.FlowExecutor
+	log   *zap.Logger
+	store *FlowStore
 }
 
 func newFlowExecutor(ctx context.Context, cfg config.FlowExecutor) Executor {
-	return &FlowExecutor{
+	if cfg.MaxDays <= 0 {
+		cfg.MaxDays = defaultFlowMaxDays
+	}
+	e := &FlowExecutor{
 		cfg: cfg,
 		log: log.Logger("flow_executor"),
 	}
+	store, err := NewFlowStore(cfg.OutputPath, cfg.MaxDays)
+	if err != nil {
+		e.log.Error("flows will not be recorded", zap.Error(err))
+		return e
+	}
+	e.store = store
+	go func() {
+		<-ctx.Done()
+		store.Close()
+	}()
+	return e
 }
 
+// Writer returns nil; flows are recorded whole by RecordFlow.
 func (e *FlowExecutor) Writer(req *core.RequestHeader, resHeader *core.ResponseHeader) io.Writer {
 	return nil
 }
+
+// RecordFlow stores f if its host is one of the configured hosts.
+func (e *FlowExecutor) RecordFlow(f *core.Flow) {
+	if e.store == nil || !matchFlowHost(e.cfg.Hosts, f) {
+		return
+	}
+	if err := e.store.Append(f); err != nil {
+		e.log.Error("failed to record flow", zap.String("id", f.ID), zap.Error(err))
+	}
+}
+
+// RecordWebSocket stores msg if the host of the upgrade request r is one
+// of the configured hosts.
+func (e *FlowExecutor) RecordWebSocket(r *http.Request, msg *core.WebSocketMessage) {
+	if e.store == nil {
+		return
+	}
+	scheme := "ws"
+	if r.TLS != nil {
+		scheme = "wss"
+	}
+	u := &url.URL{Scheme: scheme, Host: r.Host}
+	if !matchHost(e.cfg.Hosts, u.Hostname()) {
+		return
+	}
+	rec := &WebSocketRecord{
+		Time:       msg.Time,
+		URL:        u.String() + r.URL.RequestURI(),
+		FromClient: msg.FromClient,
+		Type:       msg.Type(),
+		Size:       msg.Size,
+		Compressed: msg.Compressed,
+		Truncated:  msg.Truncated,
+	}
+	if msg.Opcode == core.OpText {
+		rec.Text = string(msg.Payload)
+	} else {
+		rec.Payload = msg.Payload
+	}
+	if err := e.store.AppendWebSocket(rec); err != nil {
+		e.log.Error("failed to record websocket message", zap.String("url", rec.URL), zap.Error(err))
+	}
+}
+
+// Store returns the flow store, or nil if it could not be opened.
+func (e *FlowExecutor) Store() *FlowStore {
+	return e.store
+}
+
+// matchFlowHost returns true if the request host of f matches one of
+// hosts, or if hosts is empty.
+func matchFlowHost(hosts []string, f *core.Flow) bool {
+	if len(hosts) == 0 {
+		return true
+	}
+	u, err := url.Parse(f.Request.URL)
+	if err != nil {
+		return false
+	}
+	return matchHost(hosts, u.Hostname())
+}
+
+// matchHost returns true if host matches one of hosts, or if hosts is
+// empty.
+func matchHost(hosts []string, host string) bool {
+	if len(hosts) == 0 {
+		return true
+	}
+	for _, h := range hosts {
+		if upstream.MatchHost(h, host) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,433 @@
+package executor
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/millken/httpctl/core"
+	"github.com/millken/httpctl/upstream"
+	"github.com/pkg/errors"
+)
+
+// ErrFlowNotFound is returned when no stored flow has the requested ID.
+var ErrFlowNotFound = errors.New("flow not found")
+
+// FlowStore keeps recorded flows on disk as JSON lines, in one file per day
+// named flows-YYYYMMDD.jsonl, so they can be listed, filtered and replayed
+// later. Recorded WebSocket messages are kept alongside. Only the files of
+// the maxDays most recent days are kept.
+type FlowStore struct {
+	dir     string
+	maxDays int
+
+	// mu serializes appends and guards the index. Scans hold it only to
+	// snapshot the files and their sizes, so they never stall the
+	// exchanges recording flows.
+	mu sync.Mutex
+	// flows and websockets are the files being appended to.
+	flows      dayFile
+	websockets dayFile
+	// index locates the line of each stored flow by ID.
+	index map[string]flowOffset
+}
+
+type flowOffset struct {
+	name   string
+	offset int64
+}
+
+// NewFlowStore returns a FlowStore writing to dir, creating it if needed.
+// Files older than the maxDays most recent ones are removed as new days
+// start; a maxDays of 0 keeps every file. The stored flows are indexed by
+// ID so Get does not scan the store.
+func NewFlowStore(dir string, maxDays int) (*FlowStore, error) {
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create flow store '%s'", dir)
+	}
+	s := &FlowStore{
+		dir:        dir,
+		maxDays:    maxDays,
+		flows:      dayFile{prefix: "flows-"},
+		websockets: dayFile{prefix: "websockets-"},
+		index:      make(map[string]flowOffset),
+	}
+	files, err := s.snapshot()
+	if err != nil {
+		return nil, err
+	}
+	for _, file := range files {
+		_, err := scanFile(file.name, file.size, func(line []byte, offset int64) bool {
+			var f struct {
+				ID string `json:"id"`
+			}
+			if json.Unmarshal(line, &f) == nil {
+				s.index[f.ID] = flowOffset{name: file.name, offset: offset}
+			}
+			return true
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return s, nil
+}
+
+// Append stores f.
+func (s *FlowStore) Append(f *core.Flow) error {
+	b, err := json.Marshal(f)
+	if err != nil {
+		return errors.Wrapf(err, "failed to encode flow '%s'", f.ID)
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	name, offset, err := s.appendLine(&s.flows, f.StartedAt, b)
+	if err != nil {
+		return err
+	}
+	s.index[f.ID] = flowOffset{name: name, offset: offset}
+	return nil
+}
+
+// WebSocketRecord is a WebSocket message stored by AppendWebSocket. Text
+// payloads are kept as text, others as base64.
+type WebSocketRecord struct {
+	Time time.Time `json:"time"`
+	// URL is the ws:// or wss:// URL of the connection.
+	URL        string `json:"url"`
+	FromClient bool   `json:"fromClient"`
+	Type       string `json:"type"`
+	Size       int64  `json:"size"`
+	Compressed bool   `json:"compressed,omitempty"`
+	Truncated  bool   `json:"truncated,omitempty"`
+	Text       string `json:"text,omitempty"`
+	Payload    []byte `json:"payload,omitempty"`
+}
+
+// AppendWebSocket stores rec, in one file per day named
+// websockets-YYYYMMDD.jsonl next to the flows and kept as long.
+func (s *FlowStore) AppendWebSocket(rec *WebSocketRecord) error {
+	b, err := json.Marshal(rec)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode websocket message")
+	}
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	_, _, err = s.appendLine(&s.websockets, rec.Time, b)
+	return err
+}
+
+// dayFile is the file of a kind of records being appended to, named after
+// prefix and the day.
+type dayFile struct {
+	prefix string
+	file   *os.File
+	size   int64
+}
+
+// appendLine writes b as a line of the file of day, and returns the name of
+// the file and the offset of the line.
+func (s *FlowStore) appendLine(df *dayFile, day time.Time, b []byte) (string, int64, error) {
+	name := filepath.Join(s.dir, df.prefix+day.Format("20060102")+".jsonl")
+	if df.file == nil || df.file.Name() != name {
+		if err := s.open(df, name); err != nil {
+			return "", 0, err
+		}
+	}
+	if _, err := df.file.Write(append(b, '\n')); err != nil {
+		// The line may be partly written, start over from the actual end.
+		df.file.Close()
+		df.file = nil
+		return "", 0, errors.Wrapf(err, "failed to write flow file '%s'", name)
+	}
+	offset := df.size
+	df.size += int64(len(b)) + 1
+	return name, offset, nil
+}
+
+// open switches the appends of df to the file name and removes the files
+// past the retention.
+func (s *FlowStore) open(df *dayFile, name string) error {
+	if df.file != nil {
+		df.file.Close()
+		df.file = nil
+	}
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_APPEND|os.O_RDWR, 0600)
+	if err != nil {
+		return errors.Wrapf(err, "failed to open flow file '%s'", name)
+	}
+	fi, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return errors.Wrapf(err, "failed to stat flow file '%s'", name)
+	}
+	size := fi.Size()
+	// Terminate a line cut short by a crash, or the next record would be
+	// glued to it.
+	if size > 0 {
+		last := make([]byte, 1)
+		if _, err := file.ReadAt(last, size-1); err != nil {
+			file.Close()
+			return errors.Wrapf(err, "failed to read flow file '%s'", name)
+		}
+		if last[0] != '\n' {
+			if _, err := file.Write([]byte{'\n'}); err != nil {
+				file.Close()
+				return errors.Wrapf(err, "failed to write flow file '%s'", name)
+			}
+			size++
+		}
+	}
+	df.file, df.size = file, size
+	return s.prune(df)
+}
+
+// prune removes the files of df older than the maxDays most recent ones,
+// never the one being appended to.
+func (s *FlowStore) prune(df *dayFile) error {
+	if s.maxDays <= 0 {
+		return nil
+	}
+	names, err := filepath.Glob(filepath.Join(s.dir, df.prefix+"*.jsonl"))
+	if err != nil {
+		return errors.Wrap(err, "failed to list flow files")
+	}
+	if len(names) <= s.maxDays {
+		return nil
+	}
+	sort.Strings(names)
+	removed := make(map[string]bool)
+	for _, name := range names[:len(names)-s.maxDays] {
+		if name == df.file.Name() {
+			continue
+		}
+		if err := os.Remove(name); err != nil && !os.IsNotExist(err) {
+			return errors.Wrapf(err, "failed to remove flow file '%s'", name)
+		}
+		removed[name] = true
+	}
+	for id, o := range s.index {
+		if removed[o.name] {
+			delete(s.index, id)
+		}
+	}
+	return nil
+}
+
+// Close closes the files being appended to. A later append opens them
+// again.
+func (s *FlowStore) Close() error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	var err error
+	for _, df := range []*dayFile{&s.flows, &s.websockets} {
+		if df.file == nil {
+			continue
+		}
+		if cerr := df.file.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		df.file = nil
+	}
+	return err
+}
+
+// FlowFilter selects stored flows. Zero fields match everything.
+type FlowFilter struct {
+	// Host is matched against the request host like the hosts of proxy
+	// rules, e.g. "*.example.com".
+	Host   string
+	Method string
+	// URL must be contained in the request URL.
+	URL       string
+	MinStatus int
+	MaxStatus int
+	Since     time.Time
+	Until     time.Time
+	// Limit keeps only the most recent flows.
+	Limit int
+}
+
+// Match returns true if f passes the filter.
+func (filter *FlowFilter) Match(f *core.Flow) bool {
+	if filter.Host != "" {
+		u, err := url.Parse(f.Request.URL)
+		if err != nil || !upstream.MatchHost(filter.Host, u.Hostname()) {
+			return false
+		}
+	}
+	if filter.Method != "" && !strings.EqualFold(filter.Method, f.Request.Method) {
+		return false
+	}
+	if filter.URL != "" && !strings.Contains(f.Request.URL, filter.URL) {
+		return false
+	}
+	if filter.MinStatus > 0 || filter.MaxStatus > 0 {
+		if f.Response == nil {
+			return false
+		}
+		if filter.MinStatus > 0 && f.Response.StatusCode < filter.MinStatus {
+			return false
+		}
+		if filter.MaxStatus > 0 && f.Response.StatusCode > filter.MaxStatus {
+			return false
+		}
+	}
+	if !filter.Since.IsZero() && f.StartedAt.Before(filter.Since) {
+		return false
+	}
+	if !filter.Until.IsZero() && !f.StartedAt.Before(filter.Until) {
+		return false
+	}
+	return true
+}
+
+// List returns the stored flows passing filter, oldest first.
+func (s *FlowStore) List(filter FlowFilter) ([]*core.Flow, error) {
+	var flows []*core.Flow
+	err := s.walk(func(f *core.Flow) bool {
+		if filter.Match(f) {
+			flows = append(flows, f)
+			if filter.Limit > 0 && len(flows) > filter.Limit {
+				flows = flows[1:]
+			}
+		}
+		return true
+	})
+	return flows, err
+}
+
+// Get returns the stored flow with the given ID.
+func (s *FlowStore) Get(id string) (*core.Flow, error) {
+	s.mu.Lock()
+	o, ok := s.index[id]
+	s.mu.Unlock()
+	if !ok {
+		return nil, errors.Wrapf(ErrFlowNotFound, "flow '%s'", id)
+	}
+	file, err := os.Open(o.name)
+	if os.IsNotExist(err) {
+		return nil, errors.Wrapf(ErrFlowNotFound, "flow '%s'", id)
+	}
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to open flow file '%s'", o.name)
+	}
+	defer file.Close()
+	if _, err := file.Seek(o.offset, io.SeekStart); err != nil {
+		return nil, errors.Wrapf(err, "failed to seek flow file '%s'", o.name)
+	}
+	line, err := bufio.NewReader(file).ReadBytes('\n')
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to read flow file '%s'", o.name)
+	}
+	f := &core.Flow{}
+	if err := json.Unmarshal(line, f); err != nil {
+		return nil, errors.Wrapf(err, "failed to decode flow '%s'", id)
+	}
+	return f, nil
+}
+
+// Replay sends the request of the stored flow id again through rt and
+// returns the new response.
+func (s *FlowStore) Replay(ctx context.Context, rt http.RoundTripper, id string) (*http.Response, error) {
+	f, err := s.Get(id)
+	if err != nil {
+		return nil, err
+	}
+	r, err := f.NewRequest(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return rt.RoundTrip(r)
+}
+
+// walk calls fn for each stored flow, oldest first, until fn returns false.
+// Flows appended once the walk started are not seen. Lines that cannot be
+// decoded, such as one cut short by a crash, are skipped.
+func (s *FlowStore) walk(fn func(*core.Flow) bool) error {
+	files, err := s.snapshot()
+	if err != nil {
+		return err
+	}
+	for _, file := range files {
+		more, err := scanFile(file.name, file.size, func(line []byte, _ int64) bool {
+			f := &core.Flow{}
+			return json.Unmarshal(line, f) != nil || fn(f)
+		})
+		if os.IsNotExist(errors.Cause(err)) {
+			// Removed by the retention since the snapshot.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		if !more {
+			return nil
+		}
+	}
+	return nil
+}
+
+type flowFile struct {
+	name string
+	size int64
+}
+
+// snapshot returns the flow files, oldest first, with their sizes. Appends
+// write whole lines under s.mu, so each size ends on a line boundary.
+func (s *FlowStore) snapshot() ([]flowFile, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	names, err := filepath.Glob(filepath.Join(s.dir, "flows-*.jsonl"))
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to list flow files")
+	}
+	sort.Strings(names)
+	files := make([]flowFile, 0, len(names))
+	for _, name := range names {
+		fi, err := os.Stat(name)
+		if err != nil {
+			return nil, errors.Wrapf(err, "failed to stat flow file '%s'", name)
+		}
+		files = append(files, flowFile{name: name, size: fi.Size()})
+	}
+	return files, nil
+}
+
+// scanFile calls fn for the lines in the first size bytes of name, with
+// their offsets, until fn returns false.
+func scanFile(name string, size int64, fn func(line []byte, offset int64) bool) (bool, error) {
+	file, err := os.Open(name)
+	if err != nil {
+		return false, errors.Wrapf(err, "failed to open flow file '%s'", name)
+	}
+	defer file.Close()
+	r := bufio.NewReader(io.LimitReader(file, size))
+	var offset int64
+	for {
+		line, err := r.ReadBytes('\n')
+		if len(line) > 0 {
+			if !fn(line, offset) {
+				return false, nil
+			}
+			offset += int64(len(line))
+		}
+		if err == io.EOF {
+			return true, nil
+		}
+		if err != nil {
+			return false, errors.Wrapf(err, "failed to read flow file '%s'", name)
+		}
+	}
+}
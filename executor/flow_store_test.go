@@ -0,0 +1,164 @@
+package executor
+
+import (
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/millken/httpctl/core"
+	"github.com/pkg/errors"
+	"github.com/stretchr/testify/require"
+)
+
+func TestFlowStore(t *testing.T) {
+	require := require.New(t)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		io.WriteString(w, r.Method+" "+r.Header.Get("X-Test")+" "+string(body))
+	}))
+	defer origin.Close()
+
+	store, err := NewFlowStore(t.TempDir(), 0)
+	require.NoError(err)
+	day := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	flows := []*core.Flow{
+		{ID: "a", StartedAt: day, Request: core.FlowRequest{Method: "GET", URL: "https://www.example.com/"}, Response: &core.FlowResponse{StatusCode: 200}},
+		{ID: "b", StartedAt: day.Add(time.Hour), Request: core.FlowRequest{Method: "POST", URL: "https://api.example.com/login"}, Response: &core.FlowResponse{StatusCode: 401}},
+		{ID: "c", StartedAt: day.Add(24 * time.Hour), Request: core.FlowRequest{Method: "GET", URL: "https://other.org/x"}, Error: "refused"},
+		{ID: "d", StartedAt: day.Add(25 * time.Hour), Request: core.FlowRequest{
+			Method: "PUT",
+			URL:    origin.URL + "/replay",
+			Header: http.Header{"X-Test": {"yes"}, "Connection": {"close"}},
+			Body:   []byte("payload"),
+		}},
+	}
+	for _, f := range flows {
+		require.NoError(store.Append(f))
+	}
+
+	ids := func(filter FlowFilter) []string {
+		list, err := store.List(filter)
+		require.NoError(err)
+		var ids []string
+		for _, f := range list {
+			ids = append(ids, f.ID)
+		}
+		return ids
+	}
+	require.Equal([]string{"a", "b", "c", "d"}, ids(FlowFilter{}))
+	require.Equal([]string{"a", "b"}, ids(FlowFilter{Host: "*.example.com"}))
+	require.Equal([]string{"b"}, ids(FlowFilter{MinStatus: 400}))
+	require.Equal([]string{"a", "c"}, ids(FlowFilter{Method: "get"}))
+	require.Equal([]string{"b"}, ids(FlowFilter{URL: "/login"}))
+	require.Equal([]string{"c", "d"}, ids(FlowFilter{Since: day.Add(2 * time.Hour)}))
+	require.Equal([]string{"c", "d"}, ids(FlowFilter{Limit: 2}))
+
+	f, err := store.Get("b")
+	require.NoError(err)
+	require.Equal(401, f.Response.StatusCode)
+	_, err = store.Get("missing")
+	require.True(errors.Is(err, ErrFlowNotFound))
+
+	res, err := store.Replay(context.Background(), http.DefaultTransport, "d")
+	require.NoError(err)
+	defer res.Body.Close()
+	body, err := io.ReadAll(res.Body)
+	require.NoError(err)
+	require.Equal("PUT yes payload", string(body))
+}
+
+func TestFlowStore_AppendDuringWalk(t *testing.T) {
+	require := require.New(t)
+	store, err := NewFlowStore(t.TempDir(), 0)
+	require.NoError(err)
+	day := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(store.Append(&core.Flow{ID: "a", StartedAt: day}))
+
+	var seen []string
+	err = store.walk(func(f *core.Flow) bool {
+		seen = append(seen, f.ID)
+		done := make(chan error, 1)
+		go func() { done <- store.Append(&core.Flow{ID: f.ID + "+", StartedAt: day}) }()
+		select {
+		case err := <-done:
+			require.NoError(err)
+		case <-time.After(5 * time.Second):
+			t.Fatal("Append blocked by walk")
+		}
+		return true
+	})
+	require.NoError(err)
+	// The flow appended while walking is past the snapshot.
+	require.Equal([]string{"a"}, seen)
+
+	list, err := store.List(FlowFilter{})
+	require.NoError(err)
+	require.Len(list, 2)
+	require.Equal("a+", list[1].ID)
+}
+
+func TestFlowStore_Reopen(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	store, err := NewFlowStore(dir, 0)
+	require.NoError(err)
+	day := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	require.NoError(store.Append(&core.Flow{ID: "a", StartedAt: day}))
+	require.NoError(store.Append(&core.Flow{ID: "b", StartedAt: day}))
+	require.NoError(store.Close())
+
+	// A crash cut the last line short.
+	name := filepath.Join(dir, "flows-20220601.jsonl")
+	file, err := os.OpenFile(name, os.O_APPEND|os.O_WRONLY, 0600)
+	require.NoError(err)
+	_, err = file.WriteString(`{"id":"c","startedAt"`)
+	require.NoError(err)
+	require.NoError(file.Close())
+
+	store, err = NewFlowStore(dir, 0)
+	require.NoError(err)
+	defer store.Close()
+	f, err := store.Get("b")
+	require.NoError(err)
+	require.Equal("b", f.ID)
+	_, err = store.Get("c")
+	require.True(errors.Is(err, ErrFlowNotFound))
+
+	require.NoError(store.Append(&core.Flow{ID: "d", StartedAt: day}))
+	f, err = store.Get("d")
+	require.NoError(err)
+	require.Equal("d", f.ID)
+	list, err := store.List(FlowFilter{})
+	require.NoError(err)
+	require.Len(list, 3)
+}
+
+func TestFlowStore_Retention(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	store, err := NewFlowStore(dir, 2)
+	require.NoError(err)
+	defer store.Close()
+	day := time.Date(2022, 6, 1, 12, 0, 0, 0, time.UTC)
+	for i, id := range []string{"a", "b", "c"} {
+		require.NoError(store.Append(&core.Flow{ID: id, StartedAt: day.Add(time.Duration(i) * 24 * time.Hour)}))
+	}
+
+	names, err := filepath.Glob(filepath.Join(dir, "flows-*.jsonl"))
+	require.NoError(err)
+	require.Equal([]string{
+		filepath.Join(dir, "flows-20220602.jsonl"),
+		filepath.Join(dir, "flows-20220603.jsonl"),
+	}, names)
+	_, err = store.Get("a")
+	require.True(errors.Is(err, ErrFlowNotFound))
+	list, err := store.List(FlowFilter{})
+	require.NoError(err)
+	require.Len(list, 2)
+	require.Equal("b", list[0].ID)
+}
@@ -0,0 +1,162 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/core"
+	"github.com/millken/httpctl/log"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+const (
+	HarSplitSession = "session"
+	HarSplitHost    = "host"
+
+	defaultHarMaxEntries = 1000
+)
+
+// harFooter closes the entries array and the document. Entries are added
+// in front of it so the file is a complete HAR document after every write.
+var harFooter = []byte("]}}")
+
+type harFile struct {
+	file    *os.File
+	entries int
+}
+
+type HarExecutor struct {
+	cfg     config.HarExecutor
+	log     *zap.Logger
+	session string
+
+	mu    sync.Mutex
+	files map[string]*harFile
+	rolls map[string]int
+}
+
+func newHarExecutor(ctx context.Context, cfg config.HarExecutor) Executor {
+	if cfg.MaxEntries <= 0 {
+		cfg.MaxEntries = defaultHarMaxEntries
+	}
+	e := &HarExecutor{
+		cfg:     cfg,
+		log:     log.Logger("har_executor"),
+		session: time.Now().Format("20060102-150405"),
+		files:   make(map[string]*harFile),
+		rolls:   make(map[string]int),
+	}
+	if cfg.Split != HarSplitSession && cfg.Split != HarSplitHost {
+		e.log.Warn("unknown har split, using session", zap.String("split", cfg.Split))
+		e.cfg.Split = HarSplitSession
+	}
+	go func() {
+		<-ctx.Done()
+		e.close()
+	}()
+	return e
+}
+
+// Writer returns nil; flows are written whole by RecordFlow.
+func (e *HarExecutor) Writer(req *core.RequestHeader, resHeader *core.ResponseHeader) io.Writer {
+	return nil
+}
+
+// RecordFlow adds f to the HAR file of its session or host.
+func (e *HarExecutor) RecordFlow(f *core.Flow) {
+	if !matchFlowHost(e.cfg.Hosts, f) {
+		return
+	}
+	key := ""
+	if e.cfg.Split == HarSplitHost {
+		if u, err := url.Parse(f.Request.URL); err == nil {
+			key = u.Host
+		}
+	}
+	if err := e.append(key, core.NewHAREntry(f)); err != nil {
+		e.log.Error("failed to write har entry", zap.String("id", f.ID), zap.Error(err))
+	}
+}
+
+func (e *HarExecutor) append(key string, entry core.HAREntry) error {
+	b, err := json.Marshal(entry)
+	if err != nil {
+		return errors.Wrap(err, "failed to encode har entry")
+	}
+
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	hf := e.files[key]
+	if hf != nil && hf.entries >= e.cfg.MaxEntries {
+		hf.file.Close()
+		e.rolls[key]++
+		hf = nil
+	}
+	if hf == nil {
+		if hf, err = e.create(key); err != nil {
+			return err
+		}
+		e.files[key] = hf
+	}
+
+	if _, err := hf.file.Seek(-int64(len(harFooter)), io.SeekEnd); err != nil {
+		return errors.Wrapf(err, "failed to seek har file '%s'", hf.file.Name())
+	}
+	if hf.entries > 0 {
+		b = append([]byte(",\n"), b...)
+	}
+	if _, err := hf.file.Write(append(b, harFooter...)); err != nil {
+		return errors.Wrapf(err, "failed to write har file '%s'", hf.file.Name())
+	}
+	hf.entries++
+	return nil
+}
+
+// create starts a new HAR file holding a document without entries.
+func (e *HarExecutor) create(key string) (*harFile, error) {
+	name := e.session
+	if key != "" {
+		name += "-" + strings.NewReplacer(":", "_", "/", "_").Replace(key)
+	}
+	if n := e.rolls[key]; n > 0 {
+		name += fmt.Sprintf("-%d", n)
+	}
+	name = filepath.Join(e.cfg.OutputPath, name+".har")
+	if err := os.MkdirAll(e.cfg.OutputPath, 0700); err != nil {
+		return nil, errors.Wrapf(err, "failed to create har directory '%s'", e.cfg.OutputPath)
+	}
+	file, err := os.OpenFile(name, os.O_CREATE|os.O_TRUNC|os.O_RDWR, 0600)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create har file '%s'", name)
+	}
+	doc, err := json.Marshal(core.NewHAR())
+	if err == nil {
+		// The document ends with the empty entries array: `[]}}`.
+		_, err = file.Write(append(doc[:len(doc)-len(harFooter)-1], "[\n]}}"...))
+	}
+	if err != nil {
+		file.Close()
+		return nil, errors.Wrapf(err, "failed to write har file '%s'", name)
+	}
+	e.log.Info("writing har file", zap.String("file", name))
+	return &harFile{file: file}, nil
+}
+
+func (e *HarExecutor) close() {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for key, hf := range e.files {
+		hf.file.Close()
+		delete(e.files, key)
+	}
+}
@@ -0,0 +1,52 @@
+package executor
+
+import (
+	"context"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/core"
+	"github.com/stretchr/testify/require"
+)
+
+func TestHarExecutor(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	e := newHarExecutor(ctx, config.HarExecutor{
+		OutputPath: dir,
+		Split:      HarSplitHost,
+		MaxEntries: 2,
+	}).(*HarExecutor)
+
+	record := func(url string) {
+		e.RecordFlow(&core.Flow{
+			StartedAt: time.Now(),
+			Request:   core.FlowRequest{Method: "GET", URL: url},
+			Response:  &core.FlowResponse{StatusCode: 200},
+		})
+	}
+	record("https://a.example.com/1")
+	record("https://b.example.com:8443/1")
+	record("https://a.example.com/2")
+	record("https://a.example.com/3")
+
+	read := func(name string) *core.HAR {
+		b, err := os.ReadFile(filepath.Join(dir, e.session+name+".har"))
+		require.NoError(err)
+		har := &core.HAR{}
+		require.NoError(json.Unmarshal(b, har), string(b))
+		require.Equal("1.2", har.Log.Version)
+		return har
+	}
+	require.Len(read("-a.example.com").Log.Entries, 2)
+	rolled := read("-a.example.com-1")
+	require.Len(rolled.Log.Entries, 1)
+	require.Equal("https://a.example.com/3", rolled.Log.Entries[0].Request.URL)
+	require.Len(read("-b.example.com_8443").Log.Entries, 1)
+}
@@ -25,6 +25,9 @@ type SourceMapExecutor struct {
 	mu      sync.RWMutex
 	ch      chan string
 	process map[string]bool
+	// client fetches the source maps, through the transport given to
+	// setTransport or else a direct one.
+	client *http.Client
 }
 
 func newSourceMapExecutor(ctx context.Context, cfg config.SourceMapExecutor) Executor {
@@ -33,6 +36,12 @@ func newSourceMapExecutor(ctx context.Context, cfg config.SourceMapExecutor) Exe
 		log:     log.Logger("sourcemap_executor"),
 		process: make(map[string]bool),
 		ch:      make(chan string),
+		client: &http.Client{
+			Transport: core.CreateHTTPTransport(config.Transport{}, nil),
+			CheckRedirect: func(req *http.Request, via []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
 	}
 	go e.worker(ctx)
 	return e
@@ -85,16 +94,20 @@ func (e *SourceMapExecutor) Writer(req *core.RequestHeader, resHeader *core.Resp
 	return nil
 }
 
+func (e *SourceMapExecutor) setTransport(rt http.RoundTripper) {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	client := *e.client
+	client.Transport = rt
+	e.client = &client
+}
+
 func (e *SourceMapExecutor) fetchSource(sourceURL string) (source []byte, err error) {
 	var res *http.Response
 
-	client := &http.Client{
-		Transport: core.CreateHTTPTransport(nil),
-		CheckRedirect: func(req *http.Request, via []*http.Request) error {
-			return http.ErrUseLastResponse
-		},
-	}
-
+	e.mu.RLock()
+	client := e.client
+	e.mu.RUnlock()
 	res, err = client.Get(sourceURL + ".map")
 	if err != nil {
 		return
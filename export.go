@@ -0,0 +1,41 @@
+package main
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/millken/httpctl/core"
+	"github.com/millken/httpctl/executor"
+)
+
+// export prints the request of the flow id, read from the flow store in
+// dir, in format. It returns the process exit code.
+func export(dir, id, format string) int {
+	if dir == "" {
+		fmt.Fprintln(os.Stderr, "ERROR: Flows are not stored, set executor.flow.outputPath")
+		return 1
+	}
+	// NewFlowStore would create a missing store.
+	if _, err := os.Stat(dir); err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to open flow store: %v\n", err)
+		return 1
+	}
+	store, err := executor.NewFlowStore(dir, 0)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	defer store.Close()
+	f, err := store.Get(id)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+		return 1
+	}
+	snippet, err := core.ExportRequest(format, &f.Request)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to export flow '%s': %v\n", id, err)
+		return 1
+	}
+	fmt.Print(snippet)
+	return 0
+}
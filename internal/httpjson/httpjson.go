@@ -0,0 +1,28 @@
+// Package httpjson writes the JSON responses of the control APIs.
+package httpjson
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/pkg/errors"
+)
+
+// Write writes v as a JSON response with status.
+func Write(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
+
+// Error writes err as a JSON error response with status.
+func Error(w http.ResponseWriter, status int, err error) {
+	Write(w, status, map[string]string{"error": err.Error()})
+}
+
+// MethodNotAllowed writes a 405 error response allowing methods.
+func MethodNotAllowed(w http.ResponseWriter, methods ...string) {
+	w.Header().Set("Allow", strings.Join(methods, ", "))
+	Error(w, http.StatusMethodNotAllowed, errors.New("method not allowed"))
+}
@@ -70,6 +70,15 @@ func Logger(name string) *zap.Logger {
 	return logger
 }
 
+// Lookup returns the sub logger of the given name and true, or false if no
+// such sub logger is configured.
+func Lookup(name string) (*zap.Logger, bool) {
+	_logMu.RLock()
+	defer _logMu.RUnlock()
+	logger, ok := _subLoggers[name]
+	return logger, ok
+}
+
 // InitLoggers initializes the global logger and other sub loggers.
 func InitLoggers(globalCfg GlobalConfig, subCfgs map[string]GlobalConfig, opts ...zap.Option) error {
 	if _, exists := subCfgs[_globalLoggerName]; exists {
@@ -1,29 +1,42 @@
 package main
 
 import (
+	"context"
 	"crypto/tls"
+	"flag"
 	"fmt"
+	"net"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
 
+	"github.com/millken/httpctl/admin"
+	"github.com/millken/httpctl/capture"
 	"github.com/millken/httpctl/config"
 	"github.com/millken/httpctl/core"
+	"github.com/millken/httpctl/executor"
 	"github.com/millken/httpctl/log"
 	"github.com/millken/httpctl/middleware"
 	"github.com/millken/httpctl/resolver"
+	"github.com/millken/httpctl/rules"
 
 	"github.com/millken/httpctl/certer"
 	"go.uber.org/zap"
 )
 
-const version = "2.0.0"
+const version = core.Version
 
 const (
 	ConfigPath = "HttpCtlConfigPath"
 )
 
 func main() {
+	replayPath := flag.String("replay", "", "replay the requests of a capture file and report differences")
+	exportID := flag.String("export", "", "print the request of a stored flow as a snippet, see -format")
+	exportFormat := flag.String("format", core.ExportCurl, "snippet format of -export: "+strings.Join(core.ExportFormats, ", "))
+	flag.Parse()
+
 	configPath := os.Getenv(ConfigPath)
 	if configPath == "" {
 		configPath = "config.yaml"
@@ -39,49 +52,154 @@ func main() {
 		os.Exit(1)
 	}
 	log.L().Info("loading config", zap.Any("config", fmt.Sprintf("%+v", cfg)))
+	if *exportID != "" {
+		os.Exit(export(cfg.Executor.Flow.OutputPath, *exportID, *exportFormat))
+	}
 
-	// ctx := context.Background()
-	// execute := executor.NewExecutor(ctx, cfg.Executor)
+	ctx := context.Background()
+	execute := executor.NewExecutor(ctx, cfg.Executor)
 
 	// var proxyer proxy.Proxy
-	resolvers := resolver.NewResolver(cfg.Server.Resolver)
+	// Upstream hosts are resolved with this resolver, never the system one,
+	// which may point back at httpctl in DNS-hijack mode.
+	var nameservers []string
+	if cfg.Server.Resolver != "" {
+		nameservers = append(nameservers, cfg.Server.Resolver)
+	}
+	resolvers := resolver.NewResolver(nameservers...)
 	// proxyer = proxy.NewHttpProxy(resolvers, execute)
 
-	mux := core.NewMux(resolvers)
-	mux.Use(middleware.LoggingHandler(os.Stdout))
-	mux.Use(middleware.HttpLogHandler)
 	certCA := certer.NewCertCA()
 	if err := certCA.LoadCA(); err != nil {
 		fmt.Fprintf(os.Stderr, "ERROR: Failed to init certificate: %v\n", err)
 		os.Exit(1)
 	}
+	mux, err := core.NewMux(cfg.Server, resolvers, certCA)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to init mux: %v\n", err)
+		os.Exit(1)
+	}
+	defer mux.Close()
+	if *replayPath != "" {
+		code := replay(ctx, mux.Transport(), *replayPath)
+		mux.Close()
+		os.Exit(code)
+	}
+	mux.SetExecutor(execute)
+	execute.SetTransport(mux.Transport())
+	if execute.Recording() {
+		if n := cfg.Executor.Flow.MaxBodySize; n > 0 {
+			core.FlowBodyLimit = n
+		}
+		mux.HandleFlow(execute.RecordFlow)
+	}
+	if execute.RecordingWebSocket() {
+		mux.HandleWebSocket(execute.RecordWebSocket)
+	}
+	if cfg.Server.Capture.Path != "" {
+		f, err := os.OpenFile(cfg.Server.Capture.Path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0600)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed to open capture file: %v\n", err)
+			os.Exit(1)
+		}
+		defer f.Close()
+		mux.Use(middleware.HttpLogCaptureHandler(capture.NewWriter(f)))
+	} else {
+		mux.Use(middleware.HttpLogHandler)
+	}
+	var engine *rules.Engine
+	if cfg.Server.Rules.Path != "" {
+		if engine, err = rules.NewEngine(cfg.Server.Rules.Path); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed to load rules: %v\n", err)
+			os.Exit(1)
+		}
+		if interval := cfg.Server.Rules.ReloadInterval; interval > 0 {
+			go engine.Watch(ctx, interval)
+		}
+		mux.Use(engine.Handler)
+	}
+	var adminServer *admin.Server
+	if cfg.Server.Admin.Listen != "" {
+		if adminServer, err = admin.New(cfg.Server.Admin); err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed to init admin API: %v\n", err)
+			os.Exit(1)
+		}
+		adminServer.SetExecutor(execute)
+		adminServer.SetResolver(resolvers)
+		adminServer.SetCertCA(certCA)
+		adminServer.SetTransport(mux.Transport())
+		if engine != nil {
+			adminServer.SetRules(engine)
+		}
+		mux.HandleFlow(adminServer.RecordFlow)
+	}
+	if bp := cfg.Server.Breakpoints; adminServer != nil || len(bp.Rules) > 0 {
+		breakpoints, err := core.NewBreakpoints(bp)
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: Failed to init breakpoints: %v\n", err)
+			os.Exit(1)
+		}
+		mux.SetBreakpoints(breakpoints)
+		if adminServer != nil {
+			adminServer.SetBreakpoints(breakpoints)
+		}
+	}
 	var wg sync.WaitGroup
 
+	if adminServer != nil {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			if err := adminServer.ListenAndServe(); err != nil {
+				log.L().Fatal("Failed to bind on the given interface (admin): ", zap.Error(err))
+			}
+		}()
+	}
+
+	httpLn, err := net.Listen("tcp", cfg.Server.Http.Listen)
+	if err != nil {
+		log.L().Fatal("Failed to bind on the given interface (HTTP): ", zap.Error(err))
+	}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		if err := http.ListenAndServe(cfg.Server.Http.Listen, mux); err != nil {
+		if err := http.Serve(httpLn, mux); err != nil {
 			log.L().Fatal("Failed to bind on the given interface (HTTP): ", zap.Error(err))
 		}
 
 	}()
 
+	srv, err := core.NewHTTPSServer(mux, certCA)
+	if err != nil {
+		log.L().Fatal("Failed to init HTTPS server", zap.Error(err))
+	}
+	httpsLn, err := tls.Listen("tcp", cfg.Server.Https.Listen, srv.TLSConfig)
+	if err != nil {
+		log.L().Fatal("listen error ", zap.Error(err))
+	}
 	wg.Add(1)
 	go func() {
 		defer wg.Done()
-		config := &tls.Config{
-			GetCertificate: certCA.GetCertificate,
-		}
-		ln, err := tls.Listen("tcp", cfg.Server.Https.Listen, config)
-		if err != nil {
-			log.L().Fatal("listen error ", zap.Error(err))
-		}
-		defer ln.Close()
-		if err := http.Serve(ln, mux); err != nil {
+		defer httpsLn.Close()
+		if err := srv.Serve(httpsLn); err != nil {
 			log.L().Fatal("Failed to bind on the given interface (HTTPS): ", zap.Error(err))
 		}
 	}()
 
+	if cfg.Server.Http3.Listen != "" {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			srv := core.NewHTTP3Server(cfg.Server.Http3.Listen, mux, certCA)
+			if err := srv.ListenAndServe(); err != nil {
+				log.L().Fatal("Failed to bind on the given interface (HTTP/3): ", zap.Error(err))
+			}
+		}()
+	}
+
+	if adminServer != nil {
+		adminServer.SetReady(true)
+	}
 	wg.Wait()
 
 }
@@ -2,65 +2,199 @@ package middleware
 
 import (
 	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"fmt"
+	"hash"
 	"io"
-	"log"
 	"net/http"
-	"net/http/httptest"
 	"net/http/httputil"
-	"os"
 	"sort"
-	"strconv"
 	"strings"
+	"time"
+
+	"github.com/millken/httpctl/capture"
+	"github.com/millken/httpctl/core"
+	"github.com/millken/httpctl/log"
+	"go.uber.org/zap"
+)
+
+// DumpBodyLimit is the number of request and response body bytes dumped by
+// HttpLogHandler. Bodies are streamed, so only this prefix is kept in memory.
+var DumpBodyLimit = 64 * 1024
+
+const (
+	// AccessLogger is the sub logger every exchange is logged to.
+	AccessLogger = "access"
+	// DumpLogger is the sub logger request and response dumps are written
+	// to. Dumps are only made if it is configured in subLogs.
+	DumpLogger = "dump"
 )
 
+// HttpLogHandler logs every exchange with structured fields to the access
+// logger, and dumps requests and responses to the dump logger if there is
+// one.
 func HttpLogHandler(next http.Handler) http.Handler {
+	return httpLog(next, nil)
+}
+
+// HttpLogCaptureHandler returns HttpLogHandler, also appending every
+// exchange to w in the capture format, see package capture.
+func HttpLogCaptureHandler(w *capture.Writer) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return httpLog(next, w)
+	}
+}
+
+func httpLog(next http.Handler, cw *capture.Writer) http.Handler {
+	dump, _ := log.Lookup(DumpLogger)
+	return newHTTPLog(next, log.Logger(AccessLogger), dump, cw)
+}
+
+// newHTTPLog logs to access, and dumps to dump unless it is nil.
+func newHTTPLog(next http.Handler, access, dump *zap.Logger, cw *capture.Writer) http.Handler {
+	dumping := dump != nil
+	limit := 0
+	if dumping || cw != nil {
+		limit = DumpBodyLimit
+	}
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
-		rec := httptest.NewRecorder()
-		next.ServeHTTP(rec, r)
-		for k, v := range rec.Header() {
-			w.Header()[k] = v
+		start := time.Now()
+		var reqBody *core.TeeReadCloser
+		if limit > 0 && r.Body != nil && r.Body != http.NoBody {
+			reqBody = core.NewTeeReadCloser(r.Body, limit)
+			r.Body = reqBody
+		}
+		r, upstream := core.TraceUpstream(r)
+		tw := core.NewTeeResponseWriter(w, limit)
+		var digest hash.Hash
+		if cw != nil {
+			digest = sha256.New()
+			tw.SetDigest(digest)
 		}
+		next.ServeHTTP(tw, r)
+		duration := time.Since(start)
 
-		w.WriteHeader(rec.Code)
+		access.Info("access", accessFields(r, tw, duration, upstream)...)
 
-		b := rec.Body.Bytes()
-		w.Write(b)
-		dump, err := httputil.DumpRequest(r, true)
-		if err != nil {
-			log.Println(err)
-			return
+		if cw != nil {
+			rec := newCaptureRecord(r, reqBody, tw, digest, upstream)
+			rec.Time = start
+			rec.DurationMs = float64(duration) / float64(time.Millisecond)
+			if err := cw.Write(rec); err != nil {
+				access.Error("failed to write capture", zap.Error(err))
+			}
 		}
-		fmt.Fprintf(os.Stdout, "REQUEST \n%s\n", dump)
 
-		//todo: write response body to file, noheaders because it's a http2.0 response
-		dump, err = dumpResponse(rec)
-		if err != nil {
-			log.Println(err)
-			return
+		if dumping {
+			dumpExchange(dump, r, reqBody, tw)
 		}
-		fmt.Fprintf(os.Stdout, "RESPONSE \n%s\n", dump)
 	})
 }
 
-func dumpResponse(rr *httptest.ResponseRecorder) ([]byte, error) {
-	var b bytes.Buffer
-	r := rr.Result()
-	// Status line
-	text := r.Status
-	if text == "" {
-		text = http.StatusText(r.StatusCode)
-	} else {
-		// Just to reduce stutter, if user set r.Status to "200 OK" and StatusCode to 200.
-		// Not important.
-		text = strings.TrimPrefix(text, strconv.Itoa(r.StatusCode)+" ")
+func accessFields(r *http.Request, tw *core.TeeResponseWriter, duration time.Duration, upstream *core.UpstreamConn) []zap.Field {
+	status := tw.Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	fields := []zap.Field{
+		zap.String("method", r.Method),
+		zap.String("host", r.Host),
+		zap.String("path", r.URL.Path),
+		zap.Int("status", status),
+		zap.Int64("bytes", tw.Size()),
+		zap.Duration("duration", duration),
+		zap.String("client", r.RemoteAddr),
+		zap.String("proto", r.Proto),
 	}
+	if mapped := upstream.Mapped(); mapped != "" {
+		fields = append(fields, zap.String("mapped", mapped))
+	}
+	if addr := upstream.Addr(); addr != "" {
+		fields = append(fields, zap.String("upstream", addr), zap.Bool("reused", upstream.Reused()))
+	}
+	if r.TLS != nil {
+		fields = append(fields, zap.String("tls", core.TLSVersionName(r.TLS.Version)))
+	}
+	return fields
+}
 
-	if _, err := fmt.Fprintf(&b, "HTTP/%d.%d %03d %s\r\n", r.ProtoMajor, r.ProtoMinor, r.StatusCode, text); err != nil {
+func dumpExchange(logger *zap.Logger, r *http.Request, reqBody *core.TeeReadCloser, tw *core.TeeResponseWriter) {
+	req, err := httputil.DumpRequest(r, false)
+	if err != nil {
+		logger.Error("failed to dump request", zap.Error(err))
+		return
+	}
+	if reqBody != nil {
+		req = appendBody(req, reqBody.LimitedBuffer)
+	}
+	//todo: write response body to file, noheaders because it's a http2.0 response
+	res, err := dumpResponse(r, tw)
+	if err != nil {
+		logger.Error("failed to dump response", zap.Error(err))
+		return
+	}
+	logger.Info("dump",
+		zap.String("method", r.Method),
+		zap.String("host", r.Host),
+		zap.String("path", r.URL.Path),
+		zap.ByteString("request", req),
+		zap.ByteString("response", res),
+	)
+}
+
+func newCaptureRecord(r *http.Request, reqBody *core.TeeReadCloser, tw *core.TeeResponseWriter, digest hash.Hash, upstream *core.UpstreamConn) *capture.Record {
+	scheme := "http"
+	if r.TLS != nil {
+		scheme = "https"
+	}
+	status := tw.Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	// Responses not received from an origin, such as mapped files, are
+	// recorded in the protocol of the request.
+	proto := upstream.Proto()
+	if proto == "" {
+		proto = r.Proto
+	}
+	rec := &capture.Record{
+		Request: capture.Request{
+			Method: r.Method,
+			URL:    scheme + "://" + r.Host + r.URL.RequestURI(),
+			Proto:  r.Proto,
+			Header: r.Header.Clone(),
+		},
+		Response: capture.Response{
+			Status:     status,
+			Proto:      proto,
+			Header:     tw.Header().Clone(),
+			Body:       tw.Bytes(),
+			BodySize:   tw.Size(),
+			BodySHA256: hex.EncodeToString(digest.Sum(nil)),
+		},
+	}
+	rec.Response.BodyTruncated = tw.Truncated()
+	if reqBody != nil {
+		rec.Request.Body = reqBody.Bytes()
+		rec.Request.BodySize = reqBody.Size()
+		rec.Request.BodyTruncated = reqBody.Truncated()
+	}
+	return rec
+}
+
+func dumpResponse(r *http.Request, tw *core.TeeResponseWriter) ([]byte, error) {
+	var b bytes.Buffer
+	status := tw.Status()
+	if status == 0 {
+		status = http.StatusOK
+	}
+	// Status line
+	if _, err := fmt.Fprintf(&b, "HTTP/%d.%d %03d %s\r\n", r.ProtoMajor, r.ProtoMinor, status, http.StatusText(status)); err != nil {
 		return nil, err
 	}
-	keys := make([]string, 0, len(rr.Header()))
-	for k := range rr.Header() {
+	keys := make([]string, 0, len(tw.Header()))
+	for k := range tw.Header() {
 		keys = append(keys, k)
 	}
 	if len(keys) > 0 {
@@ -68,7 +202,7 @@ func dumpResponse(rr *httptest.ResponseRecorder) ([]byte, error) {
 	}
 
 	for _, k := range keys {
-		if _, err := fmt.Fprintf(&b, "%s: %s\r\n", k, strings.Join(rr.Header()[k], ",")); err != nil {
+		if _, err := fmt.Fprintf(&b, "%s: %s\r\n", k, strings.Join(tw.Header()[k], ",")); err != nil {
 			return nil, err
 		}
 	}
@@ -77,32 +211,32 @@ func dumpResponse(rr *httptest.ResponseRecorder) ([]byte, error) {
 		return nil, err
 	}
 	// Body
-	var b1 bytes.Buffer
-	b1.Reset()
-	r.Body, _ = drainBody(r.Body)
-	r.Write(&b1)
-	bb := b1.Bytes()
-	n := bytes.Index(bb, []byte("\r\n\r\n"))
-	if n > -1 {
-		bb = bb[n+4:]
-	}
-
-	b.Write(bb)
-
-	return b.Bytes(), nil
+	return appendDecodedBody(b.Bytes(), tw.Header(), tw.LimitedBuffer), nil
 }
 
-func drainBody(b io.ReadCloser) (r2 io.ReadCloser, err error) {
-	if b == nil || b == http.NoBody {
-		// No copying needed. Preserve the magic sentinel meaning of NoBody.
-		return http.NoBody, nil
+// appendDecodedBody appends the body like appendBody, decoding it first if
+// its Content-Encoding is one core can decode.
+func appendDecodedBody(dump []byte, h http.Header, body *core.LimitedBuffer) []byte {
+	codings := core.ContentEncoding(h)
+	if len(codings) == 0 || !core.CanDecode(codings...) {
+		return appendBody(dump, body)
+	}
+	decoded, truncated, err := core.DecodeBody(body.Bytes(), DumpBodyLimit, codings...)
+	if err != nil && !body.Truncated() {
+		return appendBody(dump, body)
 	}
-	var buf bytes.Buffer
-	if _, err = buf.ReadFrom(b); err != nil {
-		return b, err
+	dump = append(dump, decoded...)
+	if truncated || body.Truncated() {
+		dump = append(dump, "\n... (truncated)"...)
 	}
-	if err = b.Close(); err != nil {
-		return b, err
+	return dump
+}
+
+// appendBody appends the captured body prefix, noting when it was cut short.
+func appendBody(dump []byte, body *core.LimitedBuffer) []byte {
+	dump = append(dump, body.Bytes()...)
+	if body.Truncated() {
+		dump = append(dump, "\n... (truncated)"...)
 	}
-	return io.NopCloser(bytes.NewReader(buf.Bytes())), nil
+	return dump
 }
@@ -0,0 +1,118 @@
+package middleware
+
+import (
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/millken/httpctl/capture"
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/core"
+	"github.com/stretchr/testify/require"
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+)
+
+// newTestLogger returns a JSON logger writing to buf, so that tests don't
+// register the global sub loggers, which can only be done once.
+func newTestLogger(buf *bytes.Buffer) *zap.Logger {
+	enc := zapcore.NewJSONEncoder(zap.NewProductionEncoderConfig())
+	return zap.New(zapcore.NewCore(enc, zapcore.AddSync(buf), zap.DebugLevel))
+}
+
+func readEntries(t *testing.T, buf *bytes.Buffer) []map[string]interface{} {
+	var entries []map[string]interface{}
+	scanner := bufio.NewScanner(buf)
+	for scanner.Scan() {
+		entry := make(map[string]interface{})
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestHttpLogHandler(t *testing.T) {
+	require := require.New(t)
+	var accessLog, dumpLog, captured bytes.Buffer
+	h := newHTTPLog(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		w.Header().Set("Content-Type", "text/plain")
+		w.WriteHeader(http.StatusCreated)
+		w.Write(append([]byte("echo "), body...))
+	}), newTestLogger(&accessLog), newTestLogger(&dumpLog), capture.NewWriter(&captured))
+	r := httptest.NewRequest("POST", "http://example.com/api?x=1", strings.NewReader("ping"))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, r)
+	require.Equal("echo ping", w.Body.String())
+
+	entries := readEntries(t, &accessLog)
+	require.Len(entries, 1)
+	entry := entries[0]
+	require.Equal("access", entry["msg"])
+	require.Equal("POST", entry["method"])
+	require.Equal("example.com", entry["host"])
+	require.Equal("/api", entry["path"])
+	require.Equal(float64(201), entry["status"])
+	require.Equal(float64(9), entry["bytes"])
+	require.Equal("HTTP/1.1", entry["proto"])
+	require.Contains(entry, "duration")
+	require.NotContains(entry, "upstream")
+
+	entries = readEntries(t, &dumpLog)
+	require.Len(entries, 1)
+	require.Contains(entries[0]["request"], "POST http://example.com/api?x=1 HTTP/1.1")
+	require.Contains(entries[0]["request"], "ping")
+	require.Contains(entries[0]["response"], "HTTP/1.1 201 Created")
+	require.Contains(entries[0]["response"], "echo ping")
+
+	rec, err := capture.NewReader(&captured).Next()
+	require.NoError(err)
+	require.Equal(201, rec.Response.Status)
+	require.Equal([]byte("ping"), rec.Request.Body)
+}
+
+func TestAppendDecodedBody(t *testing.T) {
+	require := require.New(t)
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	zw.Write([]byte("<html>hello</html>"))
+	zw.Close()
+
+	body := core.NewLimitedBuffer(DumpBodyLimit)
+	body.Write(buf.Bytes())
+	h := http.Header{"Content-Encoding": {"gzip"}}
+	require.Equal("<html>hello</html>", string(appendDecodedBody(nil, h, body)))
+
+	h.Set("Content-Encoding", "compress")
+	require.Equal(buf.Bytes(), appendDecodedBody(nil, h, body))
+}
+
+func TestHttpLogHandler_UpstreamProto(t *testing.T) {
+	require := require.New(t)
+	origin := httptest.NewUnstartedServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, r.Proto)
+	}))
+	origin.EnableHTTP2 = true
+	origin.StartTLS()
+	defer origin.Close()
+	mx, err := core.NewMux(config.Server{Transport: config.Transport{InsecureSkipVerify: true}}, nil, nil)
+	require.NoError(err)
+	defer mx.Close()
+
+	var captured bytes.Buffer
+	h := newHTTPLog(mx, zap.NewNop(), nil, capture.NewWriter(&captured))
+	w := httptest.NewRecorder()
+	h.ServeHTTP(w, httptest.NewRequest("GET", origin.URL+"/", nil))
+	require.Equal("HTTP/2.0", w.Body.String())
+
+	rec, err := capture.NewReader(&captured).Next()
+	require.NoError(err)
+	require.Equal("HTTP/1.1", rec.Request.Proto)
+	require.Equal("HTTP/2.0", rec.Response.Proto)
+}
@@ -1,14 +1,46 @@
 package middleware
 
 import (
+	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"time"
 
-	"github.com/gorilla/handlers"
+	"github.com/millken/httpctl/core"
 )
 
+// LoggingHandler logs every exchange to dst in the Apache Common Log
+// Format.
+//
+// Deprecated: Use HttpLogHandler, which logs structured fields to the
+// access logger.
 func LoggingHandler(dst io.Writer) func(http.Handler) http.Handler {
-	return func(h http.Handler) http.Handler {
-		return handlers.LoggingHandler(dst, h)
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			start := time.Now()
+			tw := core.NewTeeResponseWriter(w, 0)
+			next.ServeHTTP(tw, r)
+			status := tw.Status()
+			if status == 0 {
+				status = http.StatusOK
+			}
+			host, _, err := net.SplitHostPort(r.RemoteAddr)
+			if err != nil {
+				host = r.RemoteAddr
+			}
+			user := "-"
+			if r.URL.User != nil && r.URL.User.Username() != "" {
+				user = r.URL.User.Username()
+			}
+			uri := r.RequestURI
+			if r.Method == http.MethodConnect || uri == "" {
+				uri = r.Host
+			}
+			// One write per line, so concurrent lines don't interleave.
+			line := fmt.Sprintf("%s - %s [%s] \"%s %s %s\" %d %d\n",
+				host, user, start.Format("02/Jan/2006:15:04:05 -0700"), r.Method, uri, r.Proto, status, tw.Size())
+			io.WriteString(dst, line)
+		})
 	}
 }
@@ -0,0 +1,25 @@
+package middleware
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"regexp"
+	"testing"
+
+	"github.com/stretchr/testify/require"
+)
+
+func TestLoggingHandler(t *testing.T) {
+	require := require.New(t)
+	var buf bytes.Buffer
+	h := LoggingHandler(&buf)(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound)
+		io.WriteString(w, "missing")
+	}))
+	r := httptest.NewRequest("GET", "http://example.com/a?b=1", nil)
+	r.RemoteAddr = "192.0.2.1:1234"
+	h.ServeHTTP(httptest.NewRecorder(), r)
+	require.Regexp(regexp.MustCompile(`^192\.0\.2\.1 - - \[\d\d/\w{3}/\d{4}:\d\d:\d\d:\d\d [+-]\d{4}\] "GET http://example.com/a\?b=1 HTTP/1\.1" 404 7\n$`), buf.String())
+}
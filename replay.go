@@ -0,0 +1,55 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+
+	"github.com/millken/httpctl/capture"
+)
+
+// replay re-issues the requests of the capture file at path through rt and
+// prints how the responses differ. It returns the process exit code: 0 if
+// every response matched, 1 otherwise.
+func replay(ctx context.Context, rt http.RoundTripper, path string) int {
+	f, err := os.Open(path)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "ERROR: Failed to open capture file: %v\n", err)
+		return 1
+	}
+	defer f.Close()
+
+	replayer := capture.NewReplayer(rt)
+	reader := capture.NewReader(f)
+	var total, failed int
+	for {
+		rec, err := reader.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			fmt.Fprintf(os.Stderr, "ERROR: %v\n", err)
+			return 1
+		}
+		total++
+		result := replayer.Replay(ctx, rec)
+		switch {
+		case result.Err != nil:
+			failed++
+			fmt.Printf("line %d: %s %s: %v\n", reader.Line(), rec.Request.Method, rec.Request.URL, result.Err)
+		case len(result.Diffs) > 0:
+			failed++
+			fmt.Printf("line %d: %s %s differs\n", reader.Line(), rec.Request.Method, rec.Request.URL)
+			for _, d := range result.Diffs {
+				fmt.Printf("\t%s\n", d)
+			}
+		}
+	}
+	fmt.Printf("%d replayed, %d matched, %d differed\n", total, total-failed, failed)
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
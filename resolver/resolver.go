@@ -6,6 +6,7 @@ import (
 	"math/rand"
 	"net"
 	"runtime"
+	"sort"
 	"strings"
 	"sync"
 	"time"
@@ -74,6 +75,48 @@ func (r *Resolver) Lookup(host string, nameservers ...string) ([]string, string,
 	return r.lookupHost(host, nameservers...)
 }
 
+// Entry is a cached lookup result.
+type Entry struct {
+	Host       string   `json:"host"`
+	Addrs      []string `json:"addrs"`
+	Nameserver string   `json:"nameserver"`
+	// Expires is nil for entries that never expire.
+	Expires *time.Time `json:"expires,omitempty"`
+}
+
+// Cache returns the cached lookups that have not expired, sorted by host.
+func (r *Resolver) Cache() []Entry {
+	r.RLock()
+	entries := make([]Entry, 0, len(r.cache))
+	for host, item := range r.cache {
+		if item.Expired() {
+			continue
+		}
+		entry := Entry{
+			Host:       host,
+			Addrs:      item.Object,
+			Nameserver: item.Nameserver,
+		}
+		if item.Expiration != 0 {
+			expires := time.Unix(0, item.Expiration)
+			entry.Expires = &expires
+		}
+		entries = append(entries, entry)
+	}
+	r.RUnlock()
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Host < entries[j].Host })
+	return entries
+}
+
+// Flush empties the cache and returns the number of entries removed.
+func (r *Resolver) Flush() int {
+	r.Lock()
+	n := len(r.cache)
+	r.cache = make(map[string]Item)
+	r.Unlock()
+	return n
+}
+
 func (r *Resolver) deleteExpired() {
 	r.Lock()
 	for k, v := range r.cache {
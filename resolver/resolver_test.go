@@ -1,7 +1,9 @@
 package resolver
 
 import (
+	"encoding/json"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/require"
 )
@@ -30,3 +32,29 @@ func TestResolver_NoFresh(t *testing.T) {
 
 	}
 }
+
+func TestResolver_Cache(t *testing.T) {
+	require := require.New(t)
+	r := NewResolver(testResolvers...)
+	expires := time.Now().Add(time.Minute)
+	r.cache["b.example.com"] = Item{Nameserver: "8.8.8.8:53", Object: []string{"10.0.0.2"}, Expiration: expires.UnixNano()}
+	r.cache["a.example.com"] = Item{Nameserver: "8.8.8.8:53", Object: []string{"10.0.0.1"}, Expiration: expires.UnixNano()}
+	r.cache["old.example.com"] = Item{Object: []string{"10.0.0.3"}, Expiration: time.Now().Add(-time.Minute).UnixNano()}
+	r.cache["static.example.com"] = Item{Object: []string{"10.0.0.4"}}
+
+	entries := r.Cache()
+	require.Len(entries, 3)
+	require.Equal("a.example.com", entries[0].Host)
+	require.Equal([]string{"10.0.0.1"}, entries[0].Addrs)
+	require.Equal("8.8.8.8:53", entries[0].Nameserver)
+	require.True(expires.Equal(*entries[0].Expires))
+	// Entries that never expire have no expiry rather than 1970.
+	require.Equal("static.example.com", entries[2].Host)
+	require.Nil(entries[2].Expires)
+	b, err := json.Marshal(entries[2])
+	require.NoError(err)
+	require.JSONEq(`{"host":"static.example.com","addrs":["10.0.0.4"],"nameserver":""}`, string(b))
+
+	require.Equal(4, r.Flush())
+	require.Empty(r.Cache())
+}
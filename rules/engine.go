@@ -0,0 +1,333 @@
+package rules
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/millken/httpctl/core"
+	"github.com/millken/httpctl/log"
+	"github.com/pkg/errors"
+	"go.uber.org/zap"
+)
+
+// MaxBodySize is the largest body that body actions are applied to. Larger
+// bodies are passed on unchanged.
+var MaxBodySize = 16 << 20
+
+var errBodyTooLarge = errors.New("body too large for rules, passed on unchanged")
+
+// Engine applies the rules of a rules file to the traffic of a core.Mux. It
+// is used as middleware:
+//
+//	mux.Use(engine.Handler)
+type Engine struct {
+	path string
+	set  atomic.Value // *ruleSet
+	log  *zap.Logger
+
+	// mu serializes reloads; modTime and size identify the loaded file.
+	mu      sync.Mutex
+	modTime time.Time
+	size    int64
+}
+
+// NewEngine returns an Engine applying the rules file at path.
+func NewEngine(path string) (*Engine, error) {
+	e := &Engine{path: path, log: log.Logger("rules")}
+	if err := e.Reload(); err != nil {
+		return nil, err
+	}
+	return e, nil
+}
+
+// Reload reads the rules file again. The current rules are kept if the file
+// is invalid.
+func (e *Engine) Reload() error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	if fi, err := os.Stat(e.path); err == nil {
+		e.modTime, e.size = fi.ModTime(), fi.Size()
+	}
+	set, err := load(e.path)
+	if err != nil {
+		return err
+	}
+	e.set.Store(set)
+	e.log.Info("loaded rules", zap.String("file", e.path), zap.Int("rules", len(set.rules)))
+	return nil
+}
+
+// Watch reloads the rules file whenever it changes, checking every
+// interval until ctx is done.
+func (e *Engine) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+		if !e.changed() {
+			continue
+		}
+		if err := e.Reload(); err != nil {
+			e.log.Error("failed to reload rules, keeping the current ones", zap.Error(err))
+		}
+	}
+}
+
+func (e *Engine) changed() bool {
+	fi, err := os.Stat(e.path)
+	if err != nil {
+		return false
+	}
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	return !fi.ModTime().Equal(e.modTime) || fi.Size() != e.size
+}
+
+// Rules returns the rules currently applied.
+func (e *Engine) Rules() []Rule {
+	return e.set.Load().(*ruleSet).file.Rules
+}
+
+// Handler applies the request actions of the matching rules to r before
+// passing it to next, and the response actions to what next writes.
+func (e *Engine) Handler(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Upgraded connections are not HTTP after the handshake.
+		if r.Header.Get("Upgrade") != "" {
+			next.ServeHTTP(w, r)
+			return
+		}
+		set := e.set.Load().(*ruleSet)
+		var requestRules, responseRules []*rule
+		for _, c := range set.rules {
+			if !c.matchRequest(r) {
+				continue
+			}
+			if c.request != nil {
+				requestRules = append(requestRules, c)
+			}
+			if c.response != nil {
+				responseRules = append(responseRules, c)
+			}
+		}
+		local := ""
+		for _, c := range requestRules {
+			var err error
+			if r, err = e.applyRequest(c, r); err != nil {
+				if r.Context().Err() != nil {
+					return
+				}
+				e.log.Warn("failed to apply rule", zap.String("rule", c.name), zap.Error(err))
+			}
+			if c.request.mapLocal != nil {
+				if name, ok := c.request.mapLocal.file(r.URL.Path); ok {
+					local = name
+				}
+			}
+		}
+		if local != "" {
+			// The Mux answers with the file in place of the origin.
+			r = core.WithResponder(r, func(r *http.Request) *http.Response {
+				return localResponse(r, local)
+			})
+		}
+		if len(responseRules) == 0 {
+			next.ServeHTTP(w, r)
+			return
+		}
+		rw := &responseWriter{ResponseWriter: w, engine: e, r: r, rules: responseRules}
+		next.ServeHTTP(rw, r)
+		rw.finish()
+	})
+}
+
+// applyRequest applies the request actions of c other than mapLocal. The
+// returned request replaces r, also when an error is returned.
+func (e *Engine) applyRequest(c *rule, r *http.Request) (*http.Request, error) {
+	a := c.request
+	e.log.Debug("applying rule to request", zap.String("rule", c.name), zap.String("host", r.Host), zap.String("uri", r.URL.RequestURI()))
+	if a.rewriteURL != nil {
+		uri := a.rewriteURL.re.ReplaceAllString(r.URL.RequestURI(), string(a.rewriteURL.replacement))
+		u, err := r.URL.Parse(uri)
+		if err != nil {
+			return r, err
+		}
+		r.URL.Path, r.URL.RawPath, r.URL.RawQuery = u.Path, u.RawPath, u.RawQuery
+	}
+	if a.host != "" {
+		r.Host = a.host
+		r.URL.Host = a.host
+	}
+	if a.mapRemote != nil {
+		r = a.mapRemote.apply(r)
+	}
+	a.applyHeaders(r.Header)
+	if a.modifiesBody() && r.Body != nil && r.Body != http.NoBody {
+		raw, err := io.ReadAll(io.LimitReader(r.Body, int64(MaxBodySize)+1))
+		if err == nil && len(raw) > MaxBodySize {
+			err = errBodyTooLarge
+		}
+		var b []byte
+		if err == nil {
+			b, err = decodeBody(raw, r.Header)
+		}
+		if err != nil {
+			// The body is sent unchanged: what was read, then the rest.
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(raw), r.Body), r.Body}
+			return r, err
+		}
+		r.Body.Close()
+		b = a.applyBody(b)
+		r.Body = io.NopCloser(bytes.NewReader(b))
+		r.ContentLength = int64(len(b))
+		r.TransferEncoding = nil
+	}
+	return r, sleep(r.Context(), a.delay)
+}
+
+// decodeBody returns body decoded if h has a Content-Encoding, which is
+// then removed from h.
+func decodeBody(body []byte, h http.Header) ([]byte, error) {
+	codings := core.ContentEncoding(h)
+	if len(codings) == 0 || len(body) == 0 {
+		return body, nil
+	}
+	decoded, truncated, err := core.DecodeBody(body, MaxBodySize, codings...)
+	if err != nil {
+		return nil, err
+	}
+	if truncated {
+		return nil, errBodyTooLarge
+	}
+	h.Del("Content-Encoding")
+	return decoded, nil
+}
+
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return nil
+	}
+	t := time.NewTimer(d)
+	defer t.Stop()
+	select {
+	case <-t.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// responseWriter applies the response actions of the rules matching the
+// status. Responses are streamed unless a body action applies, in which
+// case the body is buffered and written by finish.
+type responseWriter struct {
+	http.ResponseWriter
+	engine *Engine
+	r      *http.Request
+	rules  []*rule
+
+	wroteHeader bool
+	status      int
+	// body actions of the matching rules, nil when streaming.
+	bodyActions []*actions
+	buf         bytes.Buffer
+}
+
+func (w *responseWriter) WriteHeader(code int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = code
+	var delay time.Duration
+	for _, c := range w.rules {
+		if !c.matchStatus(code) {
+			continue
+		}
+		a := c.response
+		w.engine.log.Debug("applying rule to response", zap.String("rule", c.name), zap.String("host", w.r.Host), zap.Int("status", code))
+		a.applyHeaders(w.Header())
+		if a.status != 0 {
+			w.status = a.status
+		}
+		if a.modifiesBody() {
+			w.bodyActions = append(w.bodyActions, a)
+		}
+		delay += a.delay
+	}
+	sleep(w.r.Context(), delay)
+	if w.bodyActions == nil {
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+}
+
+func (w *responseWriter) Write(p []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.bodyActions == nil {
+		return w.ResponseWriter.Write(p)
+	}
+	if w.buf.Len()+len(p) > MaxBodySize {
+		w.engine.log.Warn("body too large for rules, passed on unchanged", zap.String("host", w.r.Host), zap.String("uri", w.r.URL.RequestURI()))
+		w.bodyActions = nil
+		w.ResponseWriter.WriteHeader(w.status)
+		if _, err := w.ResponseWriter.Write(w.buf.Bytes()); err != nil {
+			return 0, err
+		}
+		w.buf = bytes.Buffer{}
+		return w.ResponseWriter.Write(p)
+	}
+	return w.buf.Write(p)
+}
+
+// Flush is a no-op while the body is buffered.
+func (w *responseWriter) Flush() {
+	if w.bodyActions != nil {
+		return
+	}
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish applies the body actions to the buffered body and writes it.
+func (w *responseWriter) finish() {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.bodyActions == nil {
+		return
+	}
+	h := w.Header()
+	body, err := decodeBody(w.buf.Bytes(), h)
+	if err != nil {
+		w.engine.log.Warn("failed to decode body for rules, passed on unchanged", zap.String("host", w.r.Host), zap.Error(err))
+		body = w.buf.Bytes()
+	} else {
+		for _, a := range w.bodyActions {
+			body = a.applyBody(body)
+		}
+	}
+	h.Del("Transfer-Encoding")
+	h.Set("Content-Length", strconv.Itoa(len(body)))
+	w.ResponseWriter.WriteHeader(w.status)
+	w.ResponseWriter.Write(body)
+}
@@ -0,0 +1,138 @@
+package rules
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"github.com/millken/httpctl/core"
+)
+
+// apply returns r set up to be proxied to the mapped origin, or r itself
+// if its path is not under the prefix.
+func (m *mapRemote) apply(r *http.Request) *http.Request {
+	if !strings.HasPrefix(r.URL.Path, m.prefix) {
+		return r
+	}
+	p := m.target.Path + strings.TrimPrefix(r.URL.Path, m.prefix)
+	if !strings.HasPrefix(p, "/") {
+		p = "/" + p
+	}
+	// r.URL is shared with the request r was derived from.
+	r = core.WithUpstreamURL(r, m.target)
+	u := *r.URL
+	u.Path, u.RawPath = p, ""
+	r.URL = &u
+	core.ReportMapping(r.Context(), m.target.Scheme+"://"+m.target.Host+r.URL.RequestURI())
+	return r
+}
+
+// file returns the local file a request for urlPath is mapped to, and
+// false if urlPath is not under the prefix.
+func (m *mapLocal) file(urlPath string) (string, bool) {
+	if !strings.HasPrefix(urlPath, m.prefix) {
+		return "", false
+	}
+	if fi, err := os.Stat(m.path); err != nil || !fi.IsDir() {
+		return m.path, true
+	}
+	// Cleaning the rooted path keeps it inside the directory.
+	rest := path.Clean("/" + strings.TrimPrefix(urlPath, m.prefix))
+	return filepath.Join(m.path, filepath.FromSlash(rest)), true
+}
+
+// localResponse returns the response serveLocal writes for r and the file
+// name, with the body streamed as it is written.
+func localResponse(r *http.Request, name string) *http.Response {
+	pr, pw := io.Pipe()
+	lw := &localWriter{header: make(http.Header), body: pw, ready: make(chan struct{})}
+	go func() {
+		serveLocal(lw, r, name)
+		lw.WriteHeader(http.StatusOK)
+		pw.Close()
+	}()
+	<-lw.ready
+	contentLength := int64(-1)
+	if n, err := strconv.ParseInt(lw.sent.Get("Content-Length"), 10, 64); err == nil {
+		contentLength = n
+	}
+	return &http.Response{
+		Status:        fmt.Sprintf("%d %s", lw.status, http.StatusText(lw.status)),
+		StatusCode:    lw.status,
+		Proto:         "HTTP/1.1",
+		ProtoMajor:    1,
+		ProtoMinor:    1,
+		Header:        lw.sent,
+		Body:          pr,
+		ContentLength: contentLength,
+		Request:       r,
+	}
+}
+
+// localWriter is the http.ResponseWriter of localResponse. The body written
+// goes to the pipe read by the response body.
+type localWriter struct {
+	header http.Header
+	// sent is a copy of header taken by WriteHeader, and status the code
+	// it was called with.
+	sent   http.Header
+	status int
+	body   *io.PipeWriter
+	ready  chan struct{}
+}
+
+func (lw *localWriter) Header() http.Header {
+	return lw.header
+}
+
+func (lw *localWriter) WriteHeader(status int) {
+	if lw.sent != nil {
+		return
+	}
+	lw.sent, lw.status = lw.header.Clone(), status
+	close(lw.ready)
+}
+
+func (lw *localWriter) Write(b []byte) (int, error) {
+	lw.WriteHeader(http.StatusOK)
+	return lw.body.Write(b)
+}
+
+// serveLocal answers r with the file name, or index.html if name is a
+// directory. Content-Type follows the file extension, and ranges and
+// conditional requests are supported.
+func serveLocal(w http.ResponseWriter, r *http.Request, name string) {
+	core.ReportMapping(r.Context(), "file:"+name)
+	f, err := os.Open(name)
+	if err == nil {
+		var fi os.FileInfo
+		if fi, err = f.Stat(); err == nil && fi.IsDir() {
+			f.Close()
+			name = filepath.Join(name, "index.html")
+			f, err = os.Open(name)
+		}
+	}
+	switch {
+	case os.IsNotExist(err):
+		http.NotFound(w, r)
+		return
+	case os.IsPermission(err):
+		http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer f.Close()
+	fi, err := f.Stat()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	http.ServeContent(w, r, fi.Name(), fi.ModTime(), f)
+}
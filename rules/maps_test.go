@@ -0,0 +1,183 @@
+package rules
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/core"
+	"github.com/stretchr/testify/require"
+)
+
+// serveMux answers r through a Mux using e, as httpctl does.
+func serveMux(t *testing.T, e *Engine, r *http.Request) *httptest.ResponseRecorder {
+	mx, err := core.NewMux(config.Server{}, nil, nil)
+	require.NoError(t, err)
+	defer mx.Close()
+	mx.Use(e.Handler)
+	w := httptest.NewRecorder()
+	mx.ServeHTTP(w, r)
+	return w
+}
+
+func TestMapLocal(t *testing.T) {
+	require := require.New(t)
+	origin := httptest.NewServer(echo)
+	defer origin.Close()
+	u, err := url.Parse(origin.URL)
+	require.NoError(err)
+	dir := t.TempDir()
+	dist := filepath.Join(dir, "dist")
+	require.NoError(os.MkdirAll(filepath.Join(dist, "docs"), 0700))
+	require.NoError(os.WriteFile(filepath.Join(dist, "app.js"), []byte("console.log('local')"), 0600))
+	require.NoError(os.WriteFile(filepath.Join(dist, "docs", "index.html"), []byte("<h1>docs</h1>"), 0600))
+	require.NoError(os.WriteFile(filepath.Join(dir, "secret.txt"), []byte("secret"), 0600))
+	require.NoError(os.WriteFile(filepath.Join(dir, "main.css"), []byte("body{}"), 0600))
+	path := filepath.Join(dir, "rules.yaml")
+	require.NoError(os.WriteFile(path, []byte(`
+rules:
+  - match:
+      host: 127.0.0.1
+    request:
+      mapLocal:
+        prefix: /static/
+        path: dist
+  - match:
+      host: 127.0.0.1
+      path: ^/main.css$
+    request:
+      mapLocal:
+        path: main.css
+`), 0600))
+	e, err := NewEngine(path)
+	require.NoError(err)
+
+	get := func(target string, header http.Header) *httptest.ResponseRecorder {
+		r := httptest.NewRequest("GET", target, nil)
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		return serveMux(t, e, r)
+	}
+	w := get(origin.URL+"/static/app.js", nil)
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("console.log('local')", w.Body.String())
+	require.Contains(w.Header().Get("Content-Type"), "javascript")
+	require.Empty(w.Header().Get("X-Host"))
+
+	w = get(origin.URL+"/static/app.js", http.Header{"Range": {"bytes=0-6"}})
+	require.Equal(http.StatusPartialContent, w.Code)
+	require.Equal("console", w.Body.String())
+
+	w = get(origin.URL+"/main.css", nil)
+	require.Equal("body{}", w.Body.String())
+	require.Contains(w.Header().Get("Content-Type"), "text/css")
+
+	w = get(origin.URL+"/static/docs/", nil)
+	require.Equal("<h1>docs</h1>", w.Body.String())
+
+	w = get(origin.URL+"/static/../secret.txt", nil)
+	require.NotEqual("secret", w.Body.String())
+	w = get(origin.URL+"/static/missing.js", nil)
+	require.Equal(http.StatusNotFound, w.Code)
+
+	// Paths outside the prefix and other hosts go to the origin.
+	w = get(origin.URL+"/index.html", nil)
+	require.Equal(u.Host, w.Header().Get("X-Host"))
+	w = get("http://localhost:"+u.Port()+"/static/app.js", nil)
+	require.Equal("localhost:"+u.Port(), w.Header().Get("X-Host"))
+}
+
+func TestMapLocal_Reported(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	file := filepath.Join(dir, "app.js")
+	require.NoError(os.WriteFile(file, []byte("local"), 0600))
+	e := newTestEngine(t, "rules: [{request: {mapLocal: {path: "+file+"}}}]")
+	r, uc := core.TraceUpstream(httptest.NewRequest("GET", "http://www.example.com/app.js", nil))
+	w := serveMux(t, e, r)
+	require.Equal("local", w.Body.String())
+	require.Equal("file:"+file, uc.Mapped())
+}
+
+func TestMapLocal_Recorded(t *testing.T) {
+	require := require.New(t)
+	file := filepath.Join(t.TempDir(), "app.js")
+	require.NoError(os.WriteFile(file, []byte("console.log('local')"), 0600))
+	e := newTestEngine(t, "rules: [{request: {mapLocal: {path: "+file+"}}}]")
+	mx, err := core.NewMux(config.Server{}, nil, nil)
+	require.NoError(err)
+	defer mx.Close()
+	mx.Use(e.Handler)
+	var flows []*core.Flow
+	mx.HandleFlow(func(f *core.Flow) { flows = append(flows, f) })
+
+	w := httptest.NewRecorder()
+	mx.ServeHTTP(w, httptest.NewRequest("GET", "http://www.example.com/app.js", nil))
+	require.Equal("console.log('local')", w.Body.String())
+	require.Len(flows, 1)
+	require.Equal("http://www.example.com/app.js", flows[0].Request.URL)
+	require.Equal(http.StatusOK, flows[0].Response.StatusCode)
+	require.Contains(flows[0].Response.Header.Get("Content-Type"), "javascript")
+	require.Equal("console.log('local')", string(flows[0].Response.Body))
+}
+
+func TestMapRemote(t *testing.T) {
+	require := require.New(t)
+	received := make(chan *http.Request, 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		received <- r
+		w.Write([]byte("from local origin"))
+	}))
+	defer origin.Close()
+
+	e := newTestEngine(t, `
+rules:
+  - match:
+      host: api.example.com
+    request:
+      mapRemote:
+        prefix: /api/
+        url: `+origin.URL+`/v2/
+`)
+	mx, err := core.NewMux(config.Server{}, nil, nil)
+	require.NoError(err)
+	defer mx.Close()
+	mx.Use(e.Handler)
+
+	r, uc := core.TraceUpstream(httptest.NewRequest("GET", "http://api.example.com/api/users?id=1", nil))
+	r.AddCookie(&http.Cookie{Name: "session", Value: "s1"})
+	w := httptest.NewRecorder()
+	mx.ServeHTTP(w, r)
+	require.Equal(http.StatusOK, w.Code)
+	require.Equal("from local origin", w.Body.String())
+
+	got := <-received
+	require.Equal("api.example.com", got.Host)
+	require.Equal("/v2/users?id=1", got.RequestURI)
+	require.Equal("s1", func() string { c, _ := got.Cookie("session"); return c.Value }())
+	require.Equal(origin.URL+"/v2/users?id=1", uc.Mapped())
+	// The request of the client is left alone.
+	require.Equal("/api/users", r.URL.Path)
+	require.Equal(origin.Listener.Addr().String(), uc.Addr())
+}
+
+func TestMapErrors(t *testing.T) {
+	require := require.New(t)
+	for rules, msg := range map[string]string{
+		"rules: [{request: {mapRemote: {url: /relative}}}]":                       "not an absolute http or https url",
+		"rules: [{request: {mapLocal: {prefix: /}}}]":                             "mapLocal needs a path",
+		"rules: [{request: {mapLocal: {path: a}, mapRemote: {url: 'http://b'}}}]": "exclude each other",
+		"rules: [{response: {mapRemote: {url: 'http://b'}}}]":                     "are request actions",
+	} {
+		path := filepath.Join(t.TempDir(), "rules.yaml")
+		require.NoError(os.WriteFile(path, []byte(rules), 0600))
+		_, err := NewEngine(path)
+		require.Error(err, rules)
+		require.Contains(err.Error(), msg, rules)
+	}
+}
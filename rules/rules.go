@@ -0,0 +1,429 @@
+// Package rules modifies proxied traffic according to rules read from a
+// YAML file such as:
+//
+//	rules:
+//	  - name: debug api
+//	    match:
+//	      host: "*.example.com"
+//	      path: "^/api/"
+//	      method: [GET, POST]
+//	      header:
+//	        X-Debug: "^1$"
+//	    request:
+//	      setHeaders:
+//	        X-Env: staging
+//	      removeHeaders: [Cookie]
+//	      rewriteURL:
+//	        pattern: "^/api/v1/"
+//	        replacement: "/api/v2/"
+//	      host: staging.example.com
+//	  - name: local bundle
+//	    match:
+//	      host: www.example.com
+//	    request:
+//	      mapLocal:
+//	        prefix: /static/
+//	        path: ./dist
+//	  - name: local api
+//	    match:
+//	      host: api.example.com
+//	    request:
+//	      mapRemote:
+//	        prefix: /
+//	        url: http://localhost:8080/
+//	    response:
+//	      status: 503
+//	      bodyFile: maintenance.html
+//	      delay: 2s
+//	  - name: no tracking
+//	    match:
+//	      host: "www.example.com"
+//	      status: [200]
+//	    response:
+//	      replaceBody:
+//	        - pattern: "<script src=\"/tracker.js\"></script>"
+//	          replacement: ""
+//
+// A rule applies when all of its match conditions hold: host is a glob on
+// the request host, path a regular expression on the request path, header
+// maps names to regular expressions on the value (an empty expression only
+// requires the header) and status lists response status codes. A rule
+// matching on status only has response actions.
+//
+// The request actions are applied before the request is proxied, the
+// response actions before the response reaches the client. Actions run in
+// this order: rewriteURL, host, mapRemote, removeHeaders, setHeaders,
+// status, bodyFile, replaceBody, delay, mapLocal. Bodies with a
+// Content-Encoding are decoded before replaceBody and sent decoded.
+//
+// mapLocal answers requests whose path starts with prefix from a local
+// file, or from a directory the rest of the path is looked up in, instead
+// of the origin. mapRemote sends them to the scheme, host and port of url,
+// with prefix replaced by the path of url, keeping the original Host
+// header. Both are request actions reported in the access log, and their
+// responses are recorded like those of the origin. mapLocal needs the
+// engine to run as a middleware of a core.Mux.
+package rules
+
+import (
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/millken/httpctl/upstream"
+	"github.com/pkg/errors"
+	"gopkg.in/yaml.v2"
+)
+
+// File is the content of a rules file.
+type File struct {
+	Rules []Rule `yaml:"rules" json:"rules"`
+}
+
+// Rule applies Request and Response actions to the exchanges it matches.
+type Rule struct {
+	Name     string  `yaml:"name" json:"name"`
+	Match    Match   `yaml:"match" json:"match"`
+	Request  Actions `yaml:"request" json:"request"`
+	Response Actions `yaml:"response" json:"response"`
+}
+
+// Match holds the conditions of a Rule, see the package documentation.
+type Match struct {
+	Host   string            `yaml:"host" json:"host"`
+	Path   string            `yaml:"path" json:"path"`
+	Method []string          `yaml:"method" json:"method"`
+	Header map[string]string `yaml:"header" json:"header"`
+	Status []int             `yaml:"status" json:"status"`
+}
+
+// Actions modify a request or a response. RewriteURL and Host only apply to
+// requests, Status only to responses.
+type Actions struct {
+	SetHeaders    map[string]string `yaml:"setHeaders" json:"setHeaders"`
+	RemoveHeaders []string          `yaml:"removeHeaders" json:"removeHeaders"`
+	// RewriteURL is applied to the path and query, such as "/a?b=c".
+	RewriteURL  *Replace      `yaml:"rewriteURL" json:"rewriteURL"`
+	Host        string        `yaml:"host" json:"host"`
+	Status      int           `yaml:"status" json:"status"`
+	BodyFile    string        `yaml:"bodyFile" json:"bodyFile"`
+	ReplaceBody []Replace     `yaml:"replaceBody" json:"replaceBody"`
+	Delay       time.Duration `yaml:"delay" json:"delay"`
+	MapLocal    *MapLocal     `yaml:"mapLocal" json:"mapLocal"`
+	MapRemote   *MapRemote    `yaml:"mapRemote" json:"mapRemote"`
+}
+
+// MapLocal serves requests from local files instead of the origin.
+type MapLocal struct {
+	// Prefix is the request path prefix that is mapped, "/" by default.
+	Prefix string `yaml:"prefix" json:"prefix"`
+	// Path is a file served for every request, or a directory the rest of
+	// the request path is looked up in.
+	Path string `yaml:"path" json:"path"`
+}
+
+// MapRemote proxies requests to another origin.
+type MapRemote struct {
+	// Prefix is the request path prefix that is mapped, "/" by default.
+	Prefix string `yaml:"prefix" json:"prefix"`
+	// URL gives the scheme, host and port requests are sent to; its path
+	// replaces Prefix.
+	URL string `yaml:"url" json:"url"`
+}
+
+// Replace replaces the matches of the regular expression Pattern, which
+// may be referenced as $1 and so on in Replacement.
+type Replace struct {
+	Pattern     string `yaml:"pattern" json:"pattern"`
+	Replacement string `yaml:"replacement" json:"replacement"`
+}
+
+// ruleSet is a loaded rules file.
+type ruleSet struct {
+	file  File
+	rules []*rule
+}
+
+// load reads and compiles the rules file at path. Relative body files are
+// resolved against the directory of path.
+func load(path string) (*ruleSet, error) {
+	body, err := os.ReadFile(path)
+	if err != nil {
+		return nil, errors.Wrap(err, "failed to read rules")
+	}
+	set := &ruleSet{}
+	if err := yaml.UnmarshalStrict(body, &set.file); err != nil {
+		return nil, errors.Wrapf(err, "failed to parse rules '%s'", path)
+	}
+	for i := range set.file.Rules {
+		c, err := compile(&set.file.Rules[i], filepath.Dir(path))
+		if err != nil {
+			name := set.file.Rules[i].Name
+			if name == "" {
+				name = "#" + strconv.Itoa(i+1)
+			}
+			return nil, errors.Wrapf(err, "invalid rule '%s'", name)
+		}
+		set.rules = append(set.rules, c)
+	}
+	return set, nil
+}
+
+// rule is a compiled Rule.
+type rule struct {
+	name     string
+	host     string
+	path     *regexp.Regexp
+	methods  []string
+	headers  map[string]*regexp.Regexp
+	statuses []int
+	request  *actions
+	response *actions
+}
+
+// actions are compiled Actions. A nil *actions does nothing.
+type actions struct {
+	setHeaders    map[string]string
+	removeHeaders []string
+	rewriteURL    *replace
+	host          string
+	status        int
+	body          []byte
+	hasBody       bool
+	replaceBody   []replace
+	delay         time.Duration
+	mapLocal      *mapLocal
+	mapRemote     *mapRemote
+}
+
+type mapLocal struct {
+	prefix string
+	path   string
+}
+
+type mapRemote struct {
+	prefix string
+	target *url.URL
+}
+
+type replace struct {
+	re          *regexp.Regexp
+	replacement []byte
+}
+
+func compile(r *Rule, dir string) (*rule, error) {
+	c := &rule{
+		name:     r.Name,
+		host:     r.Match.Host,
+		statuses: r.Match.Status,
+	}
+	var err error
+	if r.Match.Path != "" {
+		if c.path, err = regexp.Compile(r.Match.Path); err != nil {
+			return nil, errors.Wrap(err, "invalid path")
+		}
+	}
+	for _, method := range r.Match.Method {
+		c.methods = append(c.methods, strings.ToUpper(method))
+	}
+	if len(r.Match.Header) > 0 {
+		c.headers = make(map[string]*regexp.Regexp, len(r.Match.Header))
+		for name, pattern := range r.Match.Header {
+			if c.headers[http.CanonicalHeaderKey(name)], err = regexp.Compile(pattern); err != nil {
+				return nil, errors.Wrapf(err, "invalid header '%s'", name)
+			}
+		}
+	}
+
+	if c.request, err = compileActions(&r.Request, dir); err != nil {
+		return nil, errors.Wrap(err, "invalid request actions")
+	}
+	if c.response, err = compileActions(&r.Response, dir); err != nil {
+		return nil, errors.Wrap(err, "invalid response actions")
+	}
+	switch {
+	case c.request != nil && c.request.status != 0:
+		return nil, errors.New("status is a response action")
+	case c.response != nil && (c.response.rewriteURL != nil || c.response.host != "" ||
+		c.response.mapLocal != nil || c.response.mapRemote != nil):
+		return nil, errors.New("rewriteURL, host, mapLocal and mapRemote are request actions")
+	case c.request != nil && len(c.statuses) > 0:
+		return nil, errors.New("rules matching on status only have response actions")
+	case c.request == nil && c.response == nil:
+		return nil, errors.New("no actions")
+	}
+	return c, nil
+}
+
+func compileActions(a *Actions, dir string) (*actions, error) {
+	c := &actions{
+		setHeaders:    a.SetHeaders,
+		removeHeaders: a.RemoveHeaders,
+		host:          a.Host,
+		status:        a.Status,
+		delay:         a.Delay,
+	}
+	if a.Status != 0 && (a.Status < 100 || a.Status > 999) {
+		return nil, errors.Errorf("invalid status %d", a.Status)
+	}
+	if a.RewriteURL != nil {
+		rp, err := compileReplace(a.RewriteURL)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid rewriteURL")
+		}
+		c.rewriteURL = &rp
+	}
+	if a.BodyFile != "" {
+		name := a.BodyFile
+		if !filepath.IsAbs(name) {
+			name = filepath.Join(dir, name)
+		}
+		body, err := os.ReadFile(name)
+		if err != nil {
+			return nil, errors.Wrap(err, "failed to read body file")
+		}
+		c.body, c.hasBody = body, true
+	}
+	for i := range a.ReplaceBody {
+		rp, err := compileReplace(&a.ReplaceBody[i])
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid replaceBody")
+		}
+		c.replaceBody = append(c.replaceBody, rp)
+	}
+	if a.MapLocal != nil {
+		if a.MapRemote != nil {
+			return nil, errors.New("mapLocal and mapRemote exclude each other")
+		}
+		if a.MapLocal.Path == "" {
+			return nil, errors.New("mapLocal needs a path")
+		}
+		c.mapLocal = &mapLocal{prefix: mapPrefix(a.MapLocal.Prefix), path: a.MapLocal.Path}
+		if !filepath.IsAbs(c.mapLocal.path) {
+			c.mapLocal.path = filepath.Join(dir, c.mapLocal.path)
+		}
+	}
+	if a.MapRemote != nil {
+		target, err := url.Parse(a.MapRemote.URL)
+		if err != nil {
+			return nil, errors.Wrap(err, "invalid mapRemote url")
+		}
+		if (target.Scheme != "http" && target.Scheme != "https") || target.Host == "" {
+			return nil, errors.Errorf("mapRemote url '%s' is not an absolute http or https url", a.MapRemote.URL)
+		}
+		c.mapRemote = &mapRemote{prefix: mapPrefix(a.MapRemote.Prefix), target: target}
+	}
+	if len(c.setHeaders) == 0 && len(c.removeHeaders) == 0 && c.rewriteURL == nil && c.host == "" &&
+		c.status == 0 && !c.hasBody && len(c.replaceBody) == 0 && c.delay == 0 &&
+		c.mapLocal == nil && c.mapRemote == nil {
+		return nil, nil
+	}
+	return c, nil
+}
+
+func compileReplace(r *Replace) (replace, error) {
+	re, err := regexp.Compile(r.Pattern)
+	if err != nil {
+		return replace{}, err
+	}
+	return replace{re: re, replacement: []byte(r.Replacement)}, nil
+}
+
+// matchRequest returns true if r satisfies the conditions of the rule
+// other than status.
+func (c *rule) matchRequest(r *http.Request) bool {
+	if c.host != "" && !upstream.MatchHost(c.host, hostname(r.Host)) {
+		return false
+	}
+	if c.path != nil && !c.path.MatchString(r.URL.Path) {
+		return false
+	}
+	if len(c.methods) > 0 && !containsString(c.methods, r.Method) {
+		return false
+	}
+	for name, re := range c.headers {
+		values, ok := r.Header[name]
+		if !ok {
+			return false
+		}
+		matched := false
+		for _, v := range values {
+			if re.MatchString(v) {
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false
+		}
+	}
+	return true
+}
+
+// matchStatus returns true if the rule applies to a response with status.
+func (c *rule) matchStatus(status int) bool {
+	if len(c.statuses) == 0 {
+		return true
+	}
+	for _, s := range c.statuses {
+		if s == status {
+			return true
+		}
+	}
+	return false
+}
+
+// modifiesBody returns true if the actions replace or rewrite the body.
+func (a *actions) modifiesBody() bool {
+	return a.hasBody || len(a.replaceBody) > 0
+}
+
+// applyHeaders removes and then sets the headers of the actions in h.
+func (a *actions) applyHeaders(h http.Header) {
+	for _, name := range a.removeHeaders {
+		h.Del(name)
+	}
+	for name, value := range a.setHeaders {
+		h.Set(name, value)
+	}
+}
+
+// applyBody returns body replaced by the body file, if any, and with the
+// replacements applied.
+func (a *actions) applyBody(body []byte) []byte {
+	if a.hasBody {
+		body = a.body
+	}
+	for _, rp := range a.replaceBody {
+		body = rp.re.ReplaceAll(body, rp.replacement)
+	}
+	return body
+}
+
+func mapPrefix(prefix string) string {
+	if !strings.HasPrefix(prefix, "/") {
+		prefix = "/" + prefix
+	}
+	return prefix
+}
+
+func hostname(host string) string {
+	if i := strings.LastIndexByte(host, ':'); i >= 0 && !strings.HasSuffix(host, "]") {
+		host = host[:i]
+	}
+	return strings.Trim(host, "[]")
+}
+
+func containsString(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,332 @@
+package rules
+
+import (
+	"compress/gzip"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/require"
+)
+
+func newTestEngine(t *testing.T, rules string) *Engine {
+	path := filepath.Join(t.TempDir(), "rules.yaml")
+	require.NoError(t, os.WriteFile(path, []byte(rules), 0600))
+	e, err := NewEngine(path)
+	require.NoError(t, err)
+	return e
+}
+
+// echo answers with what it received, so request actions can be checked
+// on the response.
+var echo = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	body, _ := io.ReadAll(r.Body)
+	w.Header().Set("X-Host", r.Host)
+	w.Header().Set("X-Uri", r.URL.RequestURI())
+	w.Header().Set("X-Auth", r.Header.Get("Authorization"))
+	w.Header().Set("X-Env", r.Header.Get("X-Env"))
+	w.Header().Set("Server", "origin")
+	w.Write(body)
+})
+
+func serve(e *Engine, next http.Handler, r *http.Request) *httptest.ResponseRecorder {
+	w := httptest.NewRecorder()
+	e.Handler(next).ServeHTTP(w, r)
+	return w
+}
+
+func TestMatch(t *testing.T) {
+	require := require.New(t)
+	e := newTestEngine(t, `
+rules:
+  - name: api
+    match:
+      host: "*.example.com"
+      path: "^/api/"
+      method: [post]
+      header:
+        X-Debug: "^1$"
+        X-Trace: ""
+    response:
+      setHeaders:
+        X-Matched: "yes"
+`)
+	match := func(method, target string, header http.Header) bool {
+		r := httptest.NewRequest(method, target, nil)
+		for name, values := range header {
+			r.Header[name] = values
+		}
+		return serve(e, echo, r).Header().Get("X-Matched") == "yes"
+	}
+	header := http.Header{"X-Debug": {"1"}, "X-Trace": {"abc"}}
+	require.True(match("POST", "http://www.example.com:8080/api/users", header))
+	require.False(match("GET", "http://www.example.com/api/users", header))
+	require.False(match("POST", "http://example.org/api/users", header))
+	require.False(match("POST", "http://www.example.com/web/", header))
+	require.False(match("POST", "http://www.example.com/api/", http.Header{"X-Debug": {"2"}, "X-Trace": {"abc"}}))
+	require.False(match("POST", "http://www.example.com/api/", http.Header{"X-Debug": {"1"}}))
+}
+
+func TestMatchStatus(t *testing.T) {
+	require := require.New(t)
+	e := newTestEngine(t, `
+rules:
+  - match:
+      status: [404]
+    response:
+      setHeaders:
+        X-Missing: "yes"
+`)
+	w := serve(e, http.NotFoundHandler(), httptest.NewRequest("GET", "http://example.com/", nil))
+	require.Equal("yes", w.Header().Get("X-Missing"))
+	w = serve(e, echo, httptest.NewRequest("GET", "http://example.com/", nil))
+	require.Empty(w.Header().Get("X-Missing"))
+}
+
+func TestSetHeaders(t *testing.T) {
+	require := require.New(t)
+	e := newTestEngine(t, `
+rules:
+  - request:
+      setHeaders:
+        X-Env: staging
+    response:
+      setHeaders:
+        Server: httpctl
+`)
+	w := serve(e, echo, httptest.NewRequest("GET", "http://example.com/", nil))
+	require.Equal("staging", w.Header().Get("X-Env"))
+	require.Equal("httpctl", w.Header().Get("Server"))
+}
+
+func TestRemoveHeaders(t *testing.T) {
+	require := require.New(t)
+	e := newTestEngine(t, `
+rules:
+  - request:
+      removeHeaders: [Authorization]
+    response:
+      removeHeaders: [Server]
+`)
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.Header.Set("Authorization", "Bearer secret")
+	w := serve(e, echo, r)
+	require.Empty(w.Header().Get("X-Auth"))
+	require.NotContains(w.Header(), "Server")
+}
+
+func TestRewriteURL(t *testing.T) {
+	require := require.New(t)
+	e := newTestEngine(t, `
+rules:
+  - request:
+      rewriteURL:
+        pattern: "^/api/v1/(.*)$"
+        replacement: "/api/v2/$1"
+`)
+	w := serve(e, echo, httptest.NewRequest("GET", "http://example.com/api/v1/users?id=1", nil))
+	require.Equal("/api/v2/users?id=1", w.Header().Get("X-Uri"))
+}
+
+func TestHost(t *testing.T) {
+	require := require.New(t)
+	e := newTestEngine(t, `
+rules:
+  - match:
+      host: example.com
+    request:
+      host: staging.example.com:8443
+`)
+	w := serve(e, echo, httptest.NewRequest("GET", "http://example.com/", nil))
+	require.Equal("staging.example.com:8443", w.Header().Get("X-Host"))
+}
+
+func TestStatus(t *testing.T) {
+	require := require.New(t)
+	e := newTestEngine(t, `
+rules:
+  - response:
+      status: 503
+`)
+	w := serve(e, echo, httptest.NewRequest("POST", "http://example.com/", strings.NewReader("unchanged")))
+	require.Equal(http.StatusServiceUnavailable, w.Code)
+	require.Equal("unchanged", w.Body.String())
+}
+
+func TestBodyFile(t *testing.T) {
+	require := require.New(t)
+	dir := t.TempDir()
+	require.NoError(os.WriteFile(filepath.Join(dir, "request.json"), []byte(`{"mocked":true}`), 0600))
+	require.NoError(os.WriteFile(filepath.Join(dir, "maintenance.html"), []byte("<h1>down</h1>"), 0600))
+	path := filepath.Join(dir, "rules.yaml")
+	require.NoError(os.WriteFile(path, []byte(`
+rules:
+  - match:
+      path: ^/request
+    request:
+      bodyFile: request.json
+  - match:
+      path: ^/response
+    response:
+      bodyFile: maintenance.html
+`), 0600))
+	e, err := NewEngine(path)
+	require.NoError(err)
+
+	w := serve(e, echo, httptest.NewRequest("POST", "http://example.com/request", strings.NewReader("original")))
+	require.Equal(`{"mocked":true}`, w.Body.String())
+
+	w = serve(e, echo, httptest.NewRequest("POST", "http://example.com/response", strings.NewReader("original")))
+	require.Equal("<h1>down</h1>", w.Body.String())
+	require.Equal("13", w.Header().Get("Content-Length"))
+}
+
+func TestReplaceBody(t *testing.T) {
+	require := require.New(t)
+	e := newTestEngine(t, `
+rules:
+  - request:
+      replaceBody:
+        - pattern: "secret"
+          replacement: "xxx"
+    response:
+      replaceBody:
+        - pattern: "user=(\\w+)"
+          replacement: "name=$1"
+`)
+	w := serve(e, echo, httptest.NewRequest("POST", "http://example.com/", strings.NewReader("user=me&pass=secret")))
+	require.Equal("name=me&pass=xxx", w.Body.String())
+
+	// Encoded bodies are decoded before the replacement and sent decoded.
+	gzipped := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Encoding", "gzip")
+		zw := gzip.NewWriter(w)
+		io.WriteString(zw, "user=you")
+		zw.Close()
+	})
+	w = serve(e, gzipped, httptest.NewRequest("GET", "http://example.com/", nil))
+	require.Equal("name=you", w.Body.String())
+	require.Empty(w.Header().Get("Content-Encoding"))
+}
+
+func TestReplaceBody_TooLarge(t *testing.T) {
+	require := require.New(t)
+	defer func(n int) { MaxBodySize = n }(MaxBodySize)
+	MaxBodySize = 8
+	e := newTestEngine(t, `
+rules:
+  - request:
+      replaceBody:
+        - pattern: "a"
+          replacement: "b"
+    response:
+      replaceBody:
+        - pattern: "a"
+          replacement: "b"
+`)
+	body := strings.Repeat("a", 20)
+	w := serve(e, echo, httptest.NewRequest("POST", "http://example.com/", strings.NewReader(body)))
+	require.Equal(body, w.Body.String())
+}
+
+func TestReplaceBody_Undecodable(t *testing.T) {
+	require := require.New(t)
+	e := newTestEngine(t, `
+rules:
+  - request:
+      replaceBody:
+        - pattern: "a"
+          replacement: "b"
+`)
+	// Bodies that cannot be decoded are sent unchanged.
+	for _, coding := range []string{"gzip", "compress"} {
+		r := httptest.NewRequest("POST", "http://example.com/", strings.NewReader("not encoded"))
+		r.Header.Set("Content-Encoding", coding)
+		w := serve(e, echo, r)
+		require.Equal("not encoded", w.Body.String(), coding)
+	}
+}
+
+func TestDelay(t *testing.T) {
+	require := require.New(t)
+	e := newTestEngine(t, `
+rules:
+  - request:
+      delay: 50ms
+    response:
+      delay: 50ms
+`)
+	start := time.Now()
+	w := serve(e, echo, httptest.NewRequest("GET", "http://example.com/", nil))
+	require.Equal(http.StatusOK, w.Code)
+	require.True(time.Since(start) >= 100*time.Millisecond)
+
+	// A request whose client is gone is not held.
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	called := false
+	serve(e, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { called = true }),
+		httptest.NewRequest("GET", "http://example.com/", nil).WithContext(ctx))
+	require.False(called)
+}
+
+func TestLoadErrors(t *testing.T) {
+	require := require.New(t)
+	for rules, msg := range map[string]string{
+		"rules: [{response: {status: 42}}]":                       "invalid status 42",
+		"rules: [{request: {status: 500}}]":                       "status is a response action",
+		"rules: [{response: {host: example.com}}]":                "are request actions",
+		"rules: [{match: {status: [200]}, request: {delay: 1s}}]": "only have response actions",
+		"rules: [{name: empty}]":                                  "invalid rule 'empty': no actions",
+		"rules: [{match: {path: '('}, response: {status: 500}}]":  "invalid path",
+		"rules: [{response: {bodyFile: missing.html}}]":           "failed to read body file",
+		"rules: [{response: {replaceBody: [{pattern: '['}]}}]":    "invalid replaceBody",
+		"rules: [{response: {unknown: 1}}]":                       "failed to parse rules",
+	} {
+		path := filepath.Join(t.TempDir(), "rules.yaml")
+		require.NoError(os.WriteFile(path, []byte(rules), 0600))
+		_, err := NewEngine(path)
+		require.Error(err, rules)
+		require.Contains(err.Error(), msg, rules)
+	}
+}
+
+func TestWatch(t *testing.T) {
+	require := require.New(t)
+	e := newTestEngine(t, "rules: [{response: {setHeaders: {X-Version: '1'}}}]")
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go e.Watch(ctx, 10*time.Millisecond)
+
+	version := func() string {
+		return serve(e, echo, httptest.NewRequest("GET", "http://example.com/", nil)).Header().Get("X-Version")
+	}
+	require.Equal("1", version())
+
+	// An invalid file keeps the current rules.
+	require.NoError(os.WriteFile(e.path, []byte("rules: [{response: {status: 1}}]"), 0600))
+	time.Sleep(50 * time.Millisecond)
+	require.Equal("1", version())
+
+	require.NoError(os.WriteFile(e.path, []byte("rules: [{response: {setHeaders: {X-Version: '22'}}}]"), 0600))
+	require.Eventually(func() bool { return version() == "22" }, time.Second, 10*time.Millisecond)
+	require.Len(e.Rules(), 1)
+}
+
+func TestUpgradeNotModified(t *testing.T) {
+	require := require.New(t)
+	e := newTestEngine(t, "rules: [{response: {bodyFile: rules.yaml}}]")
+	r := httptest.NewRequest("GET", "http://example.com/", nil)
+	r.Header.Set("Connection", "Upgrade")
+	r.Header.Set("Upgrade", "websocket")
+	var got http.ResponseWriter
+	w := httptest.NewRecorder()
+	e.Handler(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) { got = w })).ServeHTTP(w, r)
+	require.Equal(w, got)
+}
@@ -0,0 +1,290 @@
+package upstream
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"net/url"
+	"path"
+	"strings"
+	"time"
+
+	"github.com/millken/httpctl/config"
+	"github.com/millken/httpctl/resolver"
+	"github.com/pkg/errors"
+	"golang.org/x/net/proxy"
+)
+
+type rule struct {
+	hosts []string
+	proxy *Proxy
+}
+
+// Dialer opens connections to origin servers, either directly or through the
+// upstream proxy selected for the target host.
+//
+// Hostnames are resolved with the custom resolver rather than the system one,
+// because in DNS-hijack mode the system resolver points back at httpctl.
+type Dialer struct {
+	dialer *net.Dialer
+	// lookup resolves hosts with the custom resolver. When nil, hosts are
+	// left to the system resolver.
+	lookup func(host string) ([]string, error)
+	proxy  *Proxy
+	rules  []rule
+}
+
+// NewDialer returns a Dialer that uses defaultProxy for every host not matched
+// by one of the rules. A nil resolver falls back to the system resolver.
+func NewDialer(defaultProxy string, rules []config.ProxyRule, resolver *resolver.Resolver) (*Dialer, error) {
+	p, err := ParseProxy(defaultProxy)
+	if err != nil {
+		return nil, err
+	}
+	d := &Dialer{
+		dialer: &net.Dialer{
+			Timeout:   30 * time.Second,
+			KeepAlive: 30 * time.Second,
+		},
+		proxy: p,
+	}
+	if resolver != nil {
+		d.lookup = func(host string) ([]string, error) {
+			ips, _, err := resolver.Lookup(host)
+			return ips, err
+		}
+	}
+	for _, r := range rules {
+		p, err := ParseProxy(r.Proxy)
+		if err != nil {
+			return nil, err
+		}
+		hosts := make([]string, 0, len(r.Hosts))
+		for _, host := range r.Hosts {
+			host = strings.ToLower(host)
+			if _, err := path.Match(host, ""); err != nil {
+				return nil, errors.Wrapf(err, "invalid proxy rule host '%s'", host)
+			}
+			hosts = append(hosts, host)
+		}
+		d.rules = append(d.rules, rule{hosts: hosts, proxy: p})
+	}
+	return d, nil
+}
+
+// Proxy returns the upstream proxy used for host. The first matching rule
+// wins; hosts without a matching rule use the default proxy.
+func (d *Dialer) Proxy(host string) *Proxy {
+	if h, _, err := net.SplitHostPort(host); err == nil {
+		host = h
+	}
+	for _, r := range d.rules {
+		for _, pattern := range r.hosts {
+			if MatchHost(pattern, host) {
+				return r.proxy
+			}
+		}
+	}
+	return d.proxy
+}
+
+// MatchHost reports whether host, without port, matches the glob pattern,
+// such as "*.example.com". Matching is case-insensitive.
+func MatchHost(pattern, host string) bool {
+	ok, _ := path.Match(strings.ToLower(pattern), strings.ToLower(host))
+	return ok
+}
+
+// DialContext connects to addr through the proxy selected for its host.
+func (d *Dialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	p := d.Proxy(addr)
+	switch p.Scheme {
+	case SchemeSOCKS5, SchemeSOCKS5H:
+		return d.dialSOCKS5(ctx, p, network, addr)
+	case SchemeHTTP, SchemeHTTPS:
+		return d.dialConnect(ctx, p, network, addr)
+	default:
+		return d.dialDirect(ctx, network, addr)
+	}
+}
+
+// dialDirect connects to addr, trying each resolved IP in turn until one
+// accepts the connection.
+func (d *Dialer) dialDirect(ctx context.Context, network, addr string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	if d.lookup == nil || net.ParseIP(host) != nil {
+		return d.dialer.DialContext(ctx, network, addr)
+	}
+	// The custom resolver is invisible to net/http, so report the lookup to
+	// the request trace like the system resolver would.
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.DNSStart != nil {
+		trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+	}
+	ips, err := d.Lookup(host)
+	if trace != nil && trace.DNSDone != nil {
+		info := httptrace.DNSDoneInfo{Err: err}
+		for _, ip := range ips {
+			info.Addrs = append(info.Addrs, net.IPAddr{IP: net.ParseIP(ip)})
+		}
+		trace.DNSDone(info)
+	}
+	if err != nil {
+		return nil, err
+	}
+	var lastErr error
+	for _, ip := range ips {
+		conn, err := d.dialer.DialContext(ctx, network, net.JoinHostPort(ip, port))
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = err
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, errors.Wrapf(lastErr, "failed to dial host '%s'", addr)
+}
+
+// Lookup returns the IP addresses of host from the custom resolver.
+func (d *Dialer) Lookup(host string) ([]string, error) {
+	lookup := d.lookup
+	if lookup == nil {
+		lookup = func(host string) ([]string, error) {
+			return net.DefaultResolver.LookupHost(context.Background(), host)
+		}
+	}
+	ips, err := lookup(host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to lookup host '%s'", host)
+	}
+	if len(ips) == 0 {
+		return nil, errors.Errorf("no addresses for host '%s'", host)
+	}
+	return ips, nil
+}
+
+func (d *Dialer) dialSOCKS5(ctx context.Context, p *Proxy, network, addr string) (net.Conn, error) {
+	var auth *proxy.Auth
+	if p.User != nil {
+		password, _ := p.User.Password()
+		auth = &proxy.Auth{User: p.User.Username(), Password: password}
+	}
+	// With plain socks5 the target is resolved locally and only the IP is
+	// handed to the proxy, trying each resolved IP in turn like dialDirect.
+	targets := []string{addr}
+	if p.Scheme == SchemeSOCKS5 {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return nil, err
+		}
+		if net.ParseIP(host) == nil {
+			ips, err := d.Lookup(host)
+			if err != nil {
+				return nil, err
+			}
+			targets = targets[:0]
+			for _, ip := range ips {
+				targets = append(targets, net.JoinHostPort(ip, port))
+			}
+		}
+	}
+	socks, err := proxy.SOCKS5("tcp", p.Host, auth, directDialer{d})
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to create SOCKS5 dialer for '%s'", p)
+	}
+	var lastErr error
+	for _, target := range targets {
+		conn, err := socks.(proxy.ContextDialer).DialContext(ctx, network, target)
+		if err == nil {
+			return conn, nil
+		}
+		lastErr = errors.Wrapf(err, "failed to dial '%s' via '%s'", target, p)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, lastErr
+}
+
+// dialConnect opens a tunnel to addr with an HTTP CONNECT request.
+func (d *Dialer) dialConnect(ctx context.Context, p *Proxy, network, addr string) (net.Conn, error) {
+	conn, err := d.dialDirect(ctx, "tcp", p.Host)
+	if err != nil {
+		return nil, errors.Wrapf(err, "failed to dial proxy '%s'", p)
+	}
+	if p.Scheme == SchemeHTTPS {
+		host, _, _ := net.SplitHostPort(p.Host)
+		tlsConn := tls.Client(conn, &tls.Config{ServerName: host})
+		if err := tlsConn.HandshakeContext(ctx); err != nil {
+			conn.Close()
+			return nil, errors.Wrapf(err, "failed to handshake with proxy '%s'", p)
+		}
+		conn = tlsConn
+	}
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+		defer conn.SetDeadline(time.Time{})
+	}
+
+	req := &http.Request{
+		Method: http.MethodConnect,
+		URL:    &url.URL{Opaque: addr},
+		Host:   addr,
+		Header: make(http.Header),
+	}
+	if p.User != nil {
+		password, _ := p.User.Password()
+		credentials := p.User.Username() + ":" + password
+		req.Header.Set("Proxy-Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(credentials)))
+	}
+	if err := req.Write(conn); err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "failed to send CONNECT to proxy '%s'", p)
+	}
+	br := bufio.NewReader(conn)
+	res, err := http.ReadResponse(br, req)
+	if err != nil {
+		conn.Close()
+		return nil, errors.Wrapf(err, "failed to read CONNECT response from proxy '%s'", p)
+	}
+	res.Body.Close()
+	if res.StatusCode != http.StatusOK {
+		conn.Close()
+		return nil, errors.Errorf("proxy '%s' refused CONNECT to '%s': %s", p, addr, res.Status)
+	}
+	if br.Buffered() > 0 {
+		return &bufferedConn{Conn: conn, r: br}, nil
+	}
+	return conn, nil
+}
+
+// directDialer reaches SOCKS5 proxies through Dialer.dialDirect.
+type directDialer struct {
+	d *Dialer
+}
+
+func (dd directDialer) Dial(network, addr string) (net.Conn, error) {
+	return dd.d.dialDirect(context.Background(), network, addr)
+}
+
+func (dd directDialer) DialContext(ctx context.Context, network, addr string) (net.Conn, error) {
+	return dd.d.dialDirect(ctx, network, addr)
+}
+
+// bufferedConn keeps bytes the proxy sent right after its CONNECT response.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}